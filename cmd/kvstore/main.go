@@ -2,6 +2,7 @@ package main
 
 import (
 	"cs553/pkg/api"
+	"cs553/pkg/cluster"
 	"cs553/pkg/config"
 	"cs553/pkg/db"
 	"cs553/pkg/replication"
@@ -9,15 +10,19 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
 var (
-	dbLocation  = flag.String("db-location", "", "path for the db")
-	httpAddress = flag.String("http-address", "127.0.0.1:8080", "HTTP host address")
-	configFile  = flag.String("config-file", "config.yaml", "config file for sharding")
-	dbType      = flag.String("db-type", "bolt", "which DB to use for storage, bolt or badger")
-	shardName   = flag.String("shard", "", "name of shard for data")
-	replica     = flag.Bool("replica", false, "run as a read-only replica")
+	dbLocation       = flag.String("db-location", "", "path for the db")
+	httpAddress      = flag.String("http-address", "127.0.0.1:8080", "HTTP host address")
+	configFile       = flag.String("config-file", "config.yaml", "config file for sharding")
+	dbType           = flag.String("db-type", "bolt", "which DB to use for storage, bolt or badger")
+	shardName        = flag.String("shard", "", "name of shard for data")
+	replica          = flag.Bool("replica", false, "run as a read-only replica")
+	maxKeySize       = flag.Int("max-key-size", 4096, "largest key in bytes that is accepted")
+	maxValueSize     = flag.Int64("max-value-size", 8<<20, "largest value in bytes that is accepted")
+	versionRetention = flag.Duration("version-retention", time.Minute, "how long overwritten and deleted versions stay readable at an earlier read timestamp")
 )
 
 func parseFlags() {
@@ -30,10 +35,6 @@ func parseFlags() {
 	if (*dbType != "bolt") && (*dbType != "badger") {
 		log.Fatalf("db-type must be one of bolt or badger")
 	}
-
-	if (*dbType == "badger") && (*replica) {
-		log.Fatalf("replicas are not supported with badger")
-	}
 }
 
 func main() {
@@ -46,6 +47,7 @@ func main() {
 		log.Fatalf("NewDatabase(%q): %v", *dbLocation, err)
 	}
 	defer close()
+	newdb.SetVersionRetention(*versionRetention)
 
 	// parse config
 	config, err := config.NewConfig(*configFile, *shardName)
@@ -56,21 +58,80 @@ func main() {
 		log.Fatalf("Could not find shard with name %v in config \n", *shardName)
 	}
 
-	if *replica {
-		masterAddress, ok := config.ShardToAddress[config.ShardIndex]
-		if !ok {
-			log.Fatalf("Could not address for master shard")
+	membership, err := cluster.NewMembership(config, newdb)
+	if err != nil {
+		log.Fatalf("Could not load cluster membership: %v", err)
+	}
+	// a reshard may have replaced the layout of config.yaml
+	config = membership.Config()
+	shard, _ := config.GetShard(config.ShardIndex)
+
+	var failover *replication.Failover
+	var raftNode *replication.RaftNode
+	if shard.UsesRaft() {
+		// every member of a raft group applies the log to its own db
+		newdb.SetReplicaMode(false)
+		var closeRaft func() error
+		raftNode, closeRaft, err = replication.NewRaftNode(newdb, shard, *httpAddress, *dbLocation+"-raft")
+		if err != nil {
+			log.Fatalf("Could not start raft: %v", err)
+		}
+		defer closeRaft()
+		membership.Sync(*httpAddress)
+	} else {
+		// the replica flag only sets the starting role, failover decides
+		// the role from then on
+		failover, err = replication.NewFailover(newdb, membership, shard, *httpAddress)
+		if err != nil {
+			log.Fatalf("Could not set up failover: %v", err)
 		}
-		go replication.PropagateReplication(newdb, masterAddress)
+		failover.Start()
 	}
 
 	// set up the api http server
-	ws := api.NewWebServer(newdb, config)
+	limits := api.Limits{MaxKeySize: *maxKeySize, MaxValueSize: *maxValueSize}
+	ws := api.NewWebServer(newdb, membership, failover, raftNode, *httpAddress, limits)
+	ws.StartRecovery()
+	http.HandleFunc("/v1/keys/", ws.KeysHandler)
+	http.HandleFunc("/v1/batch/get", ws.BatchGetHandler)
+	http.HandleFunc("/v1/batch/put", ws.BatchPutHandler)
+	http.HandleFunc("/v1/scan", ws.ScanHandler)
+	http.HandleFunc("/v1/incr/", ws.CounterHandler)
+	http.HandleFunc("/v1/decr/", ws.CounterHandler)
+	http.HandleFunc("/v1/add/", ws.CounterHandler)
+	http.HandleFunc("/v1/txn", ws.TxnHandler)
+	http.HandleFunc("/v1/watch", ws.WatchHandler)
+	http.HandleFunc("/v1/leases", ws.LeasesHandler)
+	http.HandleFunc("/v1/leases/", ws.LeasesHandler)
+	http.HandleFunc("/v1/locks/", ws.LocksHandler)
+	// the original text api, kept for existing clients
 	http.HandleFunc("/get", ws.GetHandler)
 	http.HandleFunc("/put", ws.PutHandler)
+	http.HandleFunc("/delete", ws.DeleteHandler)
 	http.HandleFunc("/clean", ws.CleanHandler)
-	http.HandleFunc("/get-next-replication-key", ws.GetNextReplicationKeyHandler)
-	http.HandleFunc("/delete-next-replication-key", ws.DeleteReplicationKeyHandler)
+	http.HandleFunc("/cluster/master", ws.ClusterMasterHandler)
+	http.HandleFunc("/admin/reshard", ws.AdminReshardHandler)
+	http.HandleFunc("/admin/split", ws.AdminSplitHandler)
+	http.HandleFunc("/admin/merge", ws.AdminMergeHandler)
+	http.HandleFunc("/reshard/begin", ws.ReshardBeginHandler)
+	http.HandleFunc("/reshard/copy", ws.ReshardCopyHandler)
+	http.HandleFunc("/reshard/commit", ws.ReshardCommitHandler)
+	http.HandleFunc("/reshard/abort", ws.ReshardAbortHandler)
+	http.HandleFunc("/reshard/import", ws.ReshardImportHandler)
+	http.HandleFunc("/txn/prepare", ws.TxnPrepareHandler)
+	http.HandleFunc("/txn/commit", ws.TxnCommitHandler)
+	http.HandleFunc("/txn/abort", ws.TxnAbortHandler)
+	http.HandleFunc("/txn/decision", ws.TxnDecisionHandler)
+	if raftNode != nil {
+		http.HandleFunc("/raft/read-index", ws.ReadIndexHandler)
+	} else {
+		http.HandleFunc("/replication/stream", ws.ReplicationStreamHandler)
+		http.HandleFunc("/replication/snapshot", ws.ReplicationSnapshotHandler)
+		http.HandleFunc("/merkle", ws.MerkleHandler)
+		http.HandleFunc("/merkle/keys", ws.MerkleKeysHandler)
+		http.HandleFunc("/cluster/heartbeat", ws.HeartbeatHandler)
+		http.HandleFunc("/cluster/vote", ws.VoteHandler)
+	}
 
 	fmt.Printf("Spinning up http server at %s with shard %s at index %d \n", *httpAddress, *shardName, config.ShardIndex)
 	log.Fatal(http.ListenAndServe(*httpAddress, nil))
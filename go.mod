@@ -5,6 +5,7 @@ go 1.14
 require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/dgraph-io/badger/v3 v3.2103.2
-	golang.org/x/sys v0.0.0-20220503163025-988cb79eb6c6 // indirect
+	github.com/hashicorp/raft v1.7.1
+	github.com/hashicorp/raft-boltdb v0.0.0-20230125174641-2a8082862702
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -1,45 +1,311 @@
 package api
 
 import (
+	"cs553/pkg/cluster"
 	"cs553/pkg/config"
 	"cs553/pkg/db"
+	"cs553/pkg/merkle"
 	"cs553/pkg/replication"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxReplicationBatch = 1000
+	maxReplicationWait  = 30 * time.Second
+	// a repair pass takes one request per level, so reuse the tree for a
+	// little while rather than rebuilding it each time
+	merkleMaxAge = 2 * time.Second
 )
 
 type WebServer struct {
-	db     db.Database
-	config *config.Config
+	db          db.Database
+	membership  *cluster.Membership
+	resharder   *cluster.Resharder
+	failover    *replication.Failover
+	raft        *replication.RaftNode
+	merkle      *merkle.Cache
+	proxy       *proxy
+	coordinator *coordinator
+	// self is the http address of the node
+	self   string
+	limits Limits
+}
+
+// Limits caps the size of the keys and values a node accepts.
+type Limits struct {
+	MaxKeySize   int
+	MaxValueSize int64
 }
 
-func NewWebServer(db db.Database, config *config.Config) *WebServer {
+// NewWebServer takes the failover of a shard replicated by its master, or
+// the raft node of a shard replicated through raft. The other one is nil.
+func NewWebServer(database db.Database, membership *cluster.Membership, failover *replication.Failover, raft *replication.RaftNode, self string, limits Limits) *WebServer {
 	return &WebServer{
-		db:     db,
-		config: config,
+		db:          database,
+		membership:  membership,
+		resharder:   cluster.NewResharder(database, membership),
+		failover:    failover,
+		raft:        raft,
+		merkle:      merkle.NewCache(db.ForEachValue(database), merkleMaxAge),
+		proxy:       newProxy(),
+		coordinator: newCoordinator(database),
+		self:        self,
+		limits:      limits,
 	}
 }
 
-func (ws *WebServer) redirectToCorrectShard(shardIndex int, w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get("http://" + ws.config.ShardToAddress[shardIndex] + r.RequestURI)
-	fmt.Fprintf(w, "redirecting from shard %d to shard %d \n", ws.config.ShardIndex, shardIndex)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "error with redirecting request %v \n", err)
+// forwardToShard passes a request on to the master of the shard that owns
+// its key. Clients that ask for redirect=true are sent there with a 307
+// instead, so that they can go straight to the owner next time.
+func (ws *WebServer) forwardToShard(shardIndex int, w http.ResponseWriter, r *http.Request) {
+	// nodes commit a reshard one after another, and one that already has
+	// sends us the keys that move here
+	if hops, _ := strconv.Atoi(r.Header.Get(hopsHeader)); hops > 0 && ws.resharder.Resharding() {
+		if !ws.resharder.AwaitCommit(reshardWait) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "shard %d has not committed the reshard yet \n", ws.config().ShardIndex)
+			return
+		}
+		// routed again by the layout we just committed
+		ws.proxy.forward(w, r, ws.self)
+		return
+	}
+	address := ws.membership.Master(shardIndex).Address
+	if r.Form.Get("redirect") == "true" {
+		redirect(w, r, address, shardIndex)
 		return
 	}
-	defer resp.Body.Close()
-	io.Copy(w, resp.Body)
-	return
+	ws.proxy.forward(w, r, address)
+}
+
+// forwardToLeader passes a write on to the raft leader of our shard.
+func (ws *WebServer) forwardToLeader(w http.ResponseWriter, r *http.Request) {
+	leader := ws.raft.Leader()
+	if leader == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "shard %d has no raft leader \n", ws.config().ShardIndex)
+		return
+	}
+	ws.proxy.forward(w, r, leader)
+}
+
+// config returns the layout requests are routed by, which changes when a
+// reshard commits.
+func (ws *WebServer) config() *config.Config {
+	return ws.membership.Config()
 }
 
 func (ws *WebServer) getKeyHash(key string) int {
-	h := fnv.New64()
-	h.Write([]byte(key))
-	return int(h.Sum64() % uint64(ws.config.TotalShards))
+	return ws.config().ShardForKey(key)
+}
+
+// errTooLarge is returned for keys and values over the limits of the node.
+var errTooLarge = errors.New("too large")
+
+// reservedPrefix begins the records the nodes keep of leases and locks. It
+// is part of db.ReservedPrefix, which clients cannot write, but unlike the
+// rest of it clients can read these records.
+const reservedPrefix = db.ReservedPrefix + "/"
+
+func (ws *WebServer) checkKeySize(key string) error {
+	if ws.limits.MaxKeySize > 0 && len(key) > ws.limits.MaxKeySize {
+		return fmt.Errorf("key of %d bytes is over the limit of %d: %w", len(key), ws.limits.MaxKeySize, errTooLarge)
+	}
+	return nil
+}
+
+// checkWriteKey checks a key a client writes to, which has to be within the
+// size limit and outside of db.ReservedPrefix.
+func (ws *WebServer) checkWriteKey(key string) error {
+	if strings.HasPrefix(key, db.ReservedPrefix) {
+		return fmt.Errorf("key %q: %w", key, db.ErrReservedKey)
+	}
+	return ws.checkKeySize(key)
+}
+
+// checkReadKey checks a key a client reads, which may be a record of
+// reservedPrefix but none of the other keys of db.ReservedPrefix.
+func (ws *WebServer) checkReadKey(key string) error {
+	if strings.HasPrefix(key, db.ReservedPrefix) && !strings.HasPrefix(key, reservedPrefix) {
+		return fmt.Errorf("key %q: %w", key, db.ErrReservedKey)
+	}
+	return ws.checkKeySize(key)
+}
+
+func (ws *WebServer) checkValueSize(size int64) error {
+	if ws.limits.MaxValueSize > 0 && size > ws.limits.MaxValueSize {
+		return fmt.Errorf("value of %d bytes is over the limit of %d: %w", size, ws.limits.MaxValueSize, errTooLarge)
+	}
+	return nil
+}
+
+// readValue reads a value of at most the size limit from r.
+func (ws *WebServer) readValue(r io.Reader) ([]byte, error) {
+	if ws.limits.MaxValueSize > 0 {
+		r = io.LimitReader(r, ws.limits.MaxValueSize+1)
+	}
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := ws.checkValueSize(int64(len(value))); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// readRecord returns the record stored under key, if there is one.
+func (ws *WebServer) readRecord(key string) (db.Record, bool, error) {
+	value, found, err := db.Lookup(ws.db, key)
+	if err != nil || !found {
+		return db.Record{}, false, err
+	}
+	rec, err := db.DecodeRecord(value)
+	if err != nil {
+		return db.Record{}, false, err
+	}
+	return rec, true, nil
+}
+
+// parseTTL returns when a key written with the ttl v expires, or 0 without
+// one. Expiry is kept in whole seconds, so the key lives up to a second past
+// its ttl.
+func parseTTL(v string) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %w", err)
+	}
+	if ttl < time.Second {
+		return 0, fmt.Errorf("invalid ttl %q, it has to be at least 1s", v)
+	}
+	return uint64(time.Now().Add(ttl).Unix()) + 1, nil
+}
+
+// writeChange writes a single change through raft or to the db, only if its
+// key meets cond when there is one. A put with a ttl goes through PutBatch,
+// the only unconditional write that carries an expiry.
+func (ws *WebServer) writeChange(change db.Change, cond *db.Condition) error {
+	if ws.raft != nil {
+		switch {
+		case cond != nil:
+			return ws.raft.PutIf(change, *cond)
+		case change.Deleted:
+			return ws.raft.Delete(change.Key)
+		case change.ExpiresAt != 0:
+			return ws.raft.PutBatch([]db.Change{change})
+		}
+		return ws.raft.Put(change.Key, change.Value)
+	}
+	switch {
+	case cond != nil:
+		return ws.db.PutIf(change, *cond)
+	case change.Deleted:
+		return ws.db.DeleteKey(change.Key)
+	case change.ExpiresAt != 0:
+		return ws.db.PutBatch([]db.Change{change})
+	}
+	return ws.db.PutKey(change.Key, change.Value)
+}
+
+// writeConcernResult reports how far a write got before the master
+// answered the client.
+type writeConcernResult struct {
+	requested config.WriteConcern
+	met       config.WriteConcern
+	acked     int
+	replicas  int
+}
+
+func (res writeConcernResult) satisfied() bool {
+	return res.acked >= replication.RequiredAcks(res.requested, res.replicas)
+}
+
+func (res writeConcernResult) String() string {
+	return fmt.Sprintf("WriteConcern = %q, Met = %q, Replicas Acked = %d/%d", res.requested, res.met, res.acked, res.replicas)
+}
+
+// parseWriteConcern reads the write concern of a request, falling back to
+// the one configured for the shard.
+func (ws *WebServer) parseWriteConcern(r *http.Request) (config.WriteConcern, time.Duration, error) {
+	shard, _ := ws.config().GetShard(ws.config().ShardIndex)
+	wc, timeout := shard.WriteConcern, shard.WriteTimeout
+	if wc == "" {
+		wc = config.WriteConcernAsync
+	}
+	if timeout == 0 {
+		timeout = config.DefaultWriteTimeout
+	}
+
+	if v := r.Form.Get("write-concern"); v != "" {
+		wc = config.WriteConcern(v)
+		if !wc.Valid() {
+			return "", 0, fmt.Errorf("invalid write-concern %q", v)
+		}
+	}
+	if v := r.Form.Get("write-timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid write-timeout: %w", err)
+		}
+		timeout = d
+	}
+	return wc, timeout, nil
+}
+
+// waitForWriteConcern holds the response until enough replicas have every
+// write up to now, or the timeout passes.
+func (ws *WebServer) waitForWriteConcern(wc config.WriteConcern, timeout time.Duration) (writeConcernResult, error) {
+	replicas := len(ws.membership.Replicas(ws.config().ShardIndex))
+	res := writeConcernResult{requested: wc, met: config.WriteConcernAsync, replicas: replicas}
+
+	required := replication.RequiredAcks(wc, replicas)
+	if required > 0 {
+		seq, err := ws.db.LastSequence()
+		if err != nil {
+			return res, err
+		}
+		res.acked, err = replication.WaitForReplicas(ws.db, seq, required, timeout)
+		if err != nil {
+			return res, err
+		}
+	}
+	res.met = replication.MetWriteConcern(res.acked, replicas)
+	return res, nil
+}
+
+// writeWithConcern runs write and waits for the write concern of the
+// request, returning the status to answer with.
+func (ws *WebServer) writeWithConcern(r *http.Request, write func() error) (writeConcernResult, int, error) {
+	wc, timeout, err := ws.parseWriteConcern(r)
+	if err != nil {
+		return writeConcernResult{}, http.StatusBadRequest, err
+	}
+	if err := write(); err != nil {
+		status, _ := errorStatus(err)
+		return writeConcernResult{requested: wc, met: config.WriteConcernAsync}, status, err
+	}
+	res, err := ws.waitForWriteConcern(wc, timeout)
+	if err != nil {
+		return res, http.StatusInternalServerError, err
+	}
+	if !res.satisfied() {
+		// the write is committed on the master, but not as widely as asked
+		return res, http.StatusAccepted, nil
+	}
+	return res, http.StatusOK, nil
 }
 
 func (ws *WebServer) PutHandler(w http.ResponseWriter, r *http.Request) {
@@ -47,57 +313,453 @@ func (ws *WebServer) PutHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.Form.Get("key")
 	val := r.Form.Get("value")
 
+	err := ws.checkWriteKey(key)
+	if err == nil {
+		err = ws.checkValueSize(int64(len(val)))
+	}
+	if err != nil {
+		status, _ := errorStatus(err)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "Key= %q, Error = %v \n", key, err)
+		return
+	}
+	expiresAt, err := parseTTL(r.Form.Get("ttl"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Key= %q, Error = %v \n", key, err)
+		return
+	}
+
 	shardIndex := ws.getKeyHash(key)
-	if shardIndex != ws.config.ShardIndex {
-		ws.redirectToCorrectShard(shardIndex, w, r)
+	if shardIndex != ws.config().ShardIndex {
+		ws.forwardToShard(shardIndex, w, r)
 		return
 	}
 
-	err := ws.db.PutKey(key, []byte(val))
-	fmt.Fprintf(w, "Key= %q, hash = %d, Value = %q, Error = %v \n", key, shardIndex, val, err)
+	change := db.Change{Key: key, Value: db.EncodeRecord(db.Record{Value: []byte(val)}), ExpiresAt: expiresAt}
+	if ws.raft != nil {
+		if !ws.raft.IsLeader() {
+			ws.forwardToLeader(w, r)
+			return
+		}
+		// raft only acknowledges a write once a majority of the group has it
+		err := ws.writeChange(change, nil)
+		fmt.Fprintf(w, "Key= %q, hash = %d, Value = %q, Error = %v \n", key, shardIndex, val, err)
+		return
+	}
+
+	res, status, err := ws.writeWithConcern(r, func() error {
+		return ws.resharder.WriteBatch([]db.Change{change}, func() error {
+			return ws.writeChange(change, nil)
+		})
+	})
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "Key= %q, hash = %d, Value = %q, Error = %v, %v \n", key, shardIndex, val, err, res)
 }
 
 func (ws *WebServer) GetHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	key := r.Form.Get("key")
+	if err := ws.checkReadKey(key); err != nil {
+		status, _ := errorStatus(err)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "Value = %q, Error = %v \n", []byte(nil), err)
+		return
+	}
 
 	shardIndex := ws.getKeyHash(key)
-	if shardIndex != ws.config.ShardIndex {
-		ws.redirectToCorrectShard(shardIndex, w, r)
+	if shardIndex != ws.config().ShardIndex {
+		ws.forwardToShard(shardIndex, w, r)
 		return
 	}
 
-	val, err := ws.db.GetKey(key)
-	fmt.Fprintf(w, "Value = %q, Error = %v \n", val, err)
+	if ws.raft != nil {
+		if err := ws.raft.WaitForRead(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Value = %q, Error = %v \n", []byte(nil), err)
+			return
+		}
+	}
+
+	rec, _, err := ws.readRecord(key)
+	fmt.Fprintf(w, "Value = %q, Error = %v \n", rec.Value, err)
+}
+
+func (ws *WebServer) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	key := r.Form.Get("key")
+	if err := ws.checkWriteKey(key); err != nil {
+		status, _ := errorStatus(err)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "Key= %q, Error = %v \n", key, err)
+		return
+	}
+
+	shardIndex := ws.getKeyHash(key)
+	if shardIndex != ws.config().ShardIndex {
+		ws.forwardToShard(shardIndex, w, r)
+		return
+	}
+
+	if ws.raft != nil {
+		if !ws.raft.IsLeader() {
+			ws.forwardToLeader(w, r)
+			return
+		}
+		err := ws.raft.Delete(key)
+		fmt.Fprintf(w, "Key= %q, hash = %d, Error = %v \n", key, shardIndex, err)
+		return
+	}
+
+	res, status, err := ws.writeWithConcern(r, func() error {
+		return ws.resharder.Write(key, nil, true, func() error {
+			return ws.db.DeleteKey(key)
+		})
+	})
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "Key= %q, hash = %d, Error = %v, %v \n", key, shardIndex, err, res)
 }
 
 func (ws *WebServer) CleanHandler(w http.ResponseWriter, r *http.Request) {
 	err := ws.db.DeleteBulkKeys(func(key string) bool {
-		return ws.getKeyHash(key) != ws.config.ShardIndex
+		return ws.getKeyHash(key) != ws.config().ShardIndex
 	})
 	fmt.Fprintf(w, "Error: %v \n", err)
 }
 
-func (ws *WebServer) GetNextReplicationKeyHandler(w http.ResponseWriter, r *http.Request) {
+// ReplicationStreamHandler returns the next batch of the change log for a
+// replica. When the replica is caught up the request is held open for up to
+// the wait duration so that new writes are shipped as soon as they commit.
+func (ws *WebServer) ReplicationStreamHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	replica := r.Form.Get("replica")
+	from, err := strconv.ParseUint(r.Form.Get("from"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid from: %v \n", err)
+		return
+	}
+	limit := maxReplicationBatch
+	if l, err := strconv.Atoi(r.Form.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	var wait time.Duration
+	if d, err := time.ParseDuration(r.Form.Get("wait")); err == nil && d <= maxReplicationWait {
+		wait = d
+	}
+
+	timeout := time.After(wait)
+	for {
+		// grab the notification channel before reading so that a write
+		// committed in between is not missed
+		changed := ws.db.WaitForChanges()
+		changes, err := ws.db.GetChanges(replica, from, limit)
+		if errors.Is(err, db.ErrHistoryTruncated) || errors.Is(err, db.ErrReplicaAhead) {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, "recevied error: %v \n", err)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "recevied error: %v \n", err)
+			return
+		}
+		if len(changes) > 0 || wait == 0 {
+			json.NewEncoder(w).Encode(&replication.ChangeBatch{Changes: changes})
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ReplicationSnapshotHandler streams every key of the shard as JSON lines,
+// followed by a final entry holding the sequence the dump corresponds to. A
+// dump that ends without that entry is incomplete.
+func (ws *WebServer) ReplicationSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	replica := r.Form.Get("replica")
+
 	encoder := json.NewEncoder(w)
-	key, value, err := ws.db.GetKeyForReplication()
-	encoder.Encode(&replication.ReplicateKeyValue{
-		Key:   string(key),
-		Value: string(value),
-		Err:   err,
+	seq, err := ws.db.Snapshot(replica, func(key string, value []byte, expiresAt uint64) error {
+		return encoder.Encode(&replication.SnapshotEntry{Key: key, Value: value, ExpiresAt: expiresAt})
 	})
+	if err != nil {
+		log.Printf("snapshot for replica %q failed: %v", replica, err)
+		return
+	}
+	encoder.Encode(&replication.SnapshotEntry{Sequence: seq, Done: true})
+}
+
+func parseMaster(r *http.Request) (int, cluster.Master, error) {
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil {
+		return 0, cluster.Master{}, fmt.Errorf("invalid shard: %v", err)
+	}
+	term, err := strconv.ParseUint(r.Form.Get("term"), 10, 64)
+	if err != nil {
+		return 0, cluster.Master{}, fmt.Errorf("invalid term: %v", err)
+	}
+	return shard, cluster.Master{Address: r.Form.Get("address"), Term: term}, nil
 }
 
-func (ws *WebServer) DeleteReplicationKeyHandler(w http.ResponseWriter, r *http.Request) {
+// ClusterMasterHandler returns the masters this node knows about. When
+// called with a shard, address and term it records an announced promotion.
+func (ws *WebServer) ClusterMasterHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	key := r.Form.Get("key")
-	value := r.Form.Get("value")
+	if r.Form.Get("shard") != "" {
+		shard, master, err := parseMaster(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v \n", err)
+			return
+		}
+		if _, err := ws.membership.Update(shard, master); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "recevied error: %v \n", err)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(ws.membership.Masters())
+}
+
+// HeartbeatHandler answers a replica checking on its master with the master
+// of the shard as this node sees it.
+func (ws *WebServer) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	shard, master, err := parseMaster(r)
+	if err != nil || shard != ws.config().ShardIndex {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid heartbeat for shard %d: %v \n", shard, err)
+		return
+	}
+	json.NewEncoder(w).Encode(ws.failover.Heartbeat(master, r.Form.Get("replica")))
+}
 
-	err := ws.db.DeleteReplicationKey([]byte(key), []byte(value))
+// VoteHandler answers a replica asking for our vote to become the master.
+func (ws *WebServer) VoteHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil || shard != ws.config().ShardIndex {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid vote request for shard %d: %v \n", shard, err)
+		return
+	}
+	term, err := strconv.ParseUint(r.Form.Get("term"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid term: %v \n", err)
+		return
+	}
+	// a candidate that cannot say how far along it is gets zero, which only
+	// wins against voters that are just as empty
+	sourceTerm, _ := strconv.ParseUint(r.Form.Get("source-term"), 10, 64)
+	applied, _ := strconv.ParseUint(r.Form.Get("applied"), 10, 64)
+
+	json.NewEncoder(w).Encode(ws.failover.RequestVote(term, r.Form.Get("candidate"), sourceTerm, applied))
+}
+
+// ReadIndexHandler gives a follower of the raft group the index it has to
+// apply up to before serving a linearizable read.
+func (ws *WebServer) ReadIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if ws.raft == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "shard %d is not replicated through raft \n", ws.config().ShardIndex)
+		return
+	}
+	index, err := ws.raft.ReadIndex()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "recevied error: %v \n", err)
+		return
+	}
+	json.NewEncoder(w).Encode(index)
+}
+
+// MerkleHandler returns the hashes of a range of nodes of one level of the
+// shard's Merkle tree, so that a replica can find where it differs.
+func (ws *WebServer) MerkleHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	level, err := strconv.Atoi(r.Form.Get("level"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid level: %v \n", err)
+		return
+	}
+	from, err := strconv.Atoi(r.Form.Get("from"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid from: %v \n", err)
+		return
+	}
+	to, err := strconv.Atoi(r.Form.Get("to"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid to: %v \n", err)
+		return
+	}
+
+	tree, err := ws.merkle.Tree()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "recevied error: %v \n", err)
 		return
 	}
-	fmt.Fprint(w, "ok \n")
+	hashes, err := tree.Range(level, from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "recevied error: %v \n", err)
+		return
+	}
+	json.NewEncoder(w).Encode(hashes)
+}
+
+// MerkleKeysHandler returns every key and value in the given leaves of the
+// shard's Merkle tree.
+func (ws *WebServer) MerkleKeysHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	leaves := make(map[int]bool)
+	for _, v := range r.Form["leaf"] {
+		leaf, err := strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid leaf: %v \n", err)
+			return
+		}
+		leaves[leaf] = true
+	}
+
+	entries := []replication.SnapshotEntry{}
+	err := ws.db.ForEach(func(key string, value []byte, expiresAt uint64) error {
+		if leaves[merkle.Leaf(key)] {
+			entries = append(entries, replication.SnapshotEntry{Key: key, Value: append([]byte(nil), value...), ExpiresAt: expiresAt})
+		}
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "recevied error: %v \n", err)
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// AdminReshardHandler moves the cluster to the layout in the request body,
+// which has the format of config.yaml, while it keeps serving.
+func (ws *WebServer) AdminReshardHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "could not read layout: %v \n", err)
+		return
+	}
+	err = ws.resharder.Reshard(body, w)
+	fmt.Fprintf(w, "Error: %v \n", err)
+}
+
+// AdminSplitHandler moves the keys of shard at and after key at to the
+// shard into, which owns no keys yet, when partitioning by range.
+func (ws *WebServer) AdminSplitHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	shard, err := strconv.Atoi(r.Form.Get("shard"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid shard %q: %v \n", r.Form.Get("shard"), err)
+		return
+	}
+	into, err := strconv.Atoi(r.Form.Get("into"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid shard %q: %v \n", r.Form.Get("into"), err)
+		return
+	}
+	layout, err := ws.config().Split(shard, r.Form.Get("at"), into)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %v \n", err)
+		return
+	}
+	err = ws.resharder.Reshard(layout, w)
+	fmt.Fprintf(w, "Error: %v \n", err)
+}
+
+// AdminMergeHandler moves the keys of shard from to the shard into, whose
+// range is next to it, when partitioning by range.
+func (ws *WebServer) AdminMergeHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	into, err := strconv.Atoi(r.Form.Get("into"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid shard %q: %v \n", r.Form.Get("into"), err)
+		return
+	}
+	from, err := strconv.Atoi(r.Form.Get("from"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid shard %q: %v \n", r.Form.Get("from"), err)
+		return
+	}
+	layout, err := ws.config().Merge(into, from)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error: %v \n", err)
+		return
+	}
+	err = ws.resharder.Reshard(layout, w)
+	fmt.Fprintf(w, "Error: %v \n", err)
+}
+
+func (ws *WebServer) ReshardBeginHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = ws.resharder.Begin(body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprintf(w, "Error: %v \n", err)
+}
+
+func (ws *WebServer) ReshardCopyHandler(w http.ResponseWriter, r *http.Request) {
+	moved, err := ws.resharder.Copy()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error: %v \n", err)
+		return
+	}
+	fmt.Fprintf(w, "%d \n", moved)
+}
+
+func (ws *WebServer) ReshardCommitHandler(w http.ResponseWriter, r *http.Request) {
+	err := ws.resharder.Commit()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	fmt.Fprintf(w, "Error: %v \n", err)
+}
+
+func (ws *WebServer) ReshardAbortHandler(w http.ResponseWriter, r *http.Request) {
+	ws.resharder.Abort()
+	fmt.Fprintf(w, "Error: %v \n", nil)
+}
+
+// ReshardImportHandler stores keys sent over by their old owner.
+func (ws *WebServer) ReshardImportHandler(w http.ResponseWriter, r *http.Request) {
+	var changes []db.Change
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid keys: %v \n", err)
+		return
+	}
+	err := ws.resharder.Import(changes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	fmt.Fprintf(w, "Error: %v \n", err)
 }
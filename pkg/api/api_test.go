@@ -0,0 +1,98 @@
+package api
+
+import (
+	"cs553/pkg/cluster"
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAddress = "localhost:8080"
+
+// newTestServer returns the web server of the master of a single shard,
+// whose db lives under t.TempDir.
+func newTestServer(t *testing.T) *WebServer {
+	database, closeFunc, err := db.NewBoltDatabase(filepath.Join(t.TempDir(), "shard0"), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBoltDatabase: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	return newTestServerFor(t, database)
+}
+
+// newTestServerFor returns the web server of the master of a single shard
+// that keeps its keys in database.
+func newTestServerFor(t *testing.T, database db.Database) *WebServer {
+	c, err := config.ParseConfig([]byte("Shard:\n  Name: shard0\n  Index: 0\n  Address: "+testAddress), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig: %v", err)
+	}
+	membership, err := cluster.NewMembership(c, database)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewMembership: %v", err)
+	}
+	return NewWebServer(database, membership, nil, nil, testAddress, Limits{MaxKeySize: 64, MaxValueSize: 64})
+}
+
+// serve runs a request through handler and decodes a JSON answer into out,
+// unless out is nil.
+func serve(t *testing.T, handler http.HandlerFunc, method, target string, body io.Reader, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, body))
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: Unexpected error decoding %q: %v", method, target, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// newTestCluster returns the web servers of the masters of shards shards,
+// each serving the v1 API over HTTP from a db under t.TempDir.
+func newTestCluster(t *testing.T, shards int) []*WebServer {
+	servers := make([]*httptest.Server, shards)
+	layout := make([]string, shards)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		layout[i] = fmt.Sprintf("Shard:\n  Name: shard%d\n  Index: %d\n  Address: %s", i, i, servers[i].Listener.Addr())
+	}
+
+	wss := make([]*WebServer, shards)
+	for i, server := range servers {
+		name := fmt.Sprintf("shard%d", i)
+		database, closeFunc, err := db.NewBoltDatabase(filepath.Join(t.TempDir(), name), false)
+		if err != nil {
+			t.Fatalf("Unexpected error with NewBoltDatabase: %v", err)
+		}
+		t.Cleanup(func() { closeFunc() })
+		c, err := config.ParseConfig([]byte(strings.Join(layout, "\n---\n")), name)
+		if err != nil {
+			t.Fatalf("Unexpected error with ParseConfig: %v", err)
+		}
+		membership, err := cluster.NewMembership(c, database)
+		if err != nil {
+			t.Fatalf("Unexpected error with NewMembership: %v", err)
+		}
+		address := server.Listener.Addr().String()
+		ws := NewWebServer(database, membership, nil, nil, address, Limits{MaxKeySize: 64, MaxValueSize: 64})
+
+		mux := http.NewServeMux()
+		mux.HandleFunc(keysPath, ws.KeysHandler)
+		mux.HandleFunc(batchGetPath, ws.BatchGetHandler)
+		mux.HandleFunc("/v1/batch/put", ws.BatchPutHandler)
+		mux.HandleFunc("/v1/scan", ws.ScanHandler)
+		server.Config.Handler = mux
+		server.Start()
+		t.Cleanup(server.Close)
+		wss[i] = ws
+	}
+	return wss
+}
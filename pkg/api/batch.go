@@ -0,0 +1,345 @@
+package api
+
+import (
+	"bytes"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	batchGetPath = "/v1/batch/get"
+	maxBatchKeys = 1000
+	maxBatchBody = 64 << 20
+)
+
+type batchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type batchGetResult struct {
+	Key         string    `json:"key"`
+	Shard       int       `json:"shard"`
+	Found       bool      `json:"found"`
+	Value       []byte    `json:"value,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	Error       *apiError `json:"error,omitempty"`
+}
+
+type batchGetResponse struct {
+	Results []batchGetResult `json:"results"`
+}
+
+// batchPutEntry writes value under key, or removes key when Delete is set.
+type batchPutEntry struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+	Delete      bool   `json:"delete,omitempty"`
+}
+
+type batchPutRequest struct {
+	Entries []batchPutEntry `json:"entries"`
+}
+
+type batchPutResult struct {
+	Key          string              `json:"key"`
+	Shard        int                 `json:"shard"`
+	Error        *apiError           `json:"error,omitempty"`
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+type batchPutResponse struct {
+	Results []batchPutResult `json:"results"`
+}
+
+func newAPIError(code string, err error) *apiError {
+	return &apiError{Code: code, Message: err.Error()}
+}
+
+// decodeBatch reads the JSON body of a batch request into req.
+func (ws *WebServer) decodeBatch(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return false
+	}
+	parseQuery(r)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid batch: %w", err))
+		return false
+	}
+	return true
+}
+
+// checkBatchKey checks a key of a batch with check, which is checkWriteKey
+// for the keys of a put.
+func (ws *WebServer) checkBatchKey(key string, check func(string) error) *apiError {
+	if key == "" {
+		return newAPIError(codeInvalidRequest, fmt.Errorf("missing key"))
+	}
+	if err := check(key); err != nil {
+		_, code := errorStatus(err)
+		return newAPIError(code, err)
+	}
+	return nil
+}
+
+// fanOut runs fn for the positions of the keys of every shard in parallel.
+func fanOut(groups map[int][]int, fn func(shard int, positions []int)) {
+	var wg sync.WaitGroup
+	for shard, positions := range groups {
+		wg.Add(1)
+		go func(shard int, positions []int) {
+			defer wg.Done()
+			fn(shard, positions)
+		}(shard, positions)
+	}
+	wg.Wait()
+}
+
+// BatchGetHandler reads many keys at once. The keys are grouped by the shard
+// that owns them, every shard reads its keys in a single transaction, and
+// the answer holds a result per key in the order of the request.
+func (ws *WebServer) BatchGetHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchGetRequest
+	if !ws.decodeBatch(w, r, &req) {
+		return
+	}
+	if len(req.Keys) > maxBatchKeys {
+		writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Errorf("batch of %d keys is over the limit of %d", len(req.Keys), maxBatchKeys))
+		return
+	}
+
+	results := make([]batchGetResult, len(req.Keys))
+	for i, key := range req.Keys {
+		results[i].Key = key
+		results[i].Error = ws.checkBatchKey(key, ws.checkReadKey)
+	}
+	ws.batchGet(r, results)
+	writeJSON(w, http.StatusOK, batchGetResponse{Results: results})
+}
+
+// batchGet reads the key of every result that has no error yet from the
+// shard that owns it, and fills in the result.
+func (ws *WebServer) batchGet(r *http.Request, results []batchGetResult) {
+	groups := make(map[int][]int)
+	for i := range results {
+		if results[i].Error != nil {
+			continue
+		}
+		shard := ws.getKeyHash(results[i].Key)
+		results[i].Shard = shard
+		groups[shard] = append(groups[shard], i)
+	}
+
+	self := ws.config().ShardIndex
+	fanOut(groups, func(shard int, positions []int) {
+		keys := make([]string, len(positions))
+		for j, i := range positions {
+			keys[j] = results[i].Key
+		}
+		var group []batchGetResult
+		var e *apiError
+		if shard == self {
+			group, e = ws.localBatchGet(keys, shard)
+		} else {
+			var resp batchGetResponse
+			body, err := json.Marshal(batchGetRequest{Keys: keys})
+			if err == nil {
+				err = ws.proxy.sendJSON(r, http.MethodPost, ws.membership.Master(shard).Address, batchGetPath, bytes.NewReader(body), &resp)
+			}
+			if err == nil && len(resp.Results) != len(keys) {
+				err = fmt.Errorf("shard %d answered %d of %d keys", shard, len(resp.Results), len(keys))
+			}
+			if err != nil {
+				e = newAPIError(codeUnavailable, err)
+			}
+			group = resp.Results
+		}
+		for j, i := range positions {
+			if e != nil {
+				results[i].Error = e
+				continue
+			}
+			results[i] = group[j]
+		}
+	})
+}
+
+func (ws *WebServer) localBatchGet(keys []string, shard int) ([]batchGetResult, *apiError) {
+	if ws.raft != nil {
+		if err := ws.raft.WaitForRead(); err != nil {
+			return nil, newAPIError(codeUnavailable, err)
+		}
+	}
+	values, err := ws.db.GetBatch(keys)
+	if err != nil {
+		_, code := errorStatus(err)
+		return nil, newAPIError(code, err)
+	}
+	return getResults(keys, values, shard), nil
+}
+
+// getResults returns the results of reading keys, whose values are nil for
+// the keys that do not exist.
+func getResults(keys []string, values [][]byte, shard int) []batchGetResult {
+	results := make([]batchGetResult, len(keys))
+	for i, value := range values {
+		results[i] = batchGetResult{Key: keys[i], Shard: shard}
+		if value == nil {
+			continue
+		}
+		rec, err := db.DecodeRecord(value)
+		if err != nil {
+			results[i].Error = newAPIError(codeInternal, err)
+			continue
+		}
+		results[i].Found = true
+		results[i].Value = rec.Value
+		results[i].ContentType = rec.ContentType
+		results[i].Version = db.Version(value)
+	}
+	return results
+}
+
+// BatchPutHandler writes many keys at once. The entries are grouped by the
+// shard that owns them, every shard writes its entries in a single
+// transaction, and the answer holds a result per entry in the order of the
+// request.
+func (ws *WebServer) BatchPutHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchPutRequest
+	if !ws.decodeBatch(w, r, &req) {
+		return
+	}
+	if len(req.Entries) > maxBatchKeys {
+		writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Errorf("batch of %d keys is over the limit of %d", len(req.Entries), maxBatchKeys))
+		return
+	}
+	if _, _, err := ws.parseWriteConcern(r); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+		return
+	}
+
+	results := make([]batchPutResult, len(req.Entries))
+	groups := make(map[int][]int)
+	for i, entry := range req.Entries {
+		results[i].Key = entry.Key
+		e := ws.checkBatchKey(entry.Key, ws.checkWriteKey)
+		if e == nil {
+			if err := ws.checkValueSize(int64(len(entry.Value))); err != nil {
+				e = newAPIError(codeTooLarge, err)
+			}
+		}
+		if e == nil {
+			if _, err := parseTTL(entry.TTL); err != nil {
+				e = newAPIError(codeInvalidRequest, err)
+			}
+		}
+		if e != nil {
+			results[i].Error = e
+			continue
+		}
+		shard := ws.getKeyHash(entry.Key)
+		results[i].Shard = shard
+		groups[shard] = append(groups[shard], i)
+	}
+
+	self := ws.config().ShardIndex
+	fanOut(groups, func(shard int, positions []int) {
+		entries := make([]batchPutEntry, len(positions))
+		for j, i := range positions {
+			entries[j] = req.Entries[i]
+		}
+		var group []batchPutResult
+		var e *apiError
+		if shard == self {
+			group, e = ws.localBatchPut(r, entries, shard)
+		} else {
+			group, e = ws.sendBatchPut(r, ws.membership.Master(shard).Address, entries)
+		}
+		for j, i := range positions {
+			if e != nil {
+				results[i].Error = e
+				continue
+			}
+			results[i] = group[j]
+		}
+	})
+	writeJSON(w, http.StatusOK, batchPutResponse{Results: results})
+}
+
+// sendBatchPut passes entries on to the node at address, which writes them
+// for its shard.
+func (ws *WebServer) sendBatchPut(r *http.Request, address string, entries []batchPutEntry) ([]batchPutResult, *apiError) {
+	var resp batchPutResponse
+	err := ws.proxy.postJSON(r, address, batchPutRequest{Entries: entries}, &resp)
+	if err == nil && len(resp.Results) != len(entries) {
+		err = fmt.Errorf("%s answered %d of %d keys", address, len(resp.Results), len(entries))
+	}
+	if err != nil {
+		return nil, newAPIError(codeUnavailable, err)
+	}
+	return resp.Results, nil
+}
+
+// change returns the write of the entry.
+func (entry batchPutEntry) change() (db.Change, error) {
+	if entry.Delete {
+		return db.Change{Key: entry.Key, Deleted: true}, nil
+	}
+	expiresAt, err := parseTTL(entry.TTL)
+	if err != nil {
+		return db.Change{}, err
+	}
+	value := db.EncodeRecord(db.Record{ContentType: entry.ContentType, Value: entry.Value})
+	return db.Change{Key: entry.Key, Value: value, ExpiresAt: expiresAt}, nil
+}
+
+func (ws *WebServer) localBatchPut(r *http.Request, entries []batchPutEntry, shard int) ([]batchPutResult, *apiError) {
+	changes := make([]db.Change, len(entries))
+	for i, entry := range entries {
+		var err error
+		if changes[i], err = entry.change(); err != nil {
+			return nil, newAPIError(codeInvalidRequest, err)
+		}
+	}
+
+	var wc *writeConcernResult
+	if ws.raft != nil {
+		if !ws.raft.IsLeader() {
+			leader := ws.raft.Leader()
+			if leader == "" {
+				return nil, newAPIError(codeUnavailable, fmt.Errorf("shard %d has no raft leader", shard))
+			}
+			return ws.sendBatchPut(r, leader, entries)
+		}
+		if err := ws.raft.PutBatch(changes); err != nil {
+			return nil, newAPIError(codeUnavailable, err)
+		}
+	} else {
+		res, status, err := ws.writeWithConcern(r, func() error {
+			return ws.resharder.WriteBatch(changes, func() error {
+				return ws.db.PutBatch(changes)
+			})
+		})
+		if err != nil {
+			code := codeInvalidRequest
+			if status != http.StatusBadRequest {
+				_, code = errorStatus(err)
+			}
+			return nil, newAPIError(code, err)
+		}
+		wc = &res
+	}
+
+	results := make([]batchPutResult, len(entries))
+	for i, entry := range entries {
+		results[i] = batchPutResult{Key: entry.Key, Shard: shard, WriteConcern: wc}
+	}
+	return results, nil
+}
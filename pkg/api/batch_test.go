@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestBatchAcrossShards(t *testing.T) {
+	wss := newTestCluster(t, 2)
+	var keys []string
+	var entries []batchPutEntry
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		entries = append(entries, batchPutEntry{Key: key, Value: []byte("value-" + key)})
+	}
+	// a bad entry fails on its own
+	entries = append(entries, batchPutEntry{})
+
+	body, _ := json.Marshal(batchPutRequest{Entries: entries})
+	var put batchPutResponse
+	if w := serve(t, wss[0].BatchPutHandler, http.MethodPost, "/v1/batch/put", bytes.NewReader(body), &put); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected answer %d %s", w.Code, w.Body)
+	}
+	if len(put.Results) != len(entries) {
+		t.Fatalf("Unexpected number of results. Got: %d Expected: %d", len(put.Results), len(entries))
+	}
+	owners := make(map[int]bool)
+	for i, key := range keys {
+		owner := wss[0].getKeyHash(key)
+		owners[owner] = true
+		if result := put.Results[i]; result.Key != key || result.Shard != owner || result.Error != nil {
+			t.Errorf("Unexpected result of %s. Got: %+v Expected: shard %d", key, result, owner)
+		}
+		// the key is only written on the shard that owns it
+		for shard, ws := range wss {
+			value, err := ws.db.GetKey(key)
+			if err != nil {
+				t.Fatalf("Unexpected error with GetKey: %v", err)
+			}
+			if found := value != nil; found != (shard == owner) {
+				t.Errorf("Unexpected copy of %s on shard %d owned by %d: %v", key, shard, owner, found)
+			}
+		}
+	}
+	if len(owners) != 2 {
+		t.Fatalf("Expected the keys to be spread over both shards")
+	}
+	if result := put.Results[len(keys)]; result.Error == nil || result.Error.Code != codeInvalidRequest {
+		t.Errorf("Unexpected result of an entry without a key: %+v", result)
+	}
+
+	// reading them through the other shard answers in the order asked
+	asked := append([]string{"missing"}, keys...)
+	body, _ = json.Marshal(batchGetRequest{Keys: asked})
+	var get batchGetResponse
+	if w := serve(t, wss[1].BatchGetHandler, http.MethodPost, batchGetPath, bytes.NewReader(body), &get); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected answer %d %s", w.Code, w.Body)
+	}
+	if len(get.Results) != len(asked) {
+		t.Fatalf("Unexpected number of results. Got: %d Expected: %d", len(get.Results), len(asked))
+	}
+	for i, key := range asked {
+		result := get.Results[i]
+		found := key != "missing"
+		if result.Key != key || result.Found != found || result.Shard != wss[1].getKeyHash(key) || result.Error != nil {
+			t.Errorf("Unexpected result of %s: %+v", key, result)
+		}
+		if found && string(result.Value) != "value-"+key {
+			t.Errorf("Unexpected value of %s. Got: %q Expected: %q", key, result.Value, "value-"+key)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"cs553/pkg/db"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	incrPath = "/v1/incr/"
+	decrPath = "/v1/decr/"
+	addPath  = "/v1/add/"
+)
+
+type counterResponse struct {
+	Key          string              `json:"key"`
+	Shard        int                 `json:"shard"`
+	Value        int64               `json:"value"`
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+// CounterHandler serves /v1/incr/<key>, /v1/decr/<key> and
+// /v1/add/<key>?delta=<n>, which add 1, -1 or delta to the integer value of
+// the key and answer with the new value. The shard that owns the key reads
+// and writes it in a single transaction, so concurrent additions are never
+// lost. A counter that does not exist starts from 0 and expires after ttl,
+// if one is given.
+func (ws *WebServer) CounterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	parseQuery(r)
+
+	var key string
+	var delta int64
+	switch {
+	case strings.HasPrefix(r.URL.Path, incrPath):
+		key, delta = strings.TrimPrefix(r.URL.Path, incrPath), 1
+	case strings.HasPrefix(r.URL.Path, decrPath):
+		key, delta = strings.TrimPrefix(r.URL.Path, decrPath), -1
+	default:
+		key = strings.TrimPrefix(r.URL.Path, addPath)
+		v := r.Form.Get("delta")
+		var err error
+		if delta, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid delta %q", v))
+			return
+		}
+	}
+	if key == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("missing key"))
+		return
+	}
+	if err := ws.checkWriteKey(key); err != nil {
+		status, code := errorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	expiresAt, err := parseTTL(r.Form.Get("ttl"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+		return
+	}
+
+	shardIndex := ws.getKeyHash(key)
+	if shardIndex != ws.config().ShardIndex {
+		ws.forwardToShard(shardIndex, w, r)
+		return
+	}
+	ws.addKey(w, r, key, delta, expiresAt, shardIndex)
+}
+
+func (ws *WebServer) addKey(w http.ResponseWriter, r *http.Request, key string, delta int64, expiresAt uint64, shardIndex int) {
+	resp := counterResponse{Key: key, Shard: shardIndex}
+	if ws.raft != nil {
+		if !ws.raft.IsLeader() {
+			ws.forwardToLeader(w, r)
+			return
+		}
+		value, err := ws.raft.Add(key, delta, expiresAt)
+		if err != nil {
+			status, code := raftErrorStatus(err)
+			writeError(w, status, code, err)
+			return
+		}
+		resp.Value = value
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	// the change is only known once the db has added to the counter, and
+	// the resharder reads it after the write to send it on
+	changes := []db.Change{{Key: key}}
+	res, status, err := ws.writeWithConcern(r, func() error {
+		return ws.resharder.WriteBatch(changes, func() error {
+			change, value, err := ws.db.Add(key, delta, expiresAt)
+			if err != nil {
+				return err
+			}
+			changes[0], resp.Value = change, value
+			return nil
+		})
+	})
+	if err != nil {
+		code := codeInvalidRequest
+		if status != http.StatusBadRequest {
+			_, code = errorStatus(err)
+		}
+		writeError(w, status, code, err)
+		return
+	}
+	resp.WriteConcern = &res
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,670 @@
+package api
+
+import (
+	"crypto/rand"
+	"cs553/pkg/db"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	leasesPath = "/v1/leases"
+	locksPath  = "/v1/locks/"
+	// leaseIDBytes is the length of a lease id before it is hex encoded
+	leaseIDBytes = 16
+	// leaseRetries is how often a lease operation starts over when the lease
+	// or its locks changed between its reads and its transaction
+	leaseRetries = 10
+	// maxLockWait caps how long an acquire waits for a held lock, below the
+	// timeout of the proxy
+	maxLockWait = 20 * time.Second
+	// lockPollInterval is how often a waiting acquire tries again, as a lock
+	// that expires wakes no one up
+	lockPollInterval = time.Second
+)
+
+// errLeaseNotFound is returned for a lease that was revoked or expired.
+var errLeaseNotFound = errors.New("lease not found")
+
+// errLockHeld is returned for a lock that another lease holds.
+var errLockHeld = errors.New("lock is held")
+
+// errLeaseChanged is returned when a lease or lock changed between the reads
+// of an operation and its transaction, which then starts over.
+var errLeaseChanged = errors.New("lease or lock changed meanwhile")
+
+// errRecordUnavailable is returned when a shard could not be read.
+var errRecordUnavailable = errors.New("record is unavailable")
+
+// lease is the record of a lease. The expiry is part of it so that every
+// keepalive changes its version.
+type lease struct {
+	TTL       int64    `json:"ttl"`
+	ExpiresAt uint64   `json:"expires_at"`
+	Keys      []string `json:"keys,omitempty"`
+}
+
+// lockHolder is the record of a held lock.
+type lockHolder struct {
+	Lease     string `json:"lease"`
+	Owner     string `json:"owner,omitempty"`
+	ExpiresAt uint64 `json:"expires_at"`
+}
+
+// heldLock is a lock as it was read, with the version of its record.
+type heldLock struct {
+	key     string
+	holder  lockHolder
+	version string
+}
+
+type leaseResponse struct {
+	ID           string              `json:"id"`
+	Shard        int                 `json:"shard"`
+	TTL          int64               `json:"ttl"`
+	ExpiresAt    uint64              `json:"expires_at"`
+	Locks        []string            `json:"locks"`
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+type lockResponse struct {
+	Key          string              `json:"key"`
+	Shard        int                 `json:"shard"`
+	Lease        string              `json:"lease"`
+	Owner        string              `json:"owner,omitempty"`
+	ExpiresAt    uint64              `json:"expires_at,omitempty"`
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+// leaseKey and lockKey are where the records of a lease and of the lock of
+// key are kept. Both are routed like any other key.
+func leaseKey(id string) string {
+	return reservedPrefix + "lease/" + id
+}
+
+func lockKey(key string) string {
+	return reservedPrefix + "lock/" + key
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, leaseIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validLeaseID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == leaseIDBytes
+}
+
+// parseLeaseTTL parses the ttl of a lease, in whole seconds rounded up.
+func parseLeaseTTL(v string) (int64, error) {
+	if v == "" {
+		return 0, fmt.Errorf("missing ttl")
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %w", err)
+	}
+	if ttl < time.Second {
+		return 0, fmt.Errorf("invalid ttl %q, it has to be at least 1s", v)
+	}
+	return int64((ttl + time.Second - 1) / time.Second), nil
+}
+
+// leaseExpiry is when a lease of ttl seconds expires if it is kept alive now,
+// rounded up like the expiry of a key.
+func leaseExpiry(ttl int64) uint64 {
+	return uint64(time.Now().Unix()+ttl) + 1
+}
+
+// recordChange writes v as the JSON record of key, so that leases and locks
+// read through /v1/keys like any value written as JSON.
+func recordChange(key string, v interface{}, expiresAt uint64) (db.Change, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return db.Change{}, err
+	}
+	rec := db.Record{ContentType: "application/json", Value: value}
+	return db.Change{Key: key, Value: db.EncodeRecord(rec), ExpiresAt: expiresAt}, nil
+}
+
+func leaseChange(id string, l lease) (db.Change, error) {
+	return recordChange(leaseKey(id), l, l.ExpiresAt)
+}
+
+func lockChange(key string, holder lockHolder) (db.Change, error) {
+	return recordChange(lockKey(key), holder, holder.ExpiresAt)
+}
+
+// readRecords reads keys from the shards that own them.
+func (ws *WebServer) readRecords(r *http.Request, keys []string) ([]batchGetResult, error) {
+	results := make([]batchGetResult, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+	}
+	ws.batchGet(r, results)
+	for _, result := range results {
+		if result.Error != nil {
+			return nil, fmt.Errorf("%w: reading %q: %s", errRecordUnavailable, result.Key, result.Error.Message)
+		}
+	}
+	return results, nil
+}
+
+func decodeLease(id string, result batchGetResult) (lease, error) {
+	if !result.Found {
+		return lease{}, fmt.Errorf("%w: %q", errLeaseNotFound, id)
+	}
+	var l lease
+	if err := json.Unmarshal(result.Value, &l); err != nil {
+		return lease{}, fmt.Errorf("corrupt lease %q: %w", id, err)
+	}
+	return l, nil
+}
+
+// readLease returns lease id and its version.
+func (ws *WebServer) readLease(r *http.Request, id string) (lease, string, error) {
+	results, err := ws.readRecords(r, []string{leaseKey(id)})
+	if err != nil {
+		return lease{}, "", err
+	}
+	l, err := decodeLease(id, results[0])
+	return l, results[0].Version, err
+}
+
+// heldLocks returns the locks of keys that lease id still holds. A lock
+// drops out once it is released, or expires after a keepalive came too late.
+func (ws *WebServer) heldLocks(r *http.Request, id string, keys []string) ([]heldLock, error) {
+	lockKeys := make([]string, len(keys))
+	for i, key := range keys {
+		lockKeys[i] = lockKey(key)
+	}
+	results, err := ws.readRecords(r, lockKeys)
+	if err != nil {
+		return nil, err
+	}
+	var locks []heldLock
+	for i, result := range results {
+		if !result.Found {
+			continue
+		}
+		var holder lockHolder
+		if err := json.Unmarshal(result.Value, &holder); err != nil {
+			return nil, fmt.Errorf("corrupt lock %q: %w", keys[i], err)
+		}
+		if holder.Lease == id {
+			locks = append(locks, heldLock{key: keys[i], holder: holder, version: result.Version})
+		}
+	}
+	return locks, nil
+}
+
+// runLeaseTxn runs a transaction on the records of leases and locks, which
+// may belong to different shards. A transaction that only this node's shard
+// is part of runs here if the node writes for it, and any other one is
+// coordinated with two-phase commit. A transaction that failed because a
+// record changed since it was read fails with errLeaseChanged.
+func (ws *WebServer) runLeaseTxn(r *http.Request, txn db.Txn) (*writeConcernResult, int, string, error) {
+	self := ws.config().ShardIndex
+	parts := ws.splitTxn(txn)
+	here := ws.raft != nil && ws.raft.IsLeader() || ws.raft == nil && ws.membership.Master(self).Address == ws.self
+	var res *writeConcernResult
+	var status int
+	var code string
+	var err error
+	if _, ok := parts[self]; ok && len(parts) == 1 && here {
+		_, res, status, code, err = ws.runTxn(r, txn)
+	} else {
+		_, res, status, code, err = ws.commitAcross(r, txn, parts)
+	}
+	switch code {
+	case codePrecondition, codeConflict, codeLocked:
+		err = fmt.Errorf("%w: %v", errLeaseChanged, err)
+	}
+	return res, status, code, err
+}
+
+// leaseErrorStatus is errorStatus for the errors of leases and locks.
+func leaseErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errLeaseNotFound):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, errLockHeld):
+		return http.StatusConflict, codeConflict
+	case errors.Is(err, errRecordUnavailable):
+		return http.StatusServiceUnavailable, codeUnavailable
+	}
+	return errorStatus(err)
+}
+
+// serveHere reports whether this node serves a request for shardIndex, and
+// forwards the request otherwise. A lease is served by the master or raft
+// leader of the shard its record belongs to, and a lock by the one of the
+// shard of its record, so that their reads are never stale.
+func (ws *WebServer) serveHere(w http.ResponseWriter, r *http.Request, shardIndex int) bool {
+	if shardIndex != ws.config().ShardIndex {
+		ws.forwardToShard(shardIndex, w, r)
+		return false
+	}
+	if ws.raft != nil && !ws.raft.IsLeader() {
+		ws.forwardToLeader(w, r)
+		return false
+	}
+	return true
+}
+
+// LeasesHandler serves the leases of /v1/leases. A lease is granted with a
+// ttl in seconds and expires unless it is kept alive within it. The locks a
+// lease holds expire together with it, as they are written with its expiry
+// and every keepalive extends them in the same transaction, and revoking the
+// lease releases them at once. Leases and locks are records under
+// reservedPrefix, which are routed, replicated and resharded like any other
+// key but cannot be written by clients.
+//
+//	POST   /v1/leases?ttl=<duration>  grants a lease
+//	GET    /v1/leases/<id>
+//	POST   /v1/leases/<id>/keepalive
+//	DELETE /v1/leases/<id>            revokes the lease
+func (ws *WebServer) LeasesHandler(w http.ResponseWriter, r *http.Request) {
+	parseQuery(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, leasesPath), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+		ttl, err := parseLeaseTTL(r.Form.Get("ttl"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+			return
+		}
+		ws.grantLease(w, r, ttl)
+		return
+	}
+
+	id, action := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		id, action = rest[:i], rest[i+1:]
+	}
+	if !validLeaseID(id) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid lease id %q", id))
+		return
+	}
+	var allow string
+	switch action {
+	case "":
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			allow = "GET, DELETE"
+		}
+	case "keepalive":
+		if r.Method != http.MethodPost {
+			allow = "POST"
+		}
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Errorf("unknown lease operation %q", action))
+		return
+	}
+	if allow != "" {
+		w.Header().Set("Allow", allow)
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	shardIndex := ws.getKeyHash(leaseKey(id))
+	if !ws.serveHere(w, r, shardIndex) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		ws.getLease(w, r, id, shardIndex)
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		resp, status, code, err := ws.updateLease(r, id, r.Method == http.MethodDelete, shardIndex)
+		if err == nil {
+			writeJSON(w, status, resp)
+			return
+		}
+		if !errors.Is(err, errLeaseChanged) || attempt == leaseRetries {
+			writeError(w, status, code, err)
+			return
+		}
+	}
+}
+
+// grantLease grants a lease on any node, as the shard of its record is only
+// known once its id is drawn.
+func (ws *WebServer) grantLease(w http.ResponseWriter, r *http.Request, ttl int64) {
+	id, err := newLeaseID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	l := lease{TTL: ttl, ExpiresAt: leaseExpiry(ttl)}
+	change, err := leaseChange(id, l)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	txn := db.Txn{
+		Conditions: []db.KeyCondition{{Key: change.Key, Condition: db.Condition{Absent: true}}},
+		Writes:     []db.Change{change},
+	}
+	res, status, code, err := ws.runLeaseTxn(r, txn)
+	if err != nil {
+		writeError(w, status, code, err)
+		return
+	}
+	writeJSON(w, status, leaseResponse{ID: id, Shard: ws.getKeyHash(change.Key), TTL: l.TTL, ExpiresAt: l.ExpiresAt, Locks: []string{}, WriteConcern: res})
+}
+
+func (ws *WebServer) getLease(w http.ResponseWriter, r *http.Request, id string, shardIndex int) {
+	l, _, err := ws.readLease(r, id)
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	locks, err := ws.heldLocks(r, id, l.Keys)
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	resp := leaseResponse{ID: id, Shard: shardIndex, TTL: l.TTL, ExpiresAt: l.ExpiresAt, Locks: []string{}}
+	for _, lock := range locks {
+		resp.Locks = append(resp.Locks, lock.key)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// updateLease extends lease id and the locks it holds by the ttl of the
+// lease or, to revoke it, deletes them, in a single transaction that fails
+// if any of them changed since they were read.
+func (ws *WebServer) updateLease(r *http.Request, id string, revoke bool, shardIndex int) (leaseResponse, int, string, error) {
+	l, version, err := ws.readLease(r, id)
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		return leaseResponse{}, status, code, err
+	}
+	locks, err := ws.heldLocks(r, id, l.Keys)
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		return leaseResponse{}, status, code, err
+	}
+
+	txn := db.Txn{Conditions: []db.KeyCondition{{Key: leaseKey(id), Condition: db.Condition{Version: version}}}}
+	if !revoke {
+		l.ExpiresAt = leaseExpiry(l.TTL)
+	}
+	l.Keys = []string{}
+	for _, lock := range locks {
+		txn.Conditions = append(txn.Conditions, db.KeyCondition{Key: lockKey(lock.key), Condition: db.Condition{Version: lock.version}})
+		change := db.Change{Key: lockKey(lock.key), Deleted: true}
+		if !revoke {
+			lock.holder.ExpiresAt = l.ExpiresAt
+			if change, err = lockChange(lock.key, lock.holder); err != nil {
+				return leaseResponse{}, http.StatusInternalServerError, codeInternal, err
+			}
+		}
+		txn.Writes = append(txn.Writes, change)
+		l.Keys = append(l.Keys, lock.key)
+	}
+	change := db.Change{Key: leaseKey(id), Deleted: true}
+	if !revoke {
+		if change, err = leaseChange(id, l); err != nil {
+			return leaseResponse{}, http.StatusInternalServerError, codeInternal, err
+		}
+	}
+	txn.Writes = append(txn.Writes, change)
+
+	res, status, code, err := ws.runLeaseTxn(r, txn)
+	if err != nil {
+		return leaseResponse{}, status, code, err
+	}
+	return leaseResponse{ID: id, Shard: shardIndex, TTL: l.TTL, ExpiresAt: l.ExpiresAt, Locks: l.Keys, WriteConcern: res}, status, "", nil
+}
+
+// LocksHandler serves /v1/locks/<key>, the locks held by leases. Locks are
+// advisory: the lock of a key is a record of its own that names the lease
+// and owner holding it, and writes to the key itself are not refused.
+//
+//	POST   /v1/locks/<key>?lease=<id>[&owner=<owner>][&wait=<duration>]
+//	POST   /v1/locks/<key>?ttl=<duration>[&owner=<owner>][&wait=<duration>]
+//	GET    /v1/locks/<key>
+//	DELETE /v1/locks/<key>?lease=<id>
+//
+// An acquire either uses a lease, or grants a new one of ttl for the lock.
+// Acquiring a lock the lease already holds succeeds again, and a lock held
+// by another lease fails with a conflict unless it is released within wait.
+func (ws *WebServer) LocksHandler(w http.ResponseWriter, r *http.Request) {
+	parseQuery(r)
+	key := strings.TrimPrefix(r.URL.Path, locksPath)
+	if key == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("missing key"))
+		return
+	}
+	if err := ws.checkKeySize(key); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, err)
+		return
+	}
+	id := r.Form.Get("lease")
+	if id != "" && !validLeaseID(id) {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid lease id %q", id))
+		return
+	}
+	shardIndex := ws.getKeyHash(lockKey(key))
+
+	switch r.Method {
+	case http.MethodGet:
+		if ws.serveHere(w, r, shardIndex) {
+			ws.getLock(w, r, key, shardIndex)
+		}
+	case http.MethodPost:
+		var ttl int64
+		var err error
+		if (id == "") == (r.Form.Get("ttl") == "") {
+			err = fmt.Errorf("an acquire needs either a lease or a ttl")
+		} else if id == "" {
+			ttl, err = parseLeaseTTL(r.Form.Get("ttl"))
+		}
+		var wait time.Duration
+		if v := r.Form.Get("wait"); v != "" && err == nil {
+			if wait, err = time.ParseDuration(v); err == nil && (wait < 0 || wait > maxLockWait) {
+				err = fmt.Errorf("invalid wait %q, it has to be at most %v", v, maxLockWait)
+			}
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+			return
+		}
+		if ws.serveHere(w, r, shardIndex) {
+			ws.acquireLock(w, r, key, id, ttl, r.Form.Get("owner"), wait, shardIndex)
+		}
+	case http.MethodDelete:
+		if id == "" {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("missing lease"))
+			return
+		}
+		if ws.serveHere(w, r, shardIndex) {
+			ws.releaseLock(w, r, key, id, shardIndex)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
+
+func (ws *WebServer) getLock(w http.ResponseWriter, r *http.Request, key string, shardIndex int) {
+	results, err := ws.readRecords(r, []string{lockKey(key)})
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	if !results[0].Found {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Errorf("lock %q is not held", key))
+		return
+	}
+	var holder lockHolder
+	if err := json.Unmarshal(results[0].Value, &holder); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, fmt.Errorf("corrupt lock %q: %w", key, err))
+		return
+	}
+	writeJSON(w, http.StatusOK, lockResponse{Key: key, Shard: shardIndex, Lease: holder.Lease, Owner: holder.Owner, ExpiresAt: holder.ExpiresAt})
+}
+
+func (ws *WebServer) acquireLock(w http.ResponseWriter, r *http.Request, key, id string, ttl int64, owner string, wait time.Duration, shardIndex int) {
+	deadline := time.Now().Add(wait)
+	for attempt := 0; ; {
+		changed := ws.db.WaitForChanges()
+		resp, status, code, err := ws.tryAcquire(r, key, id, ttl, owner, shardIndex)
+		switch {
+		case err == nil:
+			writeJSON(w, status, resp)
+			return
+		case errors.Is(err, errLockHeld) && time.Now().Before(deadline):
+			timeout := time.Until(deadline)
+			if timeout > lockPollInterval {
+				timeout = lockPollInterval
+			}
+			timer := time.NewTimer(timeout)
+			select {
+			case <-changed:
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+		case errors.Is(err, errLeaseChanged) && attempt < leaseRetries:
+			attempt++
+		default:
+			writeError(w, status, code, err)
+			return
+		}
+	}
+}
+
+// tryAcquire takes the lock of key for lease id, or for a new lease of ttl
+// if there is no id, unless another lease holds it.
+func (ws *WebServer) tryAcquire(r *http.Request, key, id string, ttl int64, owner string, shardIndex int) (lockResponse, int, string, error) {
+	keys := []string{lockKey(key)}
+	if id != "" {
+		keys = append(keys, leaseKey(id))
+	}
+	results, err := ws.readRecords(r, keys)
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		return lockResponse{}, status, code, err
+	}
+
+	var l lease
+	var txn db.Txn
+	if id == "" {
+		if id, err = newLeaseID(); err != nil {
+			return lockResponse{}, http.StatusInternalServerError, codeInternal, err
+		}
+		l = lease{TTL: ttl, ExpiresAt: leaseExpiry(ttl)}
+		txn.Conditions = append(txn.Conditions, db.KeyCondition{Key: leaseKey(id), Condition: db.Condition{Absent: true}})
+	} else {
+		if l, err = decodeLease(id, results[1]); err != nil {
+			status, code := leaseErrorStatus(err)
+			return lockResponse{}, status, code, err
+		}
+		txn.Conditions = append(txn.Conditions, db.KeyCondition{Key: leaseKey(id), Condition: db.Condition{Version: results[1].Version}})
+	}
+
+	holder := lockHolder{Lease: id, Owner: owner, ExpiresAt: l.ExpiresAt}
+	if results[0].Found {
+		var held lockHolder
+		if err := json.Unmarshal(results[0].Value, &held); err != nil {
+			return lockResponse{}, http.StatusInternalServerError, codeInternal, fmt.Errorf("corrupt lock %q: %w", key, err)
+		}
+		if held.Lease != id {
+			return lockResponse{}, http.StatusConflict, codeConflict, fmt.Errorf("key %q: %w by lease %q", key, errLockHeld, held.Lease)
+		}
+		return lockResponse{Key: key, Shard: shardIndex, Lease: id, Owner: held.Owner, ExpiresAt: held.ExpiresAt}, http.StatusOK, "", nil
+	}
+
+	lock, err := lockChange(key, holder)
+	if err != nil {
+		return lockResponse{}, http.StatusInternalServerError, codeInternal, err
+	}
+	l.Keys = append(l.Keys, key)
+	change, err := leaseChange(id, l)
+	if err != nil {
+		return lockResponse{}, http.StatusInternalServerError, codeInternal, err
+	}
+	txn.Conditions = append(txn.Conditions, db.KeyCondition{Key: lock.Key, Condition: db.Condition{Absent: true}})
+	txn.Writes = []db.Change{lock, change}
+
+	res, status, code, err := ws.runLeaseTxn(r, txn)
+	if err != nil {
+		return lockResponse{}, status, code, err
+	}
+	return lockResponse{Key: key, Shard: shardIndex, Lease: id, Owner: owner, ExpiresAt: l.ExpiresAt, WriteConcern: res}, status, "", nil
+}
+
+func (ws *WebServer) releaseLock(w http.ResponseWriter, r *http.Request, key, id string, shardIndex int) {
+	for attempt := 0; ; attempt++ {
+		resp, status, code, err := ws.tryRelease(r, key, id, shardIndex)
+		if err == nil {
+			writeJSON(w, status, resp)
+			return
+		}
+		if !errors.Is(err, errLeaseChanged) || attempt == leaseRetries {
+			writeError(w, status, code, err)
+			return
+		}
+	}
+}
+
+// tryRelease deletes the lock of key if lease id holds it.
+func (ws *WebServer) tryRelease(r *http.Request, key, id string, shardIndex int) (lockResponse, int, string, error) {
+	l, version, err := ws.readLease(r, id)
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		return lockResponse{}, status, code, err
+	}
+	locks, err := ws.heldLocks(r, id, []string{key})
+	if err != nil {
+		status, code := leaseErrorStatus(err)
+		return lockResponse{}, status, code, err
+	}
+	if len(locks) == 0 {
+		return lockResponse{}, http.StatusConflict, codeConflict, fmt.Errorf("lock %q is not held by lease %q", key, id)
+	}
+
+	keys := []string{}
+	for _, k := range l.Keys {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	l.Keys = keys
+	change, err := leaseChange(id, l)
+	if err != nil {
+		return lockResponse{}, http.StatusInternalServerError, codeInternal, err
+	}
+	txn := db.Txn{
+		Conditions: []db.KeyCondition{
+			{Key: leaseKey(id), Condition: db.Condition{Version: version}},
+			{Key: lockKey(key), Condition: db.Condition{Version: locks[0].version}},
+		},
+		Writes: []db.Change{{Key: lockKey(key), Deleted: true}, change},
+	}
+	res, status, code, err := ws.runLeaseTxn(r, txn)
+	if err != nil {
+		return lockResponse{}, status, code, err
+	}
+	return lockResponse{Key: key, Shard: shardIndex, Lease: id, Owner: locks[0].holder.Owner, WriteConcern: res}, status, "", nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	ws := newTestServer(t)
+
+	var granted leaseResponse
+	if w := serve(t, ws.LeasesHandler, http.MethodPost, "/v1/leases?ttl=10s", nil, &granted); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d granting a lease: %s", w.Code, w.Body)
+	}
+	if !validLeaseID(granted.ID) || granted.TTL != 10 {
+		t.Fatalf("Unexpected lease %+v", granted)
+	}
+
+	var lock lockResponse
+	if w := serve(t, ws.LocksHandler, http.MethodPost, "/v1/locks/jobs?lease="+granted.ID+"&owner=worker-1", nil, &lock); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d acquiring a lock: %s", w.Code, w.Body)
+	}
+	if lock.Lease != granted.ID || lock.Owner != "worker-1" {
+		t.Errorf("Unexpected lock %+v", lock)
+	}
+	// acquiring it again with the same lease succeeds, with another fails
+	if w := serve(t, ws.LocksHandler, http.MethodPost, "/v1/locks/jobs?lease="+granted.ID, nil, nil); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d acquiring a held lock again: %s", w.Code, w.Body)
+	}
+	var apiErr errorResponse
+	if w := serve(t, ws.LocksHandler, http.MethodPost, "/v1/locks/jobs?ttl=10s", nil, &apiErr); w.Code != http.StatusConflict || apiErr.Error.Code != codeConflict {
+		t.Errorf("Unexpected status %d acquiring a lock held by another lease: %s", w.Code, w.Body)
+	}
+
+	var got leaseResponse
+	if w := serve(t, ws.LeasesHandler, http.MethodPost, "/v1/leases/"+granted.ID+"/keepalive", nil, &got); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d keeping the lease alive: %s", w.Code, w.Body)
+	}
+	if len(got.Locks) != 1 || got.Locks[0] != "jobs" {
+		t.Errorf("Unexpected locks %v of the lease", got.Locks)
+	}
+
+	// the records of the lock can be read but not written by clients
+	for key, record := range map[string]string{
+		lockKey("jobs"):      `"lease":"` + granted.ID + `"`,
+		leaseKey(granted.ID): `"keys":["jobs"]`,
+	} {
+		target := "/v1/keys/" + strings.ReplaceAll(key, "\x00", "%00")
+		w := serve(t, ws.KeysHandler, http.MethodGet, target, nil, nil)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || !strings.Contains(w.Body.String(), record) {
+			t.Errorf("Unexpected answer %d %s of type %q reading %q", w.Code, w.Body, w.Header().Get("Content-Type"), key)
+		}
+		if w := serve(t, ws.KeysHandler, http.MethodDelete, target, nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status %d deleting %q: %s", w.Code, key, w.Body)
+		}
+		if w := serve(t, ws.KeysHandler, http.MethodPut, target, strings.NewReader("{}"), nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected status %d writing %q: %s", w.Code, key, w.Body)
+		}
+	}
+
+	// revoking the lease releases its lock
+	if w := serve(t, ws.LeasesHandler, http.MethodDelete, "/v1/leases/"+granted.ID, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d revoking the lease: %s", w.Code, w.Body)
+	}
+	if w := serve(t, ws.LeasesHandler, http.MethodGet, "/v1/leases/"+granted.ID, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d reading a revoked lease: %s", w.Code, w.Body)
+	}
+	if w := serve(t, ws.LocksHandler, http.MethodGet, "/v1/locks/jobs", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d reading a released lock: %s", w.Code, w.Body)
+	}
+	if w := serve(t, ws.LocksHandler, http.MethodPost, "/v1/locks/jobs?ttl=10s&owner=worker-2", nil, &lock); w.Code != http.StatusOK || lock.Owner != "worker-2" {
+		t.Errorf("Unexpected status %d acquiring a released lock: %s", w.Code, w.Body)
+	}
+}
+
+func TestLockExpiry(t *testing.T) {
+	ws := newTestServer(t)
+
+	var lock lockResponse
+	if w := serve(t, ws.LocksHandler, http.MethodPost, "/v1/locks/jobs?ttl=1s", nil, &lock); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d acquiring a lock: %s", w.Code, w.Body)
+	}
+	var release lockResponse
+	if w := serve(t, ws.LocksHandler, http.MethodDelete, "/v1/locks/other?lease="+lock.Lease, nil, &release); w.Code != http.StatusConflict {
+		t.Errorf("Unexpected status %d releasing a lock the lease does not hold: %s", w.Code, w.Body)
+	}
+
+	// the lock expires together with its lease, which is not kept alive
+	time.Sleep(time.Until(time.Unix(int64(lock.ExpiresAt), 0)) + 100*time.Millisecond)
+	if w := serve(t, ws.LocksHandler, http.MethodGet, "/v1/locks/jobs", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d reading an expired lock: %s", w.Code, w.Body)
+	}
+	if w := serve(t, ws.LeasesHandler, http.MethodPost, "/v1/leases/"+lock.Lease+"/keepalive", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status %d keeping an expired lease alive: %s", w.Code, w.Body)
+	}
+	if w := serve(t, ws.LocksHandler, http.MethodPost, "/v1/locks/jobs?ttl=10s", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d acquiring an expired lock: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyTimeout = 30 * time.Second
+	// hopsHeader counts the nodes a request was forwarded by, so that nodes
+	// which briefly disagree on the layout during a reshard do not pass it
+	// back and forth forever
+	hopsHeader = "X-Kvstore-Hops"
+	maxHops    = 3
+	// reshardWait is how long a node that has not committed a reshard yet
+	// holds a request that a node which has committed it forwarded, instead
+	// of passing it back by the old layout
+	reshardWait = 5 * time.Second
+	// shardHeader names the shard that owns the key of a redirected request
+	shardHeader = "X-Kvstore-Shard"
+)
+
+// hopHeaders only apply to a single connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxy forwards requests to the node that can serve them over a pool of
+// kept alive connections.
+type proxy struct {
+	client *http.Client
+}
+
+func newProxy() *proxy {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &proxy{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   proxyTimeout,
+			// pass redirects of the upstream node on to the client
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// requestBody returns the body to forward. ParseForm has already consumed a
+// form encoded body, so it is rebuilt from the parsed form.
+func requestBody(r *http.Request) (io.Reader, int64) {
+	if len(r.PostForm) > 0 {
+		form := r.PostForm.Encode()
+		return strings.NewReader(form), int64(len(form))
+	}
+	return r.Body, r.ContentLength
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// forward sends the request on to address with its method, headers and
+// body, and copies back the status, headers and body of the answer.
+func (p *proxy) forward(w http.ResponseWriter, r *http.Request, address string) {
+	hops, _ := strconv.Atoi(r.Header.Get(hopsHeader))
+	if hops >= maxHops {
+		w.WriteHeader(http.StatusLoopDetected)
+		fmt.Fprintf(w, "request was forwarded %d times without reaching its shard \n", hops)
+		return
+	}
+
+	body, length := requestBody(r)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, "http://"+address+r.RequestURI, body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error with forwarding request %v \n", err)
+		return
+	}
+	req.ContentLength = length
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+	req.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		req.Header.Set("X-Forwarded-For", host)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "error with forwarding request to %s %v \n", address, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	removeHopHeaders(w.Header())
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// postJSON sends in to the same path on address as a request of its own,
+// such as the part of a batch another shard owns, and decodes the answer
+// into out.
+func (p *proxy) postJSON(r *http.Request, address string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return p.sendJSON(r, http.MethodPost, address, r.URL.RequestURI(), bytes.NewReader(body), out)
+}
+
+// getJSON asks address for uri as a request of its own, such as the page of
+// a scan another shard holds, and decodes the answer into out.
+func (p *proxy) getJSON(r *http.Request, address, uri string, out interface{}) error {
+	return p.sendJSON(r, http.MethodGet, address, uri, nil, out)
+}
+
+func (p *proxy) sendJSON(r *http.Request, method, address, uri string, body io.Reader, out interface{}) error {
+	hops, _ := strconv.Atoi(r.Header.Get(hopsHeader))
+	if hops >= maxHops {
+		return fmt.Errorf("request was forwarded %d times without reaching its shard", hops)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, "http://"+address+uri, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		re := &remoteError{status: resp.StatusCode, msg: fmt.Sprintf("%s returned %s: %s", address, resp.Status, bytes.TrimSpace(msg))}
+		var e errorResponse
+		if json.Unmarshal(msg, &e) == nil {
+			re.apiError = e.Error
+		}
+		return re
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// remoteError is the answer of a node that refused a request of ours, along
+// with its error code if it answered with one.
+type remoteError struct {
+	status int
+	apiError
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	if e.Code != "" {
+		return e.Message
+	}
+	return e.msg
+}
+
+// redirect points the client at address with a 307, which keeps the method
+// and body of the request.
+func redirect(w http.ResponseWriter, r *http.Request, address string, shard int) {
+	w.Header().Set(shardHeader, strconv.Itoa(shard))
+	w.Header().Set("Location", "http://"+address+r.RequestURI)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	fmt.Fprintf(w, "key belongs to shard %d at %s \n", shard, address)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestForward(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPut || string(body) != "value" || r.Header.Get("If-Match") != `"v1"` {
+			t.Errorf("Unexpected request %s %q with If-Match %q", r.Method, body, r.Header.Get("If-Match"))
+		}
+		if hops := r.Header.Get(hopsHeader); hops != "1" {
+			t.Errorf("Unexpected %s %q", hopsHeader, hops)
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte("stale"))
+	}))
+	defer upstream.Close()
+
+	r := httptest.NewRequest(http.MethodPut, "/v1/keys/a", strings.NewReader("value"))
+	r.Header.Set("If-Match", `"v1"`)
+	w := httptest.NewRecorder()
+	newProxy().forward(w, r, strings.TrimPrefix(upstream.URL, "http://"))
+	if w.Code != http.StatusPreconditionFailed || w.Body.String() != "stale" || w.Header().Get("ETag") != `"v2"` {
+		t.Errorf("Unexpected answer %d %q with ETag %q", w.Code, w.Body, w.Header().Get("ETag"))
+	}
+}
+
+func TestForwardHopLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request %s %s past the hop limit", r.Method, r.URL)
+	}))
+	defer upstream.Close()
+	address := strings.TrimPrefix(upstream.URL, "http://")
+	p := newProxy()
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/keys/a", nil)
+	r.Header.Set(hopsHeader, strconv.Itoa(maxHops))
+	w := httptest.NewRecorder()
+	p.forward(w, r, address)
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("Unexpected status %d forwarding past the hop limit", w.Code)
+	}
+	var out interface{}
+	if err := p.getJSON(r, address, "/v1/scan", &out); err == nil {
+		t.Errorf("Expected an error sending past the hop limit")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	ws := newTestServer(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/v1/keys/a?redirect=true", strings.NewReader("value"))
+	r.Form = r.URL.Query()
+	ws.forwardToShard(0, w, r)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "http://"+testAddress+"/v1/keys/a?redirect=true" {
+		t.Errorf("Unexpected Location %q", location)
+	}
+	if shard := w.Header().Get(shardHeader); shard != "0" {
+		t.Errorf("Unexpected %s %q", shardHeader, shard)
+	}
+}
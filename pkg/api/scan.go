@@ -0,0 +1,321 @@
+package api
+
+import (
+	"cs553/pkg/db"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+type scanItem struct {
+	Key         string `json:"key"`
+	Shard       int    `json:"shard"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type scanResponse struct {
+	Items []scanItem `json:"items"`
+	// ReadTs is the timestamp every shard was read at, indexed by shard. A
+	// local scan only reads its own shard.
+	ReadTs []uint64 `json:"read_ts"`
+	// Next is the token to continue the scan with, empty once it is done
+	Next string `json:"next,omitempty"`
+}
+
+type scanQuery struct {
+	start, end, prefix string
+	limit              int
+	keysOnly           bool
+	// readTs is the timestamp to read each shard at, 0 or none for the
+	// latest one
+	readTs []uint64
+}
+
+// scanCursor is what a continuation token holds: the last key returned and
+// the timestamps the scan reads the shards at, so that every page sees the
+// keys as they were when the first one was read.
+type scanCursor struct {
+	Last   string   `json:"last"`
+	ReadTs []uint64 `json:"read_ts,omitempty"`
+}
+
+// scanToken returns the continuation token of a scan that has returned every
+// key up to and including key.
+func scanToken(key string, readTs []uint64) string {
+	b, _ := json.Marshal(scanCursor{Last: key, ReadTs: readTs})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseScanToken(token string) (scanCursor, error) {
+	var cursor scanCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid token: %w", err)
+	}
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return cursor, fmt.Errorf("invalid token: %w", err)
+	}
+	return cursor, nil
+}
+
+// parseScanReadTs parses the comma separated read timestamps of the shards,
+// where 0 reads a shard at its latest timestamp.
+func parseScanReadTs(v string) ([]uint64, error) {
+	var readTs []uint64
+	for _, part := range strings.Split(v, ",") {
+		ts, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read_ts %q", v)
+		}
+		readTs = append(readTs, ts)
+	}
+	return readTs, nil
+}
+
+func formatScanReadTs(readTs []uint64) string {
+	parts := make([]string, len(readTs))
+	for i, ts := range readTs {
+		parts[i] = strconv.FormatUint(ts, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseScanQuery(q url.Values) (scanQuery, error) {
+	sq := scanQuery{
+		start:    q.Get("start"),
+		end:      q.Get("end"),
+		prefix:   q.Get("prefix"),
+		limit:    defaultScanLimit,
+		keysOnly: q.Get("keys_only") == "true",
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return sq, fmt.Errorf("invalid limit %q", v)
+		}
+		sq.limit = limit
+	}
+	if sq.limit > maxScanLimit {
+		sq.limit = maxScanLimit
+	}
+	if v := q.Get("read_ts"); v != "" {
+		readTs, err := parseScanReadTs(v)
+		if err != nil {
+			return sq, err
+		}
+		sq.readTs = readTs
+	}
+	if v := q.Get("token"); v != "" {
+		cursor, err := parseScanToken(v)
+		if err != nil {
+			return sq, err
+		}
+		// the smallest key after the last one returned
+		if after := cursor.Last + "\x00"; after > sq.start {
+			sq.start = after
+		}
+		if cursor.ReadTs != nil {
+			sq.readTs = cursor.ReadTs
+		}
+	}
+	return sq, nil
+}
+
+// shardReadTs returns the timestamp to read shard at. Timestamps taken
+// before the number of shards changed no longer tell which keys each shard
+// held.
+func (sq scanQuery) shardReadTs(shard, totalShards int) (uint64, error) {
+	if len(sq.readTs) == 0 {
+		return 0, nil
+	}
+	if len(sq.readTs) != totalShards {
+		return 0, fmt.Errorf("read_ts has %d shards but there are %d: %w", len(sq.readTs), totalShards, db.ErrSnapshotTooOld)
+	}
+	return sq.readTs[shard], nil
+}
+
+func (sq scanQuery) values() url.Values {
+	q := url.Values{}
+	q.Set("start", sq.start)
+	q.Set("end", sq.end)
+	q.Set("prefix", sq.prefix)
+	q.Set("limit", strconv.Itoa(sq.limit))
+	if sq.keysOnly {
+		q.Set("keys_only", "true")
+	}
+	if len(sq.readTs) > 0 {
+		q.Set("read_ts", formatScanReadTs(sq.readTs))
+	}
+	return q
+}
+
+// ScanHandler serves /v1/scan, which lists the keys from start up to but not
+// including end that begin with prefix, in order. The keys of every shard
+// are merged into pages of at most limit keys, and the next page is read by
+// passing the token of the answer back. Every page reads a shard at the
+// timestamp the first page read it at, which the answer lists in read_ts,
+// and a scan can be started at those timestamps again by passing them back
+// as read_ts for as long as the versions are retained. With local=true only
+// the keys of the shard of the node are listed.
+func (ws *WebServer) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	q := r.URL.Query()
+	sq, err := parseScanQuery(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+		return
+	}
+
+	var resp scanResponse
+	if q.Get("local") == "true" {
+		resp, err = ws.scanShard(sq)
+	} else {
+		resp, err = ws.scanCluster(r, sq)
+	}
+	if err != nil {
+		status, code := errorStatus(err)
+		var re *remoteError
+		if errors.As(err, &re) && re.Code != "" {
+			status, code = re.status, re.Code
+		} else if status == http.StatusInternalServerError {
+			status, code = http.StatusServiceUnavailable, codeUnavailable
+		}
+		writeError(w, status, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// scanShard reads a page of the keys this shard owns. Keys that a reshard
+// left behind until the next /clean belong to another shard and are skipped.
+func (ws *WebServer) scanShard(sq scanQuery) (scanResponse, error) {
+	if ws.raft != nil {
+		if err := ws.raft.WaitForRead(); err != nil {
+			return scanResponse{}, err
+		}
+	}
+	cfg := ws.config()
+	readTs, err := sq.shardReadTs(cfg.ShardIndex, cfg.TotalShards)
+	if err != nil {
+		return scanResponse{}, err
+	}
+	kvs, readTs, err := ws.db.ScanAt(sq.start, sq.end, sq.prefix, sq.limit+1, readTs)
+	if err != nil {
+		return scanResponse{}, err
+	}
+
+	resp := scanResponse{Items: []scanItem{}, ReadTs: make([]uint64, cfg.TotalShards)}
+	resp.ReadTs[cfg.ShardIndex] = readTs
+	if len(kvs) > sq.limit {
+		kvs = kvs[:sq.limit]
+		resp.Next = scanToken(kvs[len(kvs)-1].Key, resp.ReadTs)
+	}
+	for _, kv := range kvs {
+		if cfg.ShardForKey(kv.Key) != cfg.ShardIndex || strings.HasPrefix(kv.Key, db.ReservedPrefix) {
+			continue
+		}
+		item := scanItem{Key: kv.Key, Shard: cfg.ShardIndex}
+		if !sq.keysOnly {
+			rec, err := db.DecodeRecord(kv.Value)
+			if err != nil {
+				return scanResponse{}, fmt.Errorf("key %q: %w", kv.Key, err)
+			}
+			item.Value = rec.Value
+			item.ContentType = rec.ContentType
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return resp, nil
+}
+
+// scanCluster reads a page from every shard in parallel and merges them.
+func (ws *WebServer) scanCluster(r *http.Request, sq scanQuery) (scanResponse, error) {
+	cfg := ws.config()
+	pages := make([]scanResponse, cfg.TotalShards)
+	errs := make([]error, cfg.TotalShards)
+	uri := r.URL.Path + "?" + sq.values().Encode() + "&local=true"
+
+	var wg sync.WaitGroup
+	for shard := 0; shard < cfg.TotalShards; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			if shard == cfg.ShardIndex {
+				pages[shard], errs[shard] = ws.scanShard(sq)
+				return
+			}
+			errs[shard] = ws.proxy.getJSON(r, ws.membership.Master(shard).Address, uri, &pages[shard])
+		}(shard)
+	}
+	wg.Wait()
+
+	for shard, err := range errs {
+		if err != nil {
+			return scanResponse{}, fmt.Errorf("scanning shard %d: %w", shard, err)
+		}
+	}
+	return mergeScans(pages, sq.limit)
+}
+
+// mergeScans merges the pages of the shards into a page of at most limit
+// keys. A shard with more keys has only been read up to the last key it
+// scanned, so the page stops at the first of those keys, which every shard
+// has been read past.
+func mergeScans(pages []scanResponse, limit int) (scanResponse, error) {
+	var bound string
+	bounded := false
+	readTs := make([]uint64, len(pages))
+	for shard, page := range pages {
+		if shard < len(page.ReadTs) {
+			readTs[shard] = page.ReadTs[shard]
+		}
+		if page.Next == "" {
+			continue
+		}
+		cursor, err := parseScanToken(page.Next)
+		if err != nil {
+			return scanResponse{}, err
+		}
+		if !bounded || cursor.Last < bound {
+			bound, bounded = cursor.Last, true
+		}
+	}
+
+	items := []scanItem{}
+	for _, page := range pages {
+		for _, item := range page.Items {
+			if !bounded || item.Key <= bound {
+				items = append(items, item)
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+
+	resp := scanResponse{Items: items, ReadTs: readTs}
+	if len(items) > limit {
+		resp.Items = items[:limit]
+		resp.Next = scanToken(items[limit-1].Key, readTs)
+	} else if bounded {
+		resp.Next = scanToken(bound, readTs)
+	}
+	return resp, nil
+}
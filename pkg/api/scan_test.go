@@ -0,0 +1,73 @@
+package api
+
+import (
+	"cs553/pkg/db"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestScanAcrossShards(t *testing.T) {
+	wss := newTestCluster(t, 2)
+	var keys []string
+	owners := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		if w := serveKey(t, wss[0], http.MethodPut, key, "value-"+key, nil); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected answer %d %s writing %s", w.Code, w.Body, key)
+		}
+		keys = append(keys, key)
+		owners[wss[0].getKeyHash(key)] = true
+	}
+	if len(owners) != 2 {
+		t.Fatalf("Expected the keys to be spread over both shards")
+	}
+
+	// keys of shard 0 that a reshard left behind on shard 1 are read but
+	// not returned, so shard 1 has read no further than them while shard 0
+	// has read a full page
+	for i, left := 0, 0; left < 10; i++ {
+		key := fmt.Sprintf("key-00-%d", i)
+		if wss[0].getKeyHash(key) != 0 {
+			continue
+		}
+		if err := wss[1].db.PutKey(key, db.EncodeRecord(db.Record{Value: []byte("stale")})); err != nil {
+			t.Fatalf("Unexpected error with PutKey: %v", err)
+		}
+		left++
+	}
+
+	// every key is returned once and in order only if a page stops where
+	// the shard that read the least far stopped
+	for _, limit := range []int{1, 3, 7, 100} {
+		var got []string
+		token := ""
+		for pages := 0; ; pages++ {
+			if pages > 2*len(keys) {
+				t.Fatalf("limit %d: Expected the scan to end after %d pages", limit, pages)
+			}
+			var resp scanResponse
+			target := fmt.Sprintf("/v1/scan?limit=%d&token=%s", limit, token)
+			if w := serve(t, wss[0].ScanHandler, http.MethodGet, target, nil, &resp); w.Code != http.StatusOK {
+				t.Fatalf("limit %d: Unexpected answer %d %s", limit, w.Code, w.Body)
+			}
+			if len(resp.Items) > limit {
+				t.Errorf("limit %d: Unexpected page of %d keys", limit, len(resp.Items))
+			}
+			for _, item := range resp.Items {
+				if item.Shard != wss[0].getKeyHash(item.Key) || string(item.Value) != "value-"+item.Key {
+					t.Errorf("limit %d: Unexpected item %+v", limit, item)
+				}
+				got = append(got, item.Key)
+			}
+			if resp.Next == "" {
+				break
+			}
+			token = resp.Next
+		}
+		if !reflect.DeepEqual(got, keys) {
+			t.Errorf("limit %d: Unexpected keys. Got: %q Expected: %q", limit, got, keys)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"cs553/pkg/db"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// txnDecisionPrefix begins the meta key of every commit in the decision
+	// log of the transactions this node coordinates, which is followed by
+	// the id of the transaction
+	txnDecisionPrefix   = "txn-decision/"
+	txnRecoveryInterval = 5 * time.Second
+)
+
+const (
+	decisionCommit  = "commit"
+	decisionAbort   = "abort"
+	decisionPending = "pending"
+)
+
+type prepareRequest struct {
+	ID  string `json:"id"`
+	Txn db.Txn `json:"txn"`
+}
+
+type prepareResponse struct {
+	Reads [][]byte `json:"reads"`
+}
+
+type decisionRequest struct {
+	ID string `json:"id"`
+}
+
+type decisionResponse struct {
+	Decision string `json:"decision"`
+}
+
+// commitResponse is the answer of a shard that applied a commit, with the
+// write concern it met unless it replicates through raft.
+type commitResponse struct {
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+// coordinator keeps the decision log of the transactions spanning shards
+// that this node coordinates. Only commits are logged: a transaction that is
+// neither running nor logged was aborted, so a participant that asks about a
+// transaction the coordinator lost in a restart aborts it.
+type coordinator struct {
+	db db.Database
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newCoordinator(database db.Database) *coordinator {
+	return &coordinator{db: database, running: make(map[string]bool)}
+}
+
+func (c *coordinator) begin(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running[id] = true
+}
+
+// decide ends the transaction id, durably logging that it commits on shards
+// if commit is set. A transaction whose commit could not be logged has to be
+// aborted instead.
+func (c *coordinator) decide(id string, shards []int, commit bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, id)
+	if !commit {
+		return nil
+	}
+	raw, err := json.Marshal(shards)
+	if err != nil {
+		return err
+	}
+	return c.db.PutMeta(txnDecisionPrefix+id, raw)
+}
+
+// forget drops a commit from the log once every shard has applied it.
+func (c *coordinator) forget(id string) error {
+	return c.db.DeleteMeta(txnDecisionPrefix + id)
+}
+
+// logged returns the logged commits along with the shards they span.
+func (c *coordinator) logged() (map[string][]int, error) {
+	decisions := make(map[string][]int)
+	err := c.db.ForEachMeta(txnDecisionPrefix, func(key string, value []byte) error {
+		var shards []int
+		if err := json.Unmarshal(value, &shards); err != nil {
+			return fmt.Errorf("decoding transaction decision %s: %w", key, err)
+		}
+		decisions[strings.TrimPrefix(key, txnDecisionPrefix)] = shards
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+// decision answers a participant that asks how id was decided.
+func (c *coordinator) decision(id string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running[id] {
+		return decisionPending, nil
+	}
+	raw, err := c.db.GetMeta(txnDecisionPrefix + id)
+	if err != nil {
+		return "", err
+	}
+	if raw != nil {
+		return decisionCommit, nil
+	}
+	return decisionAbort, nil
+}
+
+// newTxnID returns the id of a transaction coordinated by this node. It
+// starts with the address of the node, so that a participant in doubt knows
+// whom to ask.
+func (ws *WebServer) newTxnID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return ws.self + "/" + hex.EncodeToString(b), nil
+}
+
+func txnCoordinator(id string) string {
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// splitTxn groups the conditions, reads and writes of txn by the shard that
+// owns their keys.
+func (ws *WebServer) splitTxn(txn db.Txn) map[int]db.Txn {
+	parts := make(map[int]db.Txn)
+	for _, c := range txn.Conditions {
+		shard := ws.getKeyHash(c.Key)
+		part := parts[shard]
+		part.Conditions = append(part.Conditions, c)
+		parts[shard] = part
+	}
+	for _, key := range txn.Reads {
+		shard := ws.getKeyHash(key)
+		part := parts[shard]
+		part.Reads = append(part.Reads, key)
+		parts[shard] = part
+	}
+	for _, change := range txn.Writes {
+		shard := ws.getKeyHash(change.Key)
+		part := parts[shard]
+		part.Writes = append(part.Writes, change)
+		parts[shard] = part
+	}
+	return parts
+}
+
+// sendToShard posts in to path on the master of shard and decodes the answer
+// into out.
+func (ws *WebServer) sendToShard(r *http.Request, shard int, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return ws.proxy.sendJSON(r, http.MethodPost, ws.membership.Master(shard).Address, path, bytes.NewReader(body), out)
+}
+
+// twoPhaseCommit answers a transaction that spans shards with the reads and
+// write concern of commitAcross.
+func (ws *WebServer) twoPhaseCommit(w http.ResponseWriter, r *http.Request, txn db.Txn, parts map[int]db.Txn) {
+	values, res, status, code, err := ws.commitAcross(r, txn, parts)
+	if err != nil {
+		writeError(w, status, code, err)
+		return
+	}
+	resp := txnResponse{Shards: partShards(parts), Reads: []batchGetResult{}, WriteConcern: res}
+	for i, key := range txn.Reads {
+		resp.Reads = append(resp.Reads, getResults([]string{key}, [][]byte{values[i]}, ws.getKeyHash(key))...)
+	}
+	writeJSON(w, status, resp)
+}
+
+// partShards returns the shards of the parts of a transaction in order.
+func partShards(parts map[int]db.Txn) []int {
+	shards := make([]int, 0, len(parts))
+	for shard := range parts {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// commitAcross is runTxn for a transaction whose parts belong to other
+// shards than this one, or to more than one. Every shard prepares its part,
+// which checks its conditions and locks its keys, and the transaction
+// commits only if all of them did. The decision to commit is logged before
+// any shard hears of it, so that it is delivered even if this node restarts
+// in between. Every shard applies the commit with the write concern of r,
+// and the status is 202 Accepted if one of them did not meet it, whose
+// result is returned.
+func (ws *WebServer) commitAcross(r *http.Request, txn db.Txn, parts map[int]db.Txn) ([][]byte, *writeConcernResult, int, string, error) {
+	// a commit cannot be refused once it is decided, so the write concern is
+	// checked before anything is prepared
+	if _, _, err := ws.parseWriteConcern(r); err != nil {
+		return nil, nil, http.StatusBadRequest, codeInvalidRequest, err
+	}
+	id, err := ws.newTxnID()
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, codeInternal, err
+	}
+	shards := partShards(parts)
+
+	ws.coordinator.begin(id)
+	reads := make([]prepareResponse, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			err := ws.sendToShard(r, shard, "/txn/prepare", prepareRequest{ID: id, Txn: parts[shard]}, &reads[i])
+			if err == nil && len(reads[i].Reads) != len(parts[shard].Reads) {
+				err = fmt.Errorf("answered %d of %d reads", len(reads[i].Reads), len(parts[shard].Reads))
+			}
+			errs[i] = err
+		}(i, shard)
+	}
+	wg.Wait()
+
+	var failed error
+	var status int
+	var code string
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		// fail with the error of the shard that refused to prepare
+		failed = fmt.Errorf("shard %d: %w", shards[i], err)
+		status, code = http.StatusServiceUnavailable, codeUnavailable
+		var re *remoteError
+		if errors.As(err, &re) && re.Code != "" {
+			status, code = re.status, re.Code
+		}
+		break
+	}
+	commit := failed == nil
+	if err := ws.coordinator.decide(id, shards, commit); err != nil {
+		commit, failed = false, fmt.Errorf("logging the decision: %w", err)
+		status, code = http.StatusInternalServerError, codeInternal
+	}
+	results, delivered := ws.deliver(r, id, shards, commit)
+	if delivered && commit {
+		if err := ws.coordinator.forget(id); err != nil {
+			log.Printf("transaction %s: %v", id, err)
+		}
+	}
+	if !commit {
+		return nil, nil, status, code, failed
+	}
+
+	// report the write concern of the shard that fell shortest of it
+	var wc *writeConcernResult
+	status = http.StatusOK
+	if !delivered {
+		status = http.StatusAccepted
+	}
+	for _, res := range results {
+		if res == nil {
+			continue
+		}
+		if wc == nil || !res.satisfied() && wc.satisfied() {
+			wc = res
+		}
+		if !res.satisfied() {
+			status = http.StatusAccepted
+		}
+	}
+	values := make([][]byte, len(txn.Reads))
+	next := make(map[int]int)
+	for i, key := range txn.Reads {
+		shard := ws.getKeyHash(key)
+		j := sort.SearchInts(shards, shard)
+		values[i] = reads[j].Reads[next[shard]]
+		next[shard]++
+	}
+	return values, wc, status, "", nil
+}
+
+// deliver sends the decision on id to shards along with the write concern of
+// r, and reports whether every one of them applied it and the write concern
+// each met. Those that did not apply it are left to recovery.
+func (ws *WebServer) deliver(r *http.Request, id string, shards []int, commit bool) ([]*writeConcernResult, bool) {
+	path := "/txn/abort"
+	if commit {
+		path = "/txn/commit"
+	}
+	query := url.Values{}
+	for _, name := range []string{"write-concern", "write-timeout"} {
+		if v := r.Form.Get(name); v != "" {
+			query.Set(name, v)
+		}
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	ok := make([]bool, len(shards))
+	results := make([]*writeConcernResult, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			var resp commitResponse
+			if err := ws.sendToShard(r, shard, path, decisionRequest{ID: id}, &resp); err != nil {
+				log.Printf("transaction %s: sending %s to shard %d: %v", id, path, shard, err)
+				return
+			}
+			ok[i], results[i] = true, resp.WriteConcern
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, delivered := range ok {
+		if !delivered {
+			return results, false
+		}
+	}
+	return results, true
+}
+
+// TxnPrepareHandler prepares the part of a transaction that this shard owns
+// for its coordinator.
+func (ws *WebServer) TxnPrepareHandler(w http.ResponseWriter, r *http.Request) {
+	var req prepareRequest
+	if !ws.decodeBody(w, r, &req) {
+		return
+	}
+	parts := ws.splitTxn(req.Txn)
+	if _, ok := parts[ws.config().ShardIndex]; !ok || len(parts) != 1 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("transaction holds keys that shard %d does not own", ws.config().ShardIndex))
+		return
+	}
+	if ws.raft != nil && !ws.raft.IsLeader() {
+		ws.forwardToLeader(w, r)
+		return
+	}
+
+	var values [][]byte
+	var err error
+	if ws.raft != nil {
+		values, err = ws.raft.Prepare(req.ID, req.Txn)
+	} else {
+		values, err = ws.db.Prepare(req.ID, req.Txn)
+	}
+	if err != nil {
+		status, code := errorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, prepareResponse{Reads: values})
+}
+
+// TxnCommitHandler applies the writes of a prepared transaction once its
+// coordinator decided to commit it.
+func (ws *WebServer) TxnCommitHandler(w http.ResponseWriter, r *http.Request) {
+	ws.decidePrepared(w, r, true)
+}
+
+// TxnAbortHandler releases the locks of a prepared transaction once its
+// coordinator decided to abort it.
+func (ws *WebServer) TxnAbortHandler(w http.ResponseWriter, r *http.Request) {
+	ws.decidePrepared(w, r, false)
+}
+
+func (ws *WebServer) decidePrepared(w http.ResponseWriter, r *http.Request, commit bool) {
+	var req decisionRequest
+	if !ws.decodeBody(w, r, &req) {
+		return
+	}
+	if ws.raft != nil && !ws.raft.IsLeader() {
+		ws.forwardToLeader(w, r)
+		return
+	}
+	if ws.raft != nil || !commit {
+		if err := ws.finishPrepared(req.ID, commit); err != nil {
+			status, code := errorStatus(err)
+			writeError(w, status, code, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, commitResponse{})
+		return
+	}
+
+	// the commit applied even if the write concern was not met, which the
+	// coordinator answers the client with
+	res, status, err := ws.writeWithConcern(r, func() error {
+		return ws.finishPrepared(req.ID, true)
+	})
+	if err != nil {
+		_, code := errorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, commitResponse{WriteConcern: &res})
+}
+
+// finishPrepared applies the decision on the transaction prepared here under
+// id.
+func (ws *WebServer) finishPrepared(id string, commit bool) error {
+	if ws.raft != nil {
+		if commit {
+			return ws.raft.CommitPrepared(id)
+		}
+		return ws.raft.AbortPrepared(id)
+	}
+	if !commit {
+		return ws.db.AbortPrepared(id)
+	}
+	prepared, err := ws.db.Prepared()
+	if err != nil {
+		return err
+	}
+	return ws.resharder.WriteBatch(prepared[id].Writes, func() error {
+		return ws.db.CommitPrepared(id)
+	})
+}
+
+// TxnDecisionHandler tells a participant how a transaction this node
+// coordinated was decided.
+func (ws *WebServer) TxnDecisionHandler(w http.ResponseWriter, r *http.Request) {
+	decision, err := ws.coordinator.decision(r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, decisionResponse{Decision: decision})
+}
+
+// StartRecovery finishes the transactions spanning shards that a restart or
+// an unreachable node left undecided. The commits this node logged as a
+// coordinator are delivered again, and the coordinators of the transactions
+// prepared here are asked how they were decided.
+func (ws *WebServer) StartRecovery() {
+	go func() {
+		ticker := time.NewTicker(txnRecoveryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ws.recoverDecisions()
+			ws.recoverPrepared()
+		}
+	}()
+}
+
+func (ws *WebServer) recoverDecisions() {
+	decisions, err := ws.coordinator.logged()
+	if err != nil {
+		log.Printf("reading transaction decisions: %v", err)
+		return
+	}
+	for id, shards := range decisions {
+		// a request of our own, which has not been forwarded by anyone
+		r, _ := http.NewRequest(http.MethodPost, "/txn/commit", nil)
+		if _, delivered := ws.deliver(r, id, shards, true); !delivered {
+			continue
+		}
+		if err := ws.coordinator.forget(id); err != nil {
+			log.Printf("transaction %s: %v", id, err)
+		}
+	}
+}
+
+func (ws *WebServer) recoverPrepared() {
+	if ws.raft != nil && !ws.raft.IsLeader() {
+		return
+	}
+	if ws.raft == nil && ws.membership.Master(ws.config().ShardIndex).Address != ws.self {
+		return
+	}
+	prepared, err := ws.db.Prepared()
+	if err != nil {
+		log.Printf("reading prepared transactions: %v", err)
+		return
+	}
+	for id := range prepared {
+		r, _ := http.NewRequest(http.MethodGet, "/txn/decision", nil)
+		var resp decisionResponse
+		if err := ws.proxy.getJSON(r, txnCoordinator(id), "/txn/decision?id="+url.QueryEscape(id), &resp); err != nil {
+			log.Printf("transaction %s: asking its coordinator: %v", id, err)
+			continue
+		}
+		if resp.Decision == decisionPending {
+			continue
+		}
+		if err := ws.finishPrepared(id, resp.Decision == decisionCommit); err != nil {
+			log.Printf("transaction %s: applying %s: %v", id, resp.Decision, err)
+		}
+	}
+}
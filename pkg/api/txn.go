@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bytes"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// txnCondition requires key to be absent, or to be at version.
+type txnCondition struct {
+	Key     string `json:"key"`
+	Absent  bool   `json:"absent,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type txnRequest struct {
+	Conditions []txnCondition  `json:"conditions"`
+	Reads      []string        `json:"reads"`
+	Writes     []batchPutEntry `json:"writes"`
+}
+
+type txnResponse struct {
+	Shards       []int               `json:"shards"`
+	Reads        []batchGetResult    `json:"reads"`
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+// TxnHandler serves /v1/txn, which checks the conditions of a transaction,
+// reads its keys and applies its writes atomically. Nothing is written unless
+// every condition holds, and the reads see the keys as they were before the
+// writes. A transaction whose keys belong to a single shard runs in a single
+// transaction of that shard, and one that spans shards is coordinated by
+// this node with two-phase commit.
+func (ws *WebServer) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	var req txnRequest
+	if !ws.decodeBody(w, r, &req) {
+		return
+	}
+	txn, status, code, err := ws.parseTxn(req)
+	if err != nil {
+		writeError(w, status, code, err)
+		return
+	}
+	parts := ws.splitTxn(txn)
+	if len(parts) > 1 {
+		ws.twoPhaseCommit(w, r, txn, parts)
+		return
+	}
+	for shardIndex := range parts {
+		if shardIndex != ws.config().ShardIndex {
+			ws.forwardToShard(shardIndex, w, r)
+			return
+		}
+		ws.transact(w, r, txn, shardIndex)
+	}
+}
+
+// decodeBody reads the JSON body of a POST into v. The body is kept, so that
+// the request can still be forwarded to the node that serves it.
+func (ws *WebServer) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return false
+	}
+	parseQuery(r)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("reading request: %w", err))
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return true
+}
+
+// parseTxn validates req and returns the transaction it asks for, or the
+// status and error code to refuse it with.
+func (ws *WebServer) parseTxn(req txnRequest) (db.Txn, int, string, error) {
+	var txn db.Txn
+	total := len(req.Conditions) + len(req.Reads) + len(req.Writes)
+	if total == 0 {
+		return txn, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("empty transaction")
+	}
+	if total > maxBatchKeys {
+		return txn, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Errorf("transaction of %d keys is over the limit of %d", total, maxBatchKeys)
+	}
+
+	for _, c := range req.Conditions {
+		if status, code, err := ws.checkTxnKey(c.Key); err != nil {
+			return txn, status, code, err
+		}
+		if c.Absent == (c.Version != "") {
+			return txn, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("condition on key %q needs either absent or a version", c.Key)
+		}
+		txn.Conditions = append(txn.Conditions, db.KeyCondition{Key: c.Key, Condition: db.Condition{Absent: c.Absent, Version: c.Version}})
+	}
+	for _, key := range req.Reads {
+		if status, code, err := ws.checkTxnKey(key); err != nil {
+			return txn, status, code, err
+		}
+		txn.Reads = append(txn.Reads, key)
+	}
+	for _, entry := range req.Writes {
+		if status, code, err := ws.checkTxnKey(entry.Key); err != nil {
+			return txn, status, code, err
+		}
+		if err := ws.checkValueSize(int64(len(entry.Value))); err != nil {
+			return txn, http.StatusRequestEntityTooLarge, codeTooLarge, err
+		}
+		change, err := entry.change()
+		if err != nil {
+			return txn, http.StatusBadRequest, codeInvalidRequest, err
+		}
+		txn.Writes = append(txn.Writes, change)
+	}
+	return txn, 0, "", nil
+}
+
+// checkTxnKey returns the status and error code to refuse a transaction
+// with if key is invalid.
+func (ws *WebServer) checkTxnKey(key string) (int, string, error) {
+	if key == "" {
+		return http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("missing key")
+	}
+	if err := ws.checkWriteKey(key); err != nil {
+		status, code := errorStatus(err)
+		return status, code, err
+	}
+	return 0, "", nil
+}
+
+func (ws *WebServer) transact(w http.ResponseWriter, r *http.Request, txn db.Txn, shardIndex int) {
+	if ws.raft != nil && !ws.raft.IsLeader() {
+		ws.forwardToLeader(w, r)
+		return
+	}
+	values, res, status, code, err := ws.runTxn(r, txn)
+	if err != nil {
+		writeError(w, status, code, err)
+		return
+	}
+	writeJSON(w, status, txnResponse{
+		Shards:       []int{shardIndex},
+		Reads:        getResults(txn.Reads, values, shardIndex),
+		WriteConcern: res,
+	})
+}
+
+// runTxn applies txn through raft, whose leader this node has to be, or to
+// the db with the write concern of r. It returns the reads of txn and the
+// status to answer with, or the status and error code to fail with.
+func (ws *WebServer) runTxn(r *http.Request, txn db.Txn) ([][]byte, *writeConcernResult, int, string, error) {
+	if ws.raft != nil {
+		values, err := ws.raft.Transact(txn)
+		if err != nil {
+			status, code := raftErrorStatus(err)
+			return nil, nil, status, code, err
+		}
+		return values, nil, http.StatusOK, "", nil
+	}
+
+	var values [][]byte
+	res, status, err := ws.writeWithConcern(r, func() error {
+		return ws.resharder.WriteBatch(txn.Writes, func() error {
+			var err error
+			values, err = ws.db.Transact(txn)
+			return err
+		})
+	})
+	if err != nil {
+		code := codeInvalidRequest
+		if status != http.StatusBadRequest {
+			_, code = errorStatus(err)
+		}
+		return nil, nil, status, code, err
+	}
+	return values, &res, status, "", nil
+}
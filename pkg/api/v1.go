@@ -0,0 +1,333 @@
+package api
+
+import (
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	keysPath = "/v1/keys/"
+	// defaultContentType is returned for values written without one
+	defaultContentType = "application/octet-stream"
+	// readTsHeader is the timestamp a value was read at, which a later GET
+	// can pass as read_ts to read the key as it was then
+	readTsHeader = "X-Kvstore-Read-Ts"
+)
+
+// Error codes of the v1 api, which clients can match on rather than on the
+// message.
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeTooLarge         = "too_large"
+	codeConflict         = "conflict"
+	codeLocked           = "locked"
+	codePrecondition     = "precondition_failed"
+	codeNotInteger       = "not_integer"
+	codeOverflow         = "overflow"
+	codeSnapshotTooOld   = "snapshot_too_old"
+	codeReadOnly         = "read_only"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal"
+)
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type keyResponse struct {
+	Key          string              `json:"key"`
+	Shard        int                 `json:"shard"`
+	Version      string              `json:"version,omitempty"`
+	WriteConcern *writeConcernResult `json:"write_concern,omitempty"`
+}
+
+type writeConcernJSON struct {
+	Requested string `json:"requested"`
+	Met       string `json:"met"`
+	Acked     int    `json:"acked"`
+	Replicas  int    `json:"replicas"`
+}
+
+func (res writeConcernResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(writeConcernJSON{string(res.requested), string(res.met), res.acked, res.replicas})
+}
+
+// UnmarshalJSON reads back the result of a write another node answered.
+func (res *writeConcernResult) UnmarshalJSON(b []byte) error {
+	var v writeConcernJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*res = writeConcernResult{config.WriteConcern(v.Requested), config.WriteConcern(v.Met), v.Acked, v.Replicas}
+	return nil
+}
+
+// errorStatus returns the status and error code a failed operation is
+// answered with.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, db.ErrReadOnly):
+		return http.StatusForbidden, codeReadOnly
+	case errors.Is(err, errTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	case errors.Is(err, db.ErrReservedKey):
+		return http.StatusBadRequest, codeInvalidRequest
+	case errors.Is(err, db.ErrLocked):
+		return http.StatusConflict, codeLocked
+	case errors.Is(err, db.ErrNotPrepared):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, db.ErrKeyExists):
+		return http.StatusConflict, codeConflict
+	case errors.Is(err, db.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, codePrecondition
+	case errors.Is(err, db.ErrNotInteger):
+		return http.StatusConflict, codeNotInteger
+	case errors.Is(err, db.ErrOverflow):
+		return http.StatusConflict, codeOverflow
+	case errors.Is(err, db.ErrSnapshotTooOld):
+		return http.StatusGone, codeSnapshotTooOld
+	case errors.Is(err, db.ErrSnapshotAhead):
+		return http.StatusBadRequest, codeInvalidRequest
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// raftErrorStatus is errorStatus for a failed raft write. Raft fails writes
+// while leadership changes hands, so an error of its own is answered as
+// unavailable for the client to retry.
+func raftErrorStatus(err error) (int, string) {
+	status, code := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		return http.StatusServiceUnavailable, codeUnavailable
+	}
+	return status, code
+}
+
+// parseQuery reads the parameters of a request from its query alone. It is
+// used in place of ParseForm by handlers whose body is a value or JSON, which
+// ParseForm would take for a form.
+func parseQuery(r *http.Request) {
+	r.Form = r.URL.Query()
+}
+
+// parseReadTs parses the read_ts parameter, 0 for the latest timestamp if
+// it is empty.
+func parseReadTs(v string) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	ts, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || ts == 0 {
+		return 0, fmt.Errorf("invalid read_ts %q", v)
+	}
+	return ts, nil
+}
+
+// etag quotes a version for the ETag header.
+func etag(version string) string {
+	return `"` + version + `"`
+}
+
+// parseCondition reads the condition of a write from its headers, where
+// If-None-Match: * only writes a key that does not exist, and If-Match only
+// writes a key still at the version of an ETag a GET returned.
+func parseCondition(r *http.Request) (*db.Condition, error) {
+	noneMatch, match := r.Header.Get("If-None-Match"), r.Header.Get("If-Match")
+	switch {
+	case noneMatch != "" && match != "":
+		return nil, fmt.Errorf("If-None-Match and If-Match cannot be combined")
+	case noneMatch != "":
+		if noneMatch != "*" || r.Method != http.MethodPut {
+			return nil, fmt.Errorf("only If-None-Match: * on a PUT is supported")
+		}
+		return &db.Condition{Absent: true}, nil
+	case match != "":
+		version := strings.Trim(match, `"`)
+		if version == "" || version == "*" {
+			return nil, fmt.Errorf("invalid If-Match %q", match)
+		}
+		return &db.Condition{Version: version}, nil
+	}
+	return nil, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	writeJSON(w, status, errorResponse{Error: apiError{Code: code, Message: err.Error()}})
+}
+
+// KeysHandler serves /v1/keys/<key>, where GET returns the value as it was
+// written with its content type, PUT writes the request body as the value and
+// DELETE removes it. A GET with read_ts returns the value as it was at that
+// timestamp of the shard. Other answers are JSON with the status code of the
+// outcome.
+func (ws *WebServer) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, keysPath)
+	if key == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("missing key"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	// leases and locks can be read but not written
+	check := ws.checkWriteKey
+	if r.Method == http.MethodGet {
+		check = ws.checkReadKey
+	}
+	if err := check(key); err != nil {
+		status, code := errorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	parseQuery(r)
+	cond, err := parseCondition(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+		return
+	}
+
+	shardIndex := ws.getKeyHash(key)
+	if shardIndex != ws.config().ShardIndex {
+		ws.forwardToShard(shardIndex, w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		readTs, err := parseReadTs(r.Form.Get("read_ts"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+			return
+		}
+		ws.getKey(w, key, readTs, shardIndex)
+	case http.MethodPut:
+		// refuse a value that is known to be too large before reading it
+		if err := ws.checkValueSize(r.ContentLength); err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, err)
+			return
+		}
+		value, err := ws.readValue(r.Body)
+		if errors.Is(err, errTooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("reading value: %w", err))
+			return
+		}
+		expiresAt, err := parseTTL(r.Form.Get("ttl"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err)
+			return
+		}
+		rec := db.Record{ContentType: r.Header.Get("Content-Type"), Value: value}
+		ws.writeKey(w, r, db.Change{Key: key, Value: db.EncodeRecord(rec), ExpiresAt: expiresAt}, cond, shardIndex)
+	case http.MethodDelete:
+		ws.writeKey(w, r, db.Change{Key: key, Deleted: true}, cond, shardIndex)
+	}
+}
+
+func (ws *WebServer) getKey(w http.ResponseWriter, key string, readTs uint64, shardIndex int) {
+	if ws.raft != nil {
+		if err := ws.raft.WaitForRead(); err != nil {
+			writeError(w, http.StatusServiceUnavailable, codeUnavailable, err)
+			return
+		}
+	}
+
+	value, readTs, err := ws.db.GetAt(key, readTs)
+	if err != nil {
+		status, code := errorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	w.Header().Set(readTsHeader, strconv.FormatUint(readTs, 10))
+	if value == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Errorf("key %q not found", key))
+		return
+	}
+	rec, err := db.DecodeRecord(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	contentType := rec.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(rec.Value)))
+	w.Header().Set(shardHeader, strconv.Itoa(shardIndex))
+	w.Header().Set("ETag", etag(db.Version(value)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(rec.Value)
+}
+
+func (ws *WebServer) writeKey(w http.ResponseWriter, r *http.Request, change db.Change, cond *db.Condition, shardIndex int) {
+	resp := keyResponse{Key: change.Key, Shard: shardIndex}
+	if !change.Deleted {
+		resp.Version = db.Version(change.Value)
+	}
+
+	if ws.raft != nil {
+		if !ws.raft.IsLeader() {
+			ws.forwardToLeader(w, r)
+			return
+		}
+		if err := ws.writeChange(change, cond); err != nil {
+			status, code := raftErrorStatus(err)
+			writeError(w, status, code, err)
+			return
+		}
+		writeVersion(w, http.StatusOK, resp)
+		return
+	}
+
+	res, status, err := ws.writeWithConcern(r, func() error {
+		return ws.resharder.WriteBatch([]db.Change{change}, func() error {
+			return ws.writeChange(change, cond)
+		})
+	})
+	if err != nil {
+		code := codeInvalidRequest
+		if status != http.StatusBadRequest {
+			_, code = errorStatus(err)
+		}
+		writeError(w, status, code, err)
+		return
+	}
+	resp.WriteConcern = &res
+	writeVersion(w, status, resp)
+}
+
+// writeVersion answers a write with the new version of its key in the ETag
+// header as well as the body.
+func writeVersion(w http.ResponseWriter, status int, resp keyResponse) {
+	if resp.Version != "" {
+		w.Header().Set("ETag", etag(resp.Version))
+	}
+	writeJSON(w, status, resp)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"cs553/pkg/db"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{db.ErrReadOnly, http.StatusForbidden, codeReadOnly},
+		{errTooLarge, http.StatusRequestEntityTooLarge, codeTooLarge},
+		{db.ErrReservedKey, http.StatusBadRequest, codeInvalidRequest},
+		{db.ErrLocked, http.StatusConflict, codeLocked},
+		{db.ErrKeyExists, http.StatusConflict, codeConflict},
+		{db.ErrVersionMismatch, http.StatusPreconditionFailed, codePrecondition},
+		{db.ErrNotInteger, http.StatusConflict, codeNotInteger},
+		{db.ErrOverflow, http.StatusConflict, codeOverflow},
+		{db.ErrSnapshotTooOld, http.StatusGone, codeSnapshotTooOld},
+		{db.ErrSnapshotAhead, http.StatusBadRequest, codeInvalidRequest},
+		{errors.New("disk on fire"), http.StatusInternalServerError, codeInternal},
+	} {
+		// errors arrive wrapped with the key they are about
+		err := fmt.Errorf("key %q: %w", "a", tc.err)
+		if status, code := errorStatus(err); status != tc.status || code != tc.code {
+			t.Errorf("errorStatus(%v) = %d, %q, expected %d, %q", err, status, code, tc.status, tc.code)
+		}
+	}
+}
+
+// serveKey runs a request on /v1/keys/<key> with the headers of header.
+func serveKey(t *testing.T, ws *WebServer, method, key, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, keysPath+key, strings.NewReader(body))
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	ws.KeysHandler(w, r)
+	return w
+}
+
+func TestKeys(t *testing.T) {
+	ws := newTestServer(t)
+
+	w := serveKey(t, ws, http.MethodGet, "a", "", nil)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"code":"`+codeNotFound+`"`) {
+		t.Errorf("Unexpected answer %d %s reading a missing key", w.Code, w.Body)
+	}
+
+	w = serveKey(t, ws, http.MethodPut, "a", "one", map[string]string{"Content-Type": "text/plain"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected answer %d %s writing a key", w.Code, w.Body)
+	}
+	first := w.Header().Get("ETag")
+	w = serveKey(t, ws, http.MethodGet, "a", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "one" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Unexpected answer %d %q of type %q reading a key", w.Code, w.Body, w.Header().Get("Content-Type"))
+	}
+	if etag := w.Header().Get("ETag"); etag == "" || etag != first {
+		t.Errorf("Unexpected ETag %q, the write returned %q", etag, first)
+	}
+
+	// a write at the current version succeeds, and moves the version on
+	w = serveKey(t, ws, http.MethodPut, "a", "two", map[string]string{"If-Match": first})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == first {
+		t.Fatalf("Unexpected answer %d %s with ETag %q writing at the current version", w.Code, w.Body, w.Header().Get("ETag"))
+	}
+	for _, header := range []map[string]string{{"If-Match": first}, {"If-None-Match": "*"}} {
+		status, code := http.StatusPreconditionFailed, codePrecondition
+		if header["If-None-Match"] != "" {
+			status, code = http.StatusConflict, codeConflict
+		}
+		w = serveKey(t, ws, http.MethodPut, "a", "three", header)
+		if w.Code != status || !strings.Contains(w.Body.String(), `"code":"`+code+`"`) {
+			t.Errorf("Unexpected answer %d %s writing with %v", w.Code, w.Body, header)
+		}
+	}
+	w = serveKey(t, ws, http.MethodDelete, "a", "", map[string]string{"If-Match": first})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Unexpected answer %d %s deleting at a stale version", w.Code, w.Body)
+	}
+	if w = serveKey(t, ws, http.MethodGet, "a", "", nil); w.Body.String() != "two" {
+		t.Errorf("Unexpected value %q after refused writes", w.Body)
+	}
+
+	if w = serveKey(t, ws, http.MethodDelete, "a", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Unexpected answer %d %s deleting a key", w.Code, w.Body)
+	}
+	if w = serveKey(t, ws, http.MethodGet, "a", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected answer %d %s reading a deleted key", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		method, key, body string
+		status            int
+		code              string
+	}{
+		{http.MethodPost, "a", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodGet, "", "", http.StatusBadRequest, codeInvalidRequest},
+		{http.MethodPut, strings.Repeat("k", 65), "", http.StatusRequestEntityTooLarge, codeTooLarge},
+		{http.MethodPut, "a", strings.Repeat("v", 65), http.StatusRequestEntityTooLarge, codeTooLarge},
+		{http.MethodPut, "a?ttl=soon", "", http.StatusBadRequest, codeInvalidRequest},
+	} {
+		w = serveKey(t, ws, tc.method, tc.key, tc.body, nil)
+		if w.Code != tc.status || !strings.Contains(w.Body.String(), `"code":"`+tc.code+`"`) {
+			t.Errorf("Unexpected answer %d %s to %s %q", w.Code, w.Body, tc.method, tc.key)
+		}
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	ws := newTestServer(t)
+	if w := serve(t, ws.PutHandler, http.MethodGet, "/put?key=a&value=one", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected answer %d %s to /put", w.Code, w.Body)
+	}
+	if w := serve(t, ws.GetHandler, http.MethodGet, "/get?key=a", nil, nil); w.Body.String() != "Value = \"one\", Error = <nil> \n" {
+		t.Errorf("Unexpected answer %q to /get", w.Body)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	t.Chdir(t.TempDir())
+	database, closeFunc, err := db.NewBadgerDatabase("shard0", false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeFunc()
+	ws := newTestServerFor(t, database)
+	if _, err := database.Prepare("txn-1", db.Txn{Writes: []db.Change{{Key: "a", Value: []byte("1")}}}); err != nil {
+		t.Fatalf("Unexpected error with Prepare: %v", err)
+	}
+
+	// the keys badger keeps the prepared transaction and its lock under
+	for _, key := range []string{"%00kvstore/lock/a", "%00kvstore/prepared/txn-1"} {
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			if w := serveKey(t, ws, method, key, "", nil); w.Code != http.StatusBadRequest {
+				t.Errorf("Unexpected answer %d %s to %s %q", w.Code, w.Body, method, key)
+			}
+		}
+		for _, handler := range []http.HandlerFunc{ws.GetHandler, ws.DeleteHandler} {
+			if w := serve(t, handler, http.MethodGet, "/?key="+key, nil, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("Unexpected answer %d %s to the legacy api for %q", w.Code, w.Body, key)
+			}
+		}
+	}
+	prepared, err := database.Prepared()
+	if err != nil {
+		t.Fatalf("Unexpected error with Prepared: %v", err)
+	}
+	if _, ok := prepared["txn-1"]; !ok {
+		t.Errorf("Prepared transaction is gone after requests to its keys")
+	}
+	if w := serveKey(t, ws, http.MethodPut, "a", "2", nil); w.Code != http.StatusConflict {
+		t.Errorf("Unexpected answer %d %s writing a locked key", w.Code, w.Body)
+	}
+}
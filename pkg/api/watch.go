@@ -0,0 +1,209 @@
+package api
+
+import (
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// watchBatch is how many changes a watch reads at most at a time
+	watchBatch = 1000
+	// watchProgressInterval is how often a watch reports the revision it has
+	// reached, which keeps the connection alive and lets a quiet watch
+	// resume from a revision that is still retained
+	watchProgressInterval = 10 * time.Second
+)
+
+type watchEvent struct {
+	Key         string `json:"key"`
+	Revision    uint64 `json:"revision"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	ExpiresAt   uint64 `json:"expires_at,omitempty"`
+}
+
+type watchProgress struct {
+	Revision uint64 `json:"revision"`
+}
+
+// writeEvent writes a server-sent event. An event with an id moves the
+// revision a client resumes from to id.
+func writeEvent(w io.Writer, event string, id uint64, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// WatchHandler serves /v1/watch, which streams the puts and deletes of key,
+// or of the keys that begin with prefix, as server-sent events. A watch
+// starts after revision, the timestamp of the shard that reads and scans
+// return, or at the latest one without it. Only the last event of a revision
+// carries its id, so a client that reconnects with Last-Event-ID resumes
+// after the last revision it saw whole. A key is watched on the shard that
+// owns it, and a prefix on the shard of the node or on shard, as it spans
+// every shard unless the keys are partitioned by range.
+func (ws *WebServer) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	q := r.URL.Query()
+	key, prefix := q.Get("key"), q.Get("prefix")
+	_, hasPrefix := q["prefix"]
+	if key != "" && hasPrefix {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("key and prefix cannot be combined"))
+		return
+	}
+	if key == "" && !hasPrefix {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("missing key or prefix"))
+		return
+	}
+	if err := ws.checkKeySize(key + prefix); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, err)
+		return
+	}
+	revision := q.Get("revision")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		revision = id
+	}
+	from, err := parseReadTs(revision)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid revision %q", revision))
+		return
+	}
+
+	cfg := ws.config()
+	shardIndex := cfg.ShardIndex
+	if key != "" {
+		shardIndex = ws.getKeyHash(key)
+	} else if v := q.Get("shard"); v != "" {
+		if shardIndex, err = strconv.Atoi(v); err != nil || shardIndex < 0 || shardIndex >= cfg.TotalShards {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid shard %q", v))
+			return
+		}
+	}
+	if shardIndex != cfg.ShardIndex {
+		// a watch outlives the timeout of the proxy, so the client is sent
+		// to the shard instead
+		redirect(w, r, ws.membership.Master(shardIndex).Address, shardIndex)
+		return
+	}
+	ws.watch(w, r, key, prefix, from, shardIndex)
+}
+
+func (ws *WebServer) watch(w http.ResponseWriter, r *http.Request, key, prefix string, from uint64, shardIndex int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	if key != "" {
+		prefix = key
+	}
+	if from == 0 {
+		// every read returns the latest timestamp
+		var err error
+		if _, from, err = ws.db.GetAt(key, 0); err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, err)
+			return
+		}
+	}
+
+	// the first read fails the request rather than the stream, such as for
+	// a revision that is no longer retained
+	changed := ws.db.WaitForChanges()
+	changes, next, err := ws.db.ChangesSince(prefix, from, watchBatch)
+	if err != nil {
+		status, code := errorStatus(err)
+		writeError(w, status, code, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set(shardHeader, strconv.Itoa(shardIndex))
+	w.WriteHeader(http.StatusOK)
+	if err := writeEvent(w, "progress", from, watchProgress{Revision: from}); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(watchProgressInterval)
+	defer ticker.Stop()
+	for {
+		if err := writeChanges(w, key, changes); err != nil {
+			return
+		}
+		flusher.Flush()
+		from = next
+
+		// a full batch is followed by the next one right away
+		if len(changes) == 0 {
+			select {
+			case <-changed:
+			case <-ticker.C:
+				if err := writeEvent(w, "progress", from, watchProgress{Revision: from}); err != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		changed = ws.db.WaitForChanges()
+		if changes, next, err = ws.db.ChangesSince(prefix, from, watchBatch); err != nil {
+			_, code := errorStatus(err)
+			writeEvent(w, "error", 0, apiError{Code: code, Message: err.Error()})
+			return
+		}
+	}
+}
+
+// writeChanges writes the changes of a watch as put and delete events. A
+// watch of a single key also reads the keys it is a prefix of, which are
+// left out, as are the keys of leases and locks.
+func writeChanges(w io.Writer, key string, changes []db.Change) error {
+	var matched []db.Change
+	for _, change := range changes {
+		if key != "" && change.Key != key || strings.HasPrefix(change.Key, db.ReservedPrefix) {
+			continue
+		}
+		matched = append(matched, change)
+	}
+	changes = matched
+	for i, change := range changes {
+		var id uint64
+		if i == len(changes)-1 || changes[i+1].Sequence != change.Sequence {
+			id = change.Sequence
+		}
+		event := watchEvent{Key: change.Key, Revision: change.Sequence}
+		name := "delete"
+		if !change.Deleted {
+			name = "put"
+			rec, err := db.DecodeRecord(change.Value)
+			if err != nil {
+				rec = db.Record{Value: change.Value}
+			}
+			event.Value, event.ContentType, event.ExpiresAt = rec.Value, rec.ContentType, change.ExpiresAt
+		}
+		if err := writeEvent(w, name, id, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sseEvent is a server-sent event as a client reads it.
+type sseEvent struct {
+	name string
+	id   string
+	data watchEvent
+}
+
+// readEvent reads the next event of a stream.
+func readEvent(t *testing.T, scanner *bufio.Scanner) sseEvent {
+	t.Helper()
+	var event sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data); err != nil {
+				t.Fatalf("Unexpected error decoding %q: %v", line, err)
+			}
+		}
+	}
+	t.Fatalf("Unexpected end of the stream: %v", scanner.Err())
+	return event
+}
+
+// openWatch starts a watch of url, resuming after lastEventID unless it
+// is empty, and reads its first progress event.
+func openWatch(t *testing.T, url, lastEventID string) (*bufio.Scanner, func()) {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewRequest: %v", err)
+	}
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Unexpected error with a watch: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d of a watch", resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	if event := readEvent(t, scanner); event.name != "progress" {
+		t.Fatalf("Unexpected first event %+v", event)
+	}
+	return scanner, func() { resp.Body.Close() }
+}
+
+func TestWatchResume(t *testing.T) {
+	ws := newTestServer(t)
+	server := httptest.NewServer(http.HandlerFunc(ws.WatchHandler))
+	defer server.Close()
+	put := func(key, value string) {
+		if w := serveKey(t, ws, http.MethodPut, key, value, nil); w.Code != http.StatusOK {
+			t.Fatalf("Unexpected answer %d %s writing %s", w.Code, w.Body, key)
+		}
+	}
+
+	put("w/a", "1")
+	scanner, closeWatch := openWatch(t, server.URL+"/v1/watch?prefix=w/", "")
+	put("w/b", "2")
+	event := readEvent(t, scanner)
+	if event.name != "put" || event.data.Key != "w/b" || event.id != strconv.FormatUint(event.data.Revision, 10) {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	closeWatch()
+
+	// a reconnect with the id of the last event picks up after it, and the
+	// header wins over the revision the watch was first opened with
+	put("w/c", "3")
+	scanner, closeWatch = openWatch(t, server.URL+"/v1/watch?prefix=w/&revision=1", event.id)
+	defer closeWatch()
+	resumed := readEvent(t, scanner)
+	if resumed.name != "put" || resumed.data.Key != "w/c" || string(resumed.data.Value) != "3" || resumed.data.Revision <= event.data.Revision {
+		t.Errorf("Unexpected event after resuming from %s: %+v", event.id, resumed)
+	}
+
+	// an id that is not a revision is refused
+	r := httptest.NewRequest(http.MethodGet, "/v1/watch?prefix=w/", nil)
+	r.Header.Set("Last-Event-ID", "nope")
+	w := httptest.NewRecorder()
+	ws.WatchHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status %d with an invalid Last-Event-ID", w.Code)
+	}
+}
@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Master is the node currently accepting writes for a shard. Term is bumped
+// every time a replica is promoted, and a higher term always wins so that
+// two nodes cannot both be believed to be the master.
+type Master struct {
+	Address string
+	Term    uint64
+}
+
+// Membership tracks the master of every shard. It starts out with the
+// addresses in config.yaml and follows the promotions announced by other
+// nodes. What it learns is persisted so that a restarted node does not fall
+// back to a master that has been replaced.
+type Membership struct {
+	config *config.Config
+	db     db.Database
+	client *http.Client
+
+	mu        sync.RWMutex
+	masters   map[int]Master
+	listeners []func(shard int, master Master)
+}
+
+func masterMetaKey(shard int) string {
+	return "master-" + strconv.Itoa(shard)
+}
+
+// layoutKey holds the config.yaml contents of the last committed reshard,
+// which replace the node's config file on startup.
+const layoutKey = "layout"
+
+func NewMembership(c *config.Config, database db.Database) (*Membership, error) {
+	raw, err := database.GetMeta(layoutKey)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		if c, err = config.ParseConfig(raw, c.ShardName); err != nil {
+			return nil, fmt.Errorf("parsing resharded layout: %w", err)
+		}
+	}
+
+	m := &Membership{
+		config:  c,
+		db:      database,
+		client:  &http.Client{Timeout: time.Second},
+		masters: make(map[int]Master),
+	}
+	for shard, address := range c.ShardToAddress {
+		master := Master{Address: address}
+		raw, err := database.GetMeta(masterMetaKey(shard))
+		if err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			if err := json.Unmarshal(raw, &master); err != nil {
+				return nil, fmt.Errorf("decoding master of shard %d: %w", shard, err)
+			}
+		}
+		m.masters[shard] = master
+	}
+	return m, nil
+}
+
+// Config returns the layout of the cluster, which changes when a reshard
+// commits.
+func (m *Membership) Config() *config.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config
+}
+
+// SetConfig switches to a new layout. Shards we already follow keep their
+// current master, in case it changed through failover.
+func (m *Membership) SetConfig(c *config.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for shard := range m.masters {
+		if _, ok := c.ShardToAddress[shard]; !ok {
+			delete(m.masters, shard)
+		}
+	}
+	for shard, address := range c.ShardToAddress {
+		if _, ok := m.masters[shard]; !ok {
+			m.masters[shard] = Master{Address: address}
+		}
+	}
+	m.config = c
+}
+
+func (m *Membership) Master(shard int) Master {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.masters[shard]
+}
+
+func (m *Membership) Masters() map[int]Master {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	masters := make(map[int]Master, len(m.masters))
+	for shard, master := range m.masters {
+		masters[shard] = master
+	}
+	return masters
+}
+
+// Update records a new master for the shard if its term is newer than the
+// one we know about, and reports whether it did.
+func (m *Membership) Update(shard int, master Master) (bool, error) {
+	m.mu.Lock()
+	current, ok := m.masters[shard]
+	if !ok || master.Term <= current.Term {
+		m.mu.Unlock()
+		return false, nil
+	}
+	m.masters[shard] = master
+	listeners := m.listeners
+	m.mu.Unlock()
+
+	raw, err := json.Marshal(&master)
+	if err != nil {
+		return true, err
+	}
+	if err := m.db.PutMeta(masterMetaKey(shard), raw); err != nil {
+		return true, err
+	}
+
+	log.Printf("shard %d is now led by %q at term %d", shard, master.Address, master.Term)
+	for _, fn := range listeners {
+		fn(shard, master)
+	}
+	return true, nil
+}
+
+// OnChange registers fn to be called after the master of a shard changes.
+func (m *Membership) OnChange(fn func(shard int, master Master)) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, fn)
+	m.mu.Unlock()
+}
+
+// Members returns every node of the shard listed in config.yaml, the
+// original master first.
+func (m *Membership) Members(shard int) []string {
+	c := m.Config()
+	return append([]string{c.ShardToAddress[shard]}, c.ShardToReplicas[shard]...)
+}
+
+// Replicas returns the members of the shard that are not its master.
+func (m *Membership) Replicas(shard int) []string {
+	master := m.Master(shard)
+	var replicas []string
+	for _, member := range m.Members(shard) {
+		if member != master.Address {
+			replicas = append(replicas, member)
+		}
+	}
+	return replicas
+}
+
+func (m *Membership) allAddresses() []string {
+	var addresses []string
+	for shard := range m.Config().ShardToAddress {
+		addresses = append(addresses, m.Members(shard)...)
+	}
+	return addresses
+}
+
+// Announce tells every node in the cluster about the master of a shard.
+// Nodes that are down learn about it from Sync once they come back.
+func (m *Membership) Announce(shard int, master Master) {
+	u := url.Values{}
+	u.Set("shard", strconv.Itoa(shard))
+	u.Set("address", master.Address)
+	u.Set("term", strconv.FormatUint(master.Term, 10))
+
+	for _, address := range m.allAddresses() {
+		if address == master.Address {
+			continue
+		}
+		resp, err := m.client.Get("http://" + address + "/cluster/master?" + u.Encode())
+		if err != nil {
+			log.Printf("could not announce master of shard %d to %q: %v", shard, address, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// Sync asks every other node which masters it knows about and keeps the
+// newest ones. It is run on startup to catch up on promotions that happened
+// while this node was down.
+func (m *Membership) Sync(self string) {
+	for _, address := range m.allAddresses() {
+		if address == self {
+			continue
+		}
+		resp, err := m.client.Get("http://" + address + "/cluster/master")
+		if err != nil {
+			continue
+		}
+		var masters map[int]Master
+		err = json.NewDecoder(resp.Body).Decode(&masters)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("could not decode masters from %q: %v", address, err)
+			continue
+		}
+		for shard, master := range masters {
+			if _, err := m.Update(shard, master); err != nil {
+				log.Printf("could not update master of shard %d: %v", shard, err)
+			}
+		}
+	}
+}
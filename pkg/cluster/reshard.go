@@ -0,0 +1,452 @@
+package cluster
+
+import (
+	"bytes"
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const reshardBatch = 500
+
+// Resharder moves keys to a new layout of the cluster while it keeps
+// serving. A reshard goes through three steps on every node:
+//
+//   - begin: the node learns the new layout, but keeps routing by the old
+//     one. From then on every write to a key that moves is also sent to the
+//     key's new owner, and the keys that could not be sent are sent again
+//     before commit.
+//   - copy: the master of every old shard sends the keys that move to their
+//     new owners.
+//   - commit: the node routes by the new layout and drops the keys it no
+//     longer owns.
+//
+// Once every node has been committed, no key that moved is written anywhere
+// but on its new owner.
+type Resharder struct {
+	db         db.Database
+	membership *Membership
+	client     *http.Client
+
+	// mu orders local writes against the start and the end of a reshard.
+	// Writes hold it for reading, so that they only wait for each other
+	// while a reshard begins or commits, and none of them is left out of the
+	// keys sent to their new owners.
+	mu      sync.RWMutex
+	next    *config.Config
+	nextRaw []byte
+	// done is closed once the reshard commits or is aborted
+	done chan struct{}
+
+	// keysMu guards pending and sending. pending holds the moving keys whose
+	// latest value has not reached their new owner, and sending the ones on
+	// their way there.
+	keysMu  sync.Mutex
+	pending map[string]bool
+	sending map[string]bool
+}
+
+func NewResharder(database db.Database, membership *Membership) *Resharder {
+	return &Resharder{
+		db:         database,
+		membership: membership,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		pending:    make(map[string]bool),
+		sending:    make(map[string]bool),
+	}
+}
+
+func (r *Resharder) post(address, path string, body []byte) ([]byte, error) {
+	resp, err := r.client.Post("http://"+address+path, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s%s returned %s: %s", address, path, resp.Status, out)
+	}
+	return out, nil
+}
+
+// ownerAddress returns the master of a shard in the new layout. Shards that
+// already exist may have failed over to another node since.
+func (r *Resharder) ownerAddress(next *config.Config, shard int) string {
+	if master := r.membership.Master(shard); master.Address != "" {
+		return master.Address
+	}
+	return next.ShardToAddress[shard]
+}
+
+func (r *Resharder) send(next *config.Config, shard int, changes []db.Change) error {
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	_, err = r.post(r.ownerAddress(next, shard), "/reshard/import", body)
+	return err
+}
+
+// Write runs a local put or delete of key and, while a reshard is under
+// way, sends it on to the key's new owner as well.
+func (r *Resharder) Write(key string, value []byte, deleted bool, write func() error) error {
+	return r.WriteBatch([]db.Change{{Key: key, Value: value, Deleted: deleted}}, write)
+}
+
+// WriteBatch runs a local write of changes and, while a reshard is under
+// way, sends the ones whose keys move on to their new owners as well. The
+// local write has taken effect once it succeeded, so keys that could not be
+// sent on do not fail it, but are sent again before the reshard commits.
+func (r *Resharder) WriteBatch(changes []db.Change, write func() error) error {
+	r.mu.RLock()
+	next := r.next
+	err := write()
+	var keys []string
+	if err == nil && next != nil {
+		self := r.membership.Config().ShardIndex
+		for _, change := range changes {
+			if next.ShardForKey(change.Key) != self {
+				keys = append(keys, change.Key)
+			}
+		}
+		r.markPending(keys)
+	}
+	r.mu.RUnlock()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	if err := r.sendKeys(next, keys); err != nil {
+		log.Printf("could not forward keys to the shards they are moving to, sending them again before commit: %v", err)
+	}
+	return nil
+}
+
+func (r *Resharder) markPending(keys []string) {
+	r.keysMu.Lock()
+	for _, key := range keys {
+		r.pending[key] = true
+	}
+	r.keysMu.Unlock()
+}
+
+// sendKeys sends the pending keys among keys to their owners under next, as
+// they are now. A key is only on its way once at a time and is read right
+// before it is sent, so an older value of it never arrives after a newer
+// one. Keys written while they were on their way are sent again, and keys
+// that could not be sent stay pending.
+func (r *Resharder) sendKeys(next *config.Config, keys []string) error {
+	var firstErr error
+	for len(keys) > 0 {
+		r.keysMu.Lock()
+		var claimed []string
+		for _, key := range keys {
+			if r.pending[key] && !r.sending[key] {
+				delete(r.pending, key)
+				r.sending[key] = true
+				claimed = append(claimed, key)
+			}
+		}
+		r.keysMu.Unlock()
+
+		failed := make(map[string]bool)
+		moving := make(map[int][]db.Change)
+		for _, key := range claimed {
+			change, err := r.read(key)
+			if err != nil {
+				failed[key] = true
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			shard := next.ShardForKey(key)
+			moving[shard] = append(moving[shard], change)
+		}
+		for shard, changes := range moving {
+			if err := r.send(next, shard, changes); err != nil {
+				for _, change := range changes {
+					failed[change.Key] = true
+				}
+				if firstErr == nil {
+					firstErr = fmt.Errorf("sending %d keys to shard %d: %w", len(changes), shard, err)
+				}
+			}
+		}
+
+		r.keysMu.Lock()
+		var again []string
+		for _, key := range claimed {
+			delete(r.sending, key)
+			if failed[key] {
+				r.pending[key] = true
+			} else if r.pending[key] {
+				again = append(again, key)
+			}
+		}
+		r.keysMu.Unlock()
+		keys = again
+	}
+	return firstErr
+}
+
+// read returns the change that brings the new owner of key up to date.
+func (r *Resharder) read(key string) (db.Change, error) {
+	value, found, err := db.Lookup(r.db, key)
+	if err != nil {
+		return db.Change{}, err
+	}
+	expiresAt, err := r.db.GetExpiry(key)
+	if err != nil {
+		return db.Change{}, err
+	}
+	// the key may have been deleted or expired since it was listed
+	return db.Change{Key: key, Value: value, Deleted: !found, ExpiresAt: expiresAt}, nil
+}
+
+// sendPending sends the keys whose writes did not reach their new owner
+// again, as they are now.
+func (r *Resharder) sendPending(next *config.Config) error {
+	r.keysMu.Lock()
+	keys := make([]string, 0, len(r.pending))
+	for key := range r.pending {
+		keys = append(keys, key)
+	}
+	r.keysMu.Unlock()
+	return r.sendKeys(next, keys)
+}
+
+// Import stores keys sent over by their old owner.
+func (r *Resharder) Import(changes []db.Change) error {
+	return r.db.PutBatch(changes)
+}
+
+func (r *Resharder) validate(next *config.Config) error {
+	current := r.membership.Config()
+	if next.ShardIndex != current.ShardIndex {
+		return fmt.Errorf("shard %s would move from index %d to %d", current.ShardName, current.ShardIndex, next.ShardIndex)
+	}
+	for _, c := range []*config.Config{current, next} {
+		for _, s := range c.Shards {
+			if s.Shard.UsesRaft() {
+				return fmt.Errorf("shard %s is replicated through raft, which cannot be resharded", s.Shard.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Begin starts forwarding writes of keys that move under the new layout.
+func (r *Resharder) Begin(raw []byte) error {
+	next, err := config.ParseConfig(raw, r.membership.Config().ShardName)
+	if err != nil {
+		return err
+	}
+	if err := r.validate(next); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.next, r.nextRaw, r.done = next, raw, make(chan struct{})
+	r.mu.Unlock()
+	r.keysMu.Lock()
+	r.pending, r.sending = make(map[string]bool), make(map[string]bool)
+	r.keysMu.Unlock()
+	return nil
+}
+
+// Abort drops a reshard that has not been committed. Keys that were already
+// copied stay on their new owners until the next /clean.
+func (r *Resharder) Abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next != nil {
+		close(r.done)
+	}
+	r.next, r.nextRaw = nil, nil
+}
+
+// Resharding reports whether a reshard has begun but is not committed yet.
+func (r *Resharder) Resharding() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.next != nil
+}
+
+// AwaitCommit waits up to timeout for a reshard under way to be committed
+// or aborted, and reports whether none is under way any more.
+func (r *Resharder) AwaitCommit(timeout time.Duration) bool {
+	r.mu.RLock()
+	next, done := r.next, r.done
+	r.mu.RUnlock()
+	if next == nil {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Copy sends every key that moves under the new layout to its new owner and
+// returns how many it sent. Keys written in the meantime are forwarded by
+// Write, so a single pass is enough.
+func (r *Resharder) Copy() (int, error) {
+	r.mu.RLock()
+	next := r.next
+	r.mu.RUnlock()
+	if next == nil {
+		return 0, fmt.Errorf("no reshard in progress")
+	}
+
+	self := r.membership.Config().ShardIndex
+	var keys []string
+	err := r.db.ForEach(func(key string, value []byte, _ uint64) error {
+		if next.ShardForKey(key) != self {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for start := 0; start < len(keys); start += reshardBatch {
+		end := start + reshardBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		r.markPending(keys[start:end])
+		if err := r.sendKeys(next, keys[start:end]); err != nil {
+			return moved, err
+		}
+		moved += end - start
+	}
+	return moved, nil
+}
+
+// Commit switches routing to the new layout, which is persisted so that it
+// outlives config.yaml, and drops the keys this node no longer owns.
+func (r *Resharder) Commit() error {
+	r.mu.RLock()
+	next := r.next
+	r.mu.RUnlock()
+	if next == nil {
+		return fmt.Errorf("no reshard in progress")
+	}
+	if err := r.sendPending(next); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	next, raw := r.next, r.nextRaw
+	if next == nil {
+		r.mu.Unlock()
+		return fmt.Errorf("no reshard in progress")
+	}
+	r.keysMu.Lock()
+	left := len(r.pending) + len(r.sending)
+	r.keysMu.Unlock()
+	if left > 0 {
+		r.mu.Unlock()
+		return fmt.Errorf("%d keys written meanwhile have not reached their new owners yet, commit again", left)
+	}
+	if err := r.db.PutMeta(layoutKey, raw); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.membership.SetConfig(next)
+	close(r.done)
+	r.next, r.nextRaw = nil, nil
+	r.mu.Unlock()
+
+	return r.db.DeleteBulkKeys(func(key string) bool {
+		return next.ShardForKey(key) != next.ShardIndex
+	})
+}
+
+// Reshard runs a whole reshard from this node, reporting its progress to
+// out. Every node of the old and new layouts has to be up, including the
+// nodes of new shards, which are started with the new config.yaml.
+func (r *Resharder) Reshard(raw []byte, out io.Writer) error {
+	next, err := config.ParseConfig(raw, r.membership.Config().ShardName)
+	if err != nil {
+		return err
+	}
+	if err := r.validate(next); err != nil {
+		return err
+	}
+
+	current := r.membership.Config()
+	var nodes []string
+	seen := make(map[string]bool)
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			nodes = append(nodes, address)
+		}
+	}
+	for _, c := range []*config.Config{current, next} {
+		for shard, address := range c.ShardToAddress {
+			add(address)
+			for _, replica := range c.ShardToReplicas[shard] {
+				add(replica)
+			}
+		}
+	}
+	// and the masters that took over through failover
+	for _, master := range r.membership.Masters() {
+		add(master.Address)
+	}
+
+	abort := func(err error) error {
+		for _, node := range nodes {
+			r.post(node, "/reshard/abort", nil)
+		}
+		return err
+	}
+
+	for _, node := range nodes {
+		if _, err := r.post(node, "/reshard/begin", raw); err != nil {
+			return abort(err)
+		}
+	}
+	fmt.Fprintf(out, "began resharding from %d to %d shards on %d nodes \n", current.TotalShards, next.TotalShards, len(nodes))
+
+	for shard := range current.ShardToAddress {
+		master := r.membership.Master(shard).Address
+		moved, err := r.post(master, "/reshard/copy", nil)
+		if err != nil {
+			return abort(err)
+		}
+		fmt.Fprintf(out, "shard %d at %s moved %s keys \n", shard, master, bytes.TrimSpace(moved))
+	}
+
+	// past this point every new owner has its keys, so a node that fails to
+	// commit only needs to be committed again
+	var failed []string
+	for _, node := range nodes {
+		if _, err := r.post(node, "/reshard/commit", nil); err != nil {
+			fmt.Fprintf(out, "could not commit %s: %v \n", node, err)
+			failed = append(failed, node)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("reshard copied but not committed on %v", failed)
+	}
+	fmt.Fprintf(out, "committed %d shards \n", next.TotalShards)
+	return nil
+}
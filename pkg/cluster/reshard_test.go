@@ -0,0 +1,264 @@
+package cluster
+
+import (
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testLayout = `Shard:
+  Name: shard0
+  Index: 0
+  Address: localhost:8080`
+
+// importer stands in for the master of a new shard, keeping the keys it is
+// sent.
+type importer struct {
+	mu   sync.Mutex
+	keys map[string]db.Change
+	fail bool
+	// delay holds every import for up to this long, so that concurrent
+	// imports arrive out of order
+	delay time.Duration
+}
+
+func (im *importer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var changes []db.Change
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if im.delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(im.delay))))
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	for _, change := range changes {
+		im.keys[change.Key] = change
+	}
+}
+
+func (im *importer) get(key string) (db.Change, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	change, ok := im.keys[key]
+	return change, ok
+}
+
+func (im *importer) setFail(fail bool) {
+	im.mu.Lock()
+	im.fail = fail
+	im.mu.Unlock()
+}
+
+// newTestResharder returns a resharder for shard0 of testLayout, and the
+// layout that splits it into a second shard served by im.
+func newTestResharder(t *testing.T, im *importer) (*Resharder, db.Database, []byte) {
+	database, closeFunc, err := db.NewBoltDatabase(filepath.Join(t.TempDir(), "shard0"), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBoltDatabase: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	current, err := config.ParseConfig([]byte(testLayout), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig: %v", err)
+	}
+	membership, err := NewMembership(current, database)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewMembership: %v", err)
+	}
+
+	server := httptest.NewServer(im)
+	t.Cleanup(server.Close)
+	next := fmt.Sprintf("%s\n---\nShard:\n  Name: shard1\n  Index: 1\n  Address: %s", testLayout, strings.TrimPrefix(server.URL, "http://"))
+	return NewResharder(database, membership), database, []byte(next)
+}
+
+// movingKeys returns n keys that move to shard1 under next.
+func movingKeys(t *testing.T, next []byte, n int) []string {
+	c, err := config.ParseConfig(next, "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig: %v", err)
+	}
+	var keys []string
+	for i := 0; len(keys) < n; i++ {
+		if key := "key-" + strconv.Itoa(i); c.ShardForKey(key) == 1 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestReshard(t *testing.T) {
+	im := &importer{keys: make(map[string]db.Change)}
+	r, database, next := newTestResharder(t, im)
+	for i := 0; i < 50; i++ {
+		if err := database.PutKey("key-"+strconv.Itoa(i), []byte("value-"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Unexpected error with PutKey: %v", err)
+		}
+	}
+	moving := movingKeys(t, next, 3)
+
+	if err := r.Begin(next); err != nil {
+		t.Fatalf("Unexpected error with Begin: %v", err)
+	}
+	if !r.Resharding() {
+		t.Errorf("Expected a reshard to be under way after Begin")
+	}
+	moved, err := r.Copy()
+	if err != nil {
+		t.Fatalf("Unexpected error with Copy: %v", err)
+	}
+	if moved == 0 || moved == 50 || moved != len(im.keys) {
+		t.Errorf("Unexpected number of keys copied. Got: %d Expected: the %d keys imported", moved, len(im.keys))
+	}
+	if change, ok := im.get(moving[0]); !ok || string(change.Value) != "value-"+strings.TrimPrefix(moving[0], "key-") {
+		t.Errorf("Unexpected copy of %s. Got: %+v", moving[0], change)
+	}
+
+	// writes of keys that move are sent on, and local keys are not
+	put := func(key, value string) error {
+		return r.Write(key, []byte(value), false, func() error {
+			return database.PutKey(key, []byte(value))
+		})
+	}
+	if err := put(moving[0], "written"); err != nil {
+		t.Fatalf("Unexpected error with Write: %v", err)
+	}
+	if change, _ := im.get(moving[0]); string(change.Value) != "written" {
+		t.Errorf("Unexpected value of a write during the reshard on the new owner. Got: %q Expected: written", change.Value)
+	}
+	err = r.Write(moving[1], nil, true, func() error {
+		return database.DeleteKey(moving[1])
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error with Write: %v", err)
+	}
+	if change, _ := im.get(moving[1]); !change.Deleted {
+		t.Errorf("Expected a delete during the reshard to reach the new owner, got: %+v", change)
+	}
+
+	// a write the new owner missed holds up the commit until it is sent
+	im.setFail(true)
+	if err := put(moving[2], "missed"); err != nil {
+		t.Fatalf("Unexpected error with a Write the new owner missed: %v", err)
+	}
+	if err := r.Commit(); err == nil {
+		t.Fatalf("Expected Commit to fail while the new owner is down")
+	}
+	im.setFail(false)
+	if err := r.Commit(); err != nil {
+		t.Fatalf("Unexpected error with Commit: %v", err)
+	}
+	if change, _ := im.get(moving[2]); string(change.Value) != "missed" {
+		t.Errorf("Unexpected value of a missed write on the new owner. Got: %q Expected: missed", change.Value)
+	}
+
+	if r.Resharding() || !r.AwaitCommit(0) {
+		t.Errorf("Expected no reshard to be under way after Commit")
+	}
+	if got := r.membership.Config().TotalShards; got != 2 {
+		t.Errorf("Unexpected layout after Commit. Got: %d shards Expected: 2", got)
+	}
+	if raw, err := database.GetMeta(layoutKey); err != nil || string(raw) != string(next) {
+		t.Errorf("Expected the layout to be persisted, got: %q %v", raw, err)
+	}
+	for _, key := range moving {
+		if _, found, err := db.Lookup(database, key); err != nil || found {
+			t.Errorf("Expected %s to be dropped after Commit, got: %v %v", key, found, err)
+		}
+	}
+}
+
+func TestReshardWritesDuringCopy(t *testing.T) {
+	im := &importer{keys: make(map[string]db.Change), delay: 5 * time.Millisecond}
+	r, database, next := newTestResharder(t, im)
+	keys := movingKeys(t, next, 20)
+	for _, key := range keys {
+		if err := database.PutKey(key, []byte("0")); err != nil {
+			t.Fatalf("Unexpected error with PutKey: %v", err)
+		}
+	}
+	if err := r.Begin(next); err != nil {
+		t.Fatalf("Unexpected error with Begin: %v", err)
+	}
+
+	// every key is written by two writers at once while it is copied, and
+	// the new owner has to end up with the value the key has here
+	const writes = 10
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; i <= writes; i++ {
+				for _, key := range keys {
+					value := []byte(strconv.Itoa(w*writes + i))
+					err := r.Write(key, value, false, func() error {
+						return database.PutKey(key, value)
+					})
+					if err != nil {
+						t.Errorf("Unexpected error with Write: %v", err)
+					}
+				}
+			}
+		}(w)
+	}
+	if _, err := r.Copy(); err != nil {
+		t.Errorf("Unexpected error with Copy: %v", err)
+	}
+	wg.Wait()
+
+	for _, key := range keys {
+		value, err := database.GetKey(key)
+		if err != nil {
+			t.Fatalf("Unexpected error with GetKey: %v", err)
+		}
+		if change, _ := im.get(key); string(change.Value) != string(value) {
+			t.Errorf("Unexpected value of %s on the new owner. Got: %q Expected: %q", key, change.Value, value)
+		}
+	}
+	if err := r.Commit(); err != nil {
+		t.Fatalf("Unexpected error with Commit: %v", err)
+	}
+}
+
+func TestReshardAbort(t *testing.T) {
+	im := &importer{keys: make(map[string]db.Change)}
+	r, _, next := newTestResharder(t, im)
+	if err := r.Begin(next); err != nil {
+		t.Fatalf("Unexpected error with Begin: %v", err)
+	}
+
+	waited := make(chan bool)
+	go func() {
+		waited <- r.AwaitCommit(10 * time.Second)
+	}()
+	r.Abort()
+	if !<-waited {
+		t.Errorf("Expected AwaitCommit to return once the reshard is aborted")
+	}
+	if r.AwaitCommit(0) != true || r.Resharding() {
+		t.Errorf("Expected no reshard to be under way after Abort")
+	}
+	if err := r.Commit(); err == nil {
+		t.Errorf("Expected Commit to fail after Abort")
+	}
+	if got := r.membership.Config().TotalShards; got != 1 {
+		t.Errorf("Unexpected layout after Abort. Got: %d shards Expected: 1", got)
+	}
+}
@@ -5,40 +5,113 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Shards         []Shard
-	ShardToAddress map[int]string
-	ShardIndex     int
-	TotalShards    int
+	Shards          []Shard
+	ShardToAddress  map[int]string
+	ShardToReplicas map[int][]string
+	ShardName       string
+	ShardIndex      int
+	TotalShards     int
+	Partitioning    Partitioning
+	partitioner     Partitioner
 }
 
 type Shard struct {
 	Shard ShardConfig `yaml:"Shard"`
 }
 
+// document is one of the yaml documents of config.yaml, which holds either
+// a shard or the partitioning of the cluster.
+type document struct {
+	Shard        ShardConfig   `yaml:"Shard"`
+	Partitioning *Partitioning `yaml:"Partitioning"`
+}
+
 type ShardConfig struct {
-	Name     string   `yaml:"Name"`
-	Index    int      `yaml:"Index"`
-	Address  string   `yaml:"Address"`
-	Replicas []string `yaml:"Replicas"`
+	Name            string        `yaml:"Name"`
+	Index           int           `yaml:"Index"`
+	Address         string        `yaml:"Address"`
+	Replicas        []string      `yaml:"Replicas,omitempty"`
+	WriteConcern    WriteConcern  `yaml:"WriteConcern,omitempty"`
+	WriteTimeout    time.Duration `yaml:"WriteTimeout,omitempty"`
+	FailoverTimeout time.Duration `yaml:"FailoverTimeout,omitempty"`
+	RepairInterval  time.Duration `yaml:"RepairInterval,omitempty"`
+	// Replication is either primary, the default, or raft. In raft mode
+	// RaftAddresses maps the http address of the master and of every replica
+	// to the address its raft transport listens on.
+	Replication   ReplicationMode   `yaml:"Replication,omitempty"`
+	RaftAddresses map[string]string `yaml:"RaftAddresses,omitempty"`
+	// Weight scales the share of the ring the shard owns, 1 by default.
+	Weight int `yaml:"Weight,omitempty"`
+	// Range is the keys the shard owns when partitioning by range. A shard
+	// without one owns no keys until a range is split into it.
+	Range *KeyRange `yaml:"Range,omitempty"`
+}
+
+// ReplicationMode is how a shard keeps its replicas in sync.
+type ReplicationMode string
+
+const (
+	ReplicationPrimary ReplicationMode = "primary"
+	ReplicationRaft    ReplicationMode = "raft"
+)
+
+// Members returns the http address of the master followed by the replicas.
+func (s ShardConfig) Members() []string {
+	return append([]string{s.Address}, s.Replicas...)
+}
+
+// UsesRaft reports whether the shard is replicated through raft.
+func (s ShardConfig) UsesRaft() bool {
+	return s.Replication == ReplicationRaft
+}
+
+// WriteConcern is how many replicas must have a write before the master
+// acknowledges it to the client.
+type WriteConcern string
+
+const (
+	WriteConcernAsync    WriteConcern = "async"
+	WriteConcernOne      WriteConcern = "one"
+	WriteConcernMajority WriteConcern = "majority"
+	WriteConcernAll      WriteConcern = "all"
+)
+
+const (
+	DefaultWriteTimeout    = time.Second
+	DefaultFailoverTimeout = 5 * time.Second
+	DefaultRepairInterval  = time.Minute
+)
+
+func (wc WriteConcern) Valid() bool {
+	switch wc {
+	case WriteConcernAsync, WriteConcernOne, WriteConcernMajority, WriteConcernAll:
+		return true
+	}
+	return false
 }
 
 func (c *Config) unmarshalAllShards(yamlFile []byte) error {
 	r := bytes.NewReader(yamlFile)
 	decoder := yaml.NewDecoder(r)
 	for {
-		var shard Shard
-		if err := decoder.Decode(&shard); err != nil {
+		var doc document
+		if err := decoder.Decode(&doc); err != nil {
 			if err != io.EOF {
 				return err
 			}
 			break
 		}
-		c.Shards = append(c.Shards, shard)
+		if doc.Partitioning != nil {
+			c.Partitioning = *doc.Partitioning
+			continue
+		}
+		c.Shards = append(c.Shards, Shard{Shard: doc.Shard})
 	}
 	return nil
 }
@@ -53,6 +126,32 @@ func (c *Config) validateNumShards() bool {
 	return maxIndex+1 == len(c.Shards)
 }
 
+func (c *Config) validateWriteConcerns() error {
+	for _, s := range c.Shards {
+		if s.Shard.WriteConcern != "" && !s.Shard.WriteConcern.Valid() {
+			return fmt.Errorf("shard %s has invalid WriteConcern %q", s.Shard.Name, s.Shard.WriteConcern)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateReplication() error {
+	for _, s := range c.Shards {
+		switch s.Shard.Replication {
+		case "", ReplicationPrimary:
+		case ReplicationRaft:
+			for _, member := range s.Shard.Members() {
+				if s.Shard.RaftAddresses[member] == "" {
+					return fmt.Errorf("shard %s has no raft address for %s", s.Shard.Name, member)
+				}
+			}
+		default:
+			return fmt.Errorf("shard %s has invalid Replication %q", s.Shard.Name, s.Shard.Replication)
+		}
+	}
+	return nil
+}
+
 func (c *Config) createShardToAddressMap() {
 	shardToAddress := make(map[int]string)
 	for _, s := range c.Shards {
@@ -61,15 +160,62 @@ func (c *Config) createShardToAddressMap() {
 	c.ShardToAddress = shardToAddress
 }
 
-func NewConfig(fileName string, shardName string) (*Config, error) {
-	config := &Config{
-		Shards: []Shard{},
+func (c *Config) createShardToReplicasMap() {
+	shardToReplicas := make(map[int][]string)
+	for _, s := range c.Shards {
+		shardToReplicas[s.Shard.Index] = s.Shard.Replicas
+	}
+	c.ShardToReplicas = shardToReplicas
+}
+
+func (c *Config) GetShard(index int) (ShardConfig, bool) {
+	for _, s := range c.Shards {
+		if s.Shard.Index == index {
+			return s.Shard, true
+		}
 	}
+	return ShardConfig{}, false
+}
+
+// ShardForKey returns the index of the shard a key belongs to.
+func (c *Config) ShardForKey(key string) int {
+	return c.partitioner.ShardForKey(key)
+}
 
+// Marshal returns the layout in the format of config.yaml.
+func (c *Config) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	for _, s := range c.Shards {
+		if err := encoder.Encode(s); err != nil {
+			return nil, err
+		}
+	}
+	if c.Partitioning != (Partitioning{}) {
+		if err := encoder.Encode(map[string]Partitioning{"Partitioning": c.Partitioning}); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func NewConfig(fileName string, shardName string) (*Config, error) {
 	yamlFile, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return nil, fmt.Errorf("Could not find Config YAML: %s", fileName)
 	}
+	return ParseConfig(yamlFile, shardName)
+}
+
+// ParseConfig builds the config from the contents of a config file, such as
+// the new layout handed to a node when the cluster is resharded.
+func ParseConfig(yamlFile []byte, shardName string) (*Config, error) {
+	config := &Config{
+		Shards: []Shard{},
+	}
 
 	if err := config.unmarshalAllShards(yamlFile); err != nil {
 		return nil, fmt.Errorf("could not parse yaml file: %w", err)
@@ -79,7 +225,20 @@ func NewConfig(fileName string, shardName string) (*Config, error) {
 		return nil, fmt.Errorf("shard index greater than number of shards")
 	}
 
+	if err := config.validateWriteConcerns(); err != nil {
+		return nil, err
+	}
+
+	if err := config.validateReplication(); err != nil {
+		return nil, err
+	}
+
+	if err := config.validatePartitioning(); err != nil {
+		return nil, err
+	}
+
 	config.TotalShards = len(config.Shards)
+	config.ShardName = shardName
 	config.ShardIndex = -1
 	for _, s := range config.Shards {
 		if s.Shard.Name == shardName {
@@ -87,6 +246,8 @@ func NewConfig(fileName string, shardName string) (*Config, error) {
 		}
 	}
 	config.createShardToAddressMap()
+	config.createShardToReplicasMap()
+	config.createPartitioner()
 
 	return config, nil
 }
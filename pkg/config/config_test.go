@@ -5,6 +5,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 var validYAML = `Shard: 
@@ -53,6 +54,11 @@ var correctConfig = Config{
 		1: "localhost:8081",
 		2: "localhost:8082",
 	},
+	ShardToReplicas: map[int][]string{
+		0: {"localhost:8083"},
+		1: nil,
+		2: nil,
+	},
 	TotalShards: 3,
 }
 
@@ -162,6 +168,16 @@ func TestCreateShardToAddressMap(t *testing.T) {
 	}
 }
 
+func TestCreateShardToReplicasMap(t *testing.T) {
+	config := Config{Shards: correctConfig.Shards}
+	config.createShardToReplicasMap()
+
+	eq := reflect.DeepEqual(config.ShardToReplicas, correctConfig.ShardToReplicas)
+	if !eq {
+		t.Errorf("Error with shard to replicas mapping. Expected: %v Got: %v", correctConfig.ShardToReplicas, config.ShardToReplicas)
+	}
+}
+
 func TestNewConfig(t *testing.T) {
 	f, err := ioutil.TempFile("", "temp")
 	if err != nil {
@@ -189,6 +205,11 @@ func TestNewConfig(t *testing.T) {
 		t.Errorf("Incorrect ShardToAddress result. Expected: %v Got: %v \n", correctConfig.ShardToAddress, c.ShardToAddress)
 	}
 
+	eq = reflect.DeepEqual(c.ShardToReplicas, correctConfig.ShardToReplicas)
+	if !eq {
+		t.Errorf("Incorrect ShardToReplicas result. Expected: %v Got: %v \n", correctConfig.ShardToReplicas, c.ShardToReplicas)
+	}
+
 	if c.TotalShards != correctConfig.TotalShards {
 		t.Errorf("Incorrect TotalShards result. Expected: %v Got: %v \n", correctConfig.TotalShards, c.TotalShards)
 	}
@@ -270,3 +291,116 @@ func TestNewConfigWithBadNumShards(t *testing.T) {
 		t.Error("Unexpected error with deleting the file: %w", err)
 	}
 }
+
+func TestNewConfigWithWriteConcern(t *testing.T) {
+	yamlContents := []byte(`Shard: 
+  Name: shard0
+  Index: 0
+  Address: localhost:8080
+  Replicas: [localhost:8083, localhost:8084]
+  WriteConcern: majority
+  WriteTimeout: 500ms`)
+
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(yamlContents)
+	if err != nil {
+		t.Error("Unexpected error with writing to the file: %w", err)
+	}
+
+	c, err := NewConfig(f.Name(), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with NewConfig(): %v", err)
+	}
+	shard, ok := c.GetShard(0)
+	if !ok {
+		t.Fatalf("Expected to find shard 0")
+	}
+	if shard.WriteConcern != WriteConcernMajority {
+		t.Errorf("Incorrect WriteConcern. Expected: %q Got: %q", WriteConcernMajority, shard.WriteConcern)
+	}
+	if shard.WriteTimeout != 500*time.Millisecond {
+		t.Errorf("Incorrect WriteTimeout. Expected: %v Got: %v", 500*time.Millisecond, shard.WriteTimeout)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestValidateWriteConcerns(t *testing.T) {
+	config := Config{
+		Shards: []Shard{
+			{
+				Shard: ShardConfig{
+					Name:         "shard0",
+					Index:        0,
+					WriteConcern: "most",
+				},
+			},
+		},
+	}
+	if err := config.validateWriteConcerns(); err == nil {
+		t.Errorf("Expected error for an invalid write concern")
+	}
+}
+
+func TestValidateReplication(t *testing.T) {
+	config := Config{
+		Shards: []Shard{
+			{
+				Shard: ShardConfig{
+					Name:        "shard0",
+					Index:       0,
+					Address:     "localhost:8080",
+					Replicas:    []string{"localhost:8083"},
+					Replication: ReplicationRaft,
+					RaftAddresses: map[string]string{
+						"localhost:8080": "localhost:9080",
+					},
+				},
+			},
+		},
+	}
+	if err := config.validateReplication(); err == nil {
+		t.Errorf("Expected error for a replica without a raft address")
+	}
+
+	config.Shards[0].Shard.RaftAddresses["localhost:8083"] = "localhost:9083"
+	if err := config.validateReplication(); err != nil {
+		t.Errorf("Unexpected error with validateReplication(): %v", err)
+	}
+
+	config.Shards[0].Shard.Replication = "paxos"
+	if err := config.validateReplication(); err == nil {
+		t.Errorf("Expected error for an invalid replication mode")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(validYAML), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+	if c.ShardName != "shard0" {
+		t.Errorf("Incorrect ShardName. Expected: %q Got: %q", "shard0", c.ShardName)
+	}
+	if c.TotalShards != correctConfig.TotalShards {
+		t.Errorf("Incorrect TotalShards result. Expected: %v Got: %v \n", correctConfig.TotalShards, c.TotalShards)
+	}
+
+	for _, key := range []string{"key1", "key2", "key-17007"} {
+		shard := c.ShardForKey(key)
+		if shard < 0 || shard >= c.TotalShards {
+			t.Errorf("Key %q mapped to shard %d outside of %d shards", key, shard, c.TotalShards)
+		}
+		if shard != c.ShardForKey(key) {
+			t.Errorf("Key %q mapped to different shards", key)
+		}
+	}
+}
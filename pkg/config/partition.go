@@ -0,0 +1,323 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// PartitionMode is how keys are spread over the shards.
+type PartitionMode string
+
+const (
+	// PartitionModulo is the original fnv(key) % TotalShards and the default.
+	// It remaps almost every key when the number of shards changes.
+	PartitionModulo PartitionMode = "modulo"
+	// PartitionRing places every shard on a consistent hash ring, so adding
+	// or removing a shard only moves the keys of its part of the ring.
+	PartitionRing PartitionMode = "ring"
+	// PartitionRange gives every shard a contiguous range of keys, so that
+	// keys are kept in order across the cluster.
+	PartitionRange PartitionMode = "range"
+)
+
+const DefaultVirtualNodes = 128
+
+// Partitioning is the optional document of config.yaml that chooses the
+// partitioner, e.g.
+//
+//	Partitioning:
+//	  Mode: ring
+//	  VirtualNodes: 128
+type Partitioning struct {
+	Mode PartitionMode `yaml:"Mode,omitempty"`
+	// VirtualNodes is how many points a shard of weight 1 has on the ring.
+	VirtualNodes int `yaml:"VirtualNodes,omitempty"`
+}
+
+// KeyRange is the keys from Start up to, but not including, End. An empty
+// End is the end of the key space.
+type KeyRange struct {
+	Start string `yaml:"Start,omitempty"`
+	End   string `yaml:"End,omitempty"`
+}
+
+func (r KeyRange) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+// Partitioner maps a key to the index of the shard that owns it.
+type Partitioner interface {
+	ShardForKey(key string) int
+}
+
+func (c *Config) validatePartitioning() error {
+	switch c.Partitioning.Mode {
+	case "", PartitionRing, PartitionModulo:
+		for _, s := range c.Shards {
+			if s.Shard.Range != nil {
+				return fmt.Errorf("shard %s has a Range but the partitioning Mode is not %s", s.Shard.Name, PartitionRange)
+			}
+		}
+	case PartitionRange:
+		if err := c.validateRanges(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid partitioning Mode %q", c.Partitioning.Mode)
+	}
+	if c.Partitioning.VirtualNodes < 0 {
+		return fmt.Errorf("invalid partitioning VirtualNodes %d", c.Partitioning.VirtualNodes)
+	}
+	for _, s := range c.Shards {
+		if s.Shard.Weight < 0 {
+			return fmt.Errorf("shard %s has invalid Weight %d", s.Shard.Name, s.Shard.Weight)
+		}
+	}
+	return nil
+}
+
+func (c *Config) createPartitioner() {
+	switch c.Partitioning.Mode {
+	case PartitionRing:
+		virtualNodes := c.Partitioning.VirtualNodes
+		if virtualNodes == 0 {
+			virtualNodes = DefaultVirtualNodes
+		}
+		c.partitioner = newRingPartitioner(c.Shards, virtualNodes)
+	case PartitionRange:
+		c.partitioner = newRangePartitioner(c.Shards)
+	default:
+		c.partitioner = moduloPartitioner(c.TotalShards)
+	}
+}
+
+type moduloPartitioner int
+
+func (p moduloPartitioner) ShardForKey(key string) int {
+	h := fnv.New64()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(p))
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// ringPartitioner owns a key by the first point at or after the hash of the
+// key, going around the ring.
+type ringPartitioner struct {
+	points []ringPoint
+}
+
+func newRingPartitioner(shards []Shard, virtualNodes int) *ringPartitioner {
+	p := &ringPartitioner{}
+	for _, s := range shards {
+		weight := s.Shard.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		// points are placed by the name of the shard rather than its index,
+		// so that renumbering the shards does not move them
+		for i := 0; i < virtualNodes*weight; i++ {
+			p.points = append(p.points, ringPoint{
+				hash:  ringHash(s.Shard.Name + "#" + strconv.Itoa(i)),
+				shard: s.Shard.Index,
+			})
+		}
+	}
+	sort.Slice(p.points, func(i, j int) bool {
+		if p.points[i].hash != p.points[j].hash {
+			return p.points[i].hash < p.points[j].hash
+		}
+		return p.points[i].shard < p.points[j].shard
+	})
+	return p
+}
+
+func (p *ringPartitioner) ShardForKey(key string) int {
+	if len(p.points) == 0 {
+		return 0
+	}
+	h := ringHash(key)
+	i := sort.Search(len(p.points), func(i int) bool {
+		return p.points[i].hash >= h
+	})
+	if i == len(p.points) {
+		i = 0
+	}
+	return p.points[i].shard
+}
+
+// ringHash is fnv-1a followed by the murmur3 finalizer, since fnv alone
+// spreads short keys that only differ in their last bytes poorly.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// sortedRanges returns the shards that own a range, by the start of it.
+func sortedRanges(shards []Shard) []ShardConfig {
+	var owners []ShardConfig
+	for _, s := range shards {
+		if s.Shard.Range != nil {
+			owners = append(owners, s.Shard)
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return owners[i].Range.Start < owners[j].Range.Start
+	})
+	return owners
+}
+
+// validateRanges checks that the ranges of the shards cover every key
+// exactly once.
+func (c *Config) validateRanges() error {
+	owners := sortedRanges(c.Shards)
+	if len(owners) == 0 {
+		return fmt.Errorf("no shard has a Range")
+	}
+	if owners[0].Range.Start != "" {
+		return fmt.Errorf("no shard has the keys before %q", owners[0].Range.Start)
+	}
+	for i, s := range owners {
+		if s.Range.End != "" && s.Range.End <= s.Range.Start {
+			return fmt.Errorf("shard %s has an empty Range", s.Name)
+		}
+		if i == len(owners)-1 {
+			if s.Range.End != "" {
+				return fmt.Errorf("no shard has the keys from %q", s.Range.End)
+			}
+		} else if next := owners[i+1]; s.Range.End != next.Range.Start {
+			return fmt.Errorf("range of shard %s ends at %q but the range of shard %s starts at %q", s.Name, s.Range.End, next.Name, next.Range.Start)
+		}
+	}
+	return nil
+}
+
+type rangeEntry struct {
+	start string
+	shard int
+}
+
+// rangePartitioner owns a key by the range with the last start at or before
+// the key.
+type rangePartitioner struct {
+	ranges []rangeEntry
+}
+
+func newRangePartitioner(shards []Shard) *rangePartitioner {
+	p := &rangePartitioner{}
+	for _, s := range sortedRanges(shards) {
+		p.ranges = append(p.ranges, rangeEntry{start: s.Range.Start, shard: s.Index})
+	}
+	return p
+}
+
+func (p *rangePartitioner) ShardForKey(key string) int {
+	i := sort.Search(len(p.ranges), func(i int) bool {
+		return p.ranges[i].start > key
+	})
+	if i == 0 {
+		return 0
+	}
+	return p.ranges[i-1].shard
+}
+
+// cloneShards copies the shards of the layout, so that their ranges can be
+// changed without touching c.
+func (c *Config) cloneShards() []Shard {
+	shards := make([]Shard, len(c.Shards))
+	for i, s := range c.Shards {
+		shards[i] = s
+		if s.Shard.Range != nil {
+			r := *s.Shard.Range
+			shards[i].Shard.Range = &r
+		}
+	}
+	return shards
+}
+
+func (c *Config) shardConfig(index int) (*ShardConfig, error) {
+	for i := range c.Shards {
+		if c.Shards[i].Shard.Index == index {
+			return &c.Shards[i].Shard, nil
+		}
+	}
+	return nil, fmt.Errorf("no shard with index %d", index)
+}
+
+// rangeShards returns shards a and b of a copy of the layout, which has to be
+// partitioned by range.
+func (c *Config) rangeShards(a, b int) (*Config, *ShardConfig, *ShardConfig, error) {
+	if c.Partitioning.Mode != PartitionRange {
+		return nil, nil, nil, fmt.Errorf("the cluster is not partitioned by range")
+	}
+	if a == b {
+		return nil, nil, nil, fmt.Errorf("shard %d cannot be split or merged with itself", a)
+	}
+	next := &Config{Shards: c.cloneShards(), Partitioning: c.Partitioning}
+	sa, err := next.shardConfig(a)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sb, err := next.shardConfig(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return next, sa, sb, nil
+}
+
+// Split returns the layout, in the format of config.yaml, where the keys of
+// shard from that are at or after key at move to shard into, which must not
+// own any keys yet.
+func (c *Config) Split(from int, at string, into int) ([]byte, error) {
+	next, src, dst, err := c.rangeShards(from, into)
+	if err != nil {
+		return nil, err
+	}
+	if src.Range == nil {
+		return nil, fmt.Errorf("shard %s owns no keys", src.Name)
+	}
+	if dst.Range != nil {
+		return nil, fmt.Errorf("shard %s already owns keys", dst.Name)
+	}
+	if at == src.Range.Start || !src.Range.Contains(at) {
+		return nil, fmt.Errorf("%q does not split the range of shard %s", at, src.Name)
+	}
+	dst.Range = &KeyRange{Start: at, End: src.Range.End}
+	src.Range.End = at
+	return next.Marshal()
+}
+
+// Merge returns the layout, in the format of config.yaml, where shard into
+// takes over the adjacent range of shard from. Shard from is left without
+// keys, ready to be split into again.
+func (c *Config) Merge(into int, from int) ([]byte, error) {
+	next, dst, src, err := c.rangeShards(into, from)
+	if err != nil {
+		return nil, err
+	}
+	if dst.Range == nil || src.Range == nil {
+		return nil, fmt.Errorf("shards %s and %s do not both own keys", dst.Name, src.Name)
+	}
+	switch {
+	case dst.Range.End != "" && dst.Range.End == src.Range.Start:
+		dst.Range.End = src.Range.End
+	case src.Range.End != "" && src.Range.End == dst.Range.Start:
+		dst.Range.Start = src.Range.Start
+	default:
+		return nil, fmt.Errorf("ranges of shards %s and %s are not adjacent", dst.Name, src.Name)
+	}
+	src.Range = nil
+	return next.Marshal()
+}
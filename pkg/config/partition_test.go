@@ -0,0 +1,276 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func shardsYAML(n int, extra string) string {
+	var docs []string
+	for i := 0; i < n; i++ {
+		docs = append(docs, fmt.Sprintf("Shard:\n  Name: shard%d\n  Index: %d\n  Address: localhost:%d", i, i, 8080+i))
+	}
+	if extra != "" {
+		docs = append(docs, extra)
+	}
+	return strings.Join(docs, "\n---\n")
+}
+
+func countKeys(t *testing.T, c *Config, keys int) map[int]int {
+	counts := make(map[int]int)
+	for i := 0; i < keys; i++ {
+		shard := c.ShardForKey(fmt.Sprintf("key-%d", i))
+		if shard < 0 || shard >= c.TotalShards {
+			t.Fatalf("Key mapped to shard %d outside of %d shards", shard, c.TotalShards)
+		}
+		counts[shard]++
+	}
+	return counts
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	c, err := ParseConfig([]byte(shardsYAML(4, "Partitioning:\n  Mode: ring")), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+
+	counts := countKeys(t, c, 10000)
+	for shard := 0; shard < 4; shard++ {
+		if counts[shard] < 1750 || counts[shard] > 3250 {
+			t.Errorf("Shard %d owns %d of 10000 keys, expected about 2500", shard, counts[shard])
+		}
+	}
+}
+
+func TestRingAddShardMovesFairShare(t *testing.T) {
+	before, err := ParseConfig([]byte(shardsYAML(4, "Partitioning:\n  Mode: ring")), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+	after, err := ParseConfig([]byte(shardsYAML(5, "Partitioning:\n  Mode: ring")), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		from, to := before.ShardForKey(key), after.ShardForKey(key)
+		if from == to {
+			continue
+		}
+		if to != 4 {
+			t.Fatalf("Key %q moved from shard %d to %d instead of the new shard", key, from, to)
+		}
+		moved++
+	}
+	if moved < 1400 || moved > 2600 {
+		t.Errorf("Adding a fifth shard moved %d of 10000 keys, expected about 2000", moved)
+	}
+}
+
+func TestRingWeight(t *testing.T) {
+	yaml := shardsYAML(1, "Shard:\n  Name: shard1\n  Index: 1\n  Address: localhost:8081\n  Weight: 3\n---\nPartitioning:\n  Mode: ring")
+	c, err := ParseConfig([]byte(yaml), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+
+	counts := countKeys(t, c, 10000)
+	if counts[1] < 6500 || counts[1] > 8500 {
+		t.Errorf("Shard of weight 3 owns %d of 10000 keys, expected about 7500", counts[1])
+	}
+}
+
+func TestPartitioningDocument(t *testing.T) {
+	c, err := ParseConfig([]byte(shardsYAML(3, "")), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+	if _, ok := c.partitioner.(moduloPartitioner); !ok {
+		t.Errorf("Expected the modulo partitioner by default, got %T", c.partitioner)
+	}
+
+	c, err = ParseConfig([]byte(shardsYAML(3, "Partitioning:\n  Mode: modulo")), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+	if c.TotalShards != 3 {
+		t.Errorf("Partitioning document counted as a shard. Got %d shards", c.TotalShards)
+	}
+	if c.Partitioning.Mode != PartitionModulo {
+		t.Errorf("Incorrect partitioning Mode. Expected: %q Got: %q", PartitionModulo, c.Partitioning.Mode)
+	}
+	if _, ok := c.partitioner.(moduloPartitioner); !ok {
+		t.Errorf("Expected the modulo partitioner, got %T", c.partitioner)
+	}
+
+	c, err = ParseConfig([]byte(shardsYAML(3, "Partitioning:\n  Mode: ring\n  VirtualNodes: 16")), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+	if points := len(c.partitioner.(*ringPartitioner).points); points != 48 {
+		t.Errorf("Incorrect number of ring points. Expected: 48 Got: %d", points)
+	}
+}
+
+func TestValidatePartitioning(t *testing.T) {
+	for _, extra := range []string{
+		"Partitioning:\n  Mode: bogus",
+		"Partitioning:\n  VirtualNodes: -1",
+		"Shard:\n  Name: shard1\n  Index: 1\n  Weight: -2",
+	} {
+		if _, err := ParseConfig([]byte(shardsYAML(1, extra)), "shard0"); err == nil {
+			t.Errorf("Expected error for invalid partitioning %q", extra)
+		}
+	}
+}
+
+var rangeYAML = `Shard:
+  Name: shard0
+  Index: 0
+  Address: localhost:8080
+  Range: {End: g}
+---
+Shard:
+  Name: shard1
+  Index: 1
+  Address: localhost:8081
+  Range: {Start: g, End: p}
+---
+Shard:
+  Name: shard2
+  Index: 2
+  Address: localhost:8082
+  Range: {Start: p}
+---
+Shard:
+  Name: shard3
+  Index: 3
+  Address: localhost:8083
+---
+Partitioning:
+  Mode: range`
+
+func TestRangePartitioner(t *testing.T) {
+	c, err := ParseConfig([]byte(rangeYAML), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+
+	for key, shard := range map[string]int{
+		"":      0,
+		"apple": 0,
+		"g":     1,
+		"gamma": 1,
+		"oz":    1,
+		"p":     2,
+		"zebra": 2,
+	} {
+		if got := c.ShardForKey(key); got != shard {
+			t.Errorf("Key %q mapped to shard %d, expected %d", key, got, shard)
+		}
+	}
+}
+
+func TestValidateRanges(t *testing.T) {
+	for _, ranges := range [][2]string{
+		{"Range: {End: g}", "Range: {Start: h}"},
+		{"Range: {Start: a, End: g}", "Range: {Start: g}"},
+		{"Range: {End: g}", "Range: {Start: g, End: p}"},
+		{"Range: {End: g}", "Range: {Start: g, End: a}"},
+		{"", ""},
+	} {
+		yaml := fmt.Sprintf("Shard:\n  Name: shard0\n  Index: 0\n  %s\n---\nShard:\n  Name: shard1\n  Index: 1\n  %s\n---\nPartitioning:\n  Mode: range", ranges[0], ranges[1])
+		if _, err := ParseConfig([]byte(yaml), "shard0"); err == nil {
+			t.Errorf("Expected error for ranges %v", ranges)
+		}
+	}
+
+	if _, err := ParseConfig([]byte(shardsYAML(1, "")+"\n  Range: {End: g}"), "shard0"); err == nil {
+		t.Errorf("Expected error for a Range without range partitioning")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	c, err := ParseConfig([]byte(rangeYAML), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+	raw, err := c.Marshal()
+	if err != nil {
+		t.Fatalf("Unexpected error with Marshal(): %v", err)
+	}
+	parsed, err := ParseConfig(raw, "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing marshalled layout: %v", err)
+	}
+	if !reflect.DeepEqual(parsed.Shards, c.Shards) || parsed.Partitioning != c.Partitioning {
+		t.Errorf("Marshalled layout changed. Expected: %v Got: %v", c.Shards, parsed.Shards)
+	}
+}
+
+func TestSplitAndMerge(t *testing.T) {
+	c, err := ParseConfig([]byte(rangeYAML), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig(): %v", err)
+	}
+
+	raw, err := c.Split(1, "k", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error with Split(): %v", err)
+	}
+	split, err := ParseConfig(raw, "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing split layout: %v", err)
+	}
+	for key, shard := range map[string]int{"gamma": 1, "k": 3, "kiwi": 3, "p": 2} {
+		if got := split.ShardForKey(key); got != shard {
+			t.Errorf("After split key %q mapped to shard %d, expected %d", key, got, shard)
+		}
+	}
+	if c.ShardForKey("kiwi") != 1 {
+		t.Errorf("Split changed the original layout")
+	}
+
+	raw, err = split.Merge(2, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error with Merge(): %v", err)
+	}
+	merged, err := ParseConfig(raw, "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing merged layout: %v", err)
+	}
+	for key, shard := range map[string]int{"gamma": 1, "kiwi": 2, "zebra": 2} {
+		if got := merged.ShardForKey(key); got != shard {
+			t.Errorf("After merge key %q mapped to shard %d, expected %d", key, got, shard)
+		}
+	}
+	if s, _ := merged.GetShard(3); s.Range != nil {
+		t.Errorf("Merged shard still owns %v", s.Range)
+	}
+
+	for _, err := range []error{
+		errOf(c.Split(1, "g", 3)),
+		errOf(c.Split(1, "z", 3)),
+		errOf(c.Split(1, "k", 2)),
+		errOf(c.Split(3, "k", 1)),
+		errOf(c.Merge(0, 2)),
+		errOf(c.Merge(0, 3)),
+		errOf(c.Merge(0, 7)),
+	} {
+		if err == nil {
+			t.Errorf("Expected error for an invalid split or merge")
+		}
+	}
+	ring, _ := ParseConfig([]byte(shardsYAML(2, "Partitioning:\n  Mode: ring")), "shard0")
+	if _, err := ring.Split(0, "k", 1); err == nil {
+		t.Errorf("Expected error splitting a ring")
+	}
+}
+
+func errOf(_ []byte, err error) error {
+	return err
+}
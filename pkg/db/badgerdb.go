@@ -1,44 +1,219 @@
 package db
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 )
 
+// Keys used for our own bookkeeping live under a prefix that user keys may
+// not use, and are skipped when iterating or shipping changes.
+var internalKeyPrefix = []byte(ReservedPrefix + "store/")
+
+var badgerAppliedSequenceKey = append(append([]byte{}, internalKeyPrefix...), "applied-sequence"...)
+
+// How often a new version pin is taken while replicas are attached or
+// versions are retained, and how many pins are held at most.
+const (
+	pinInterval = time.Second
+	maxPins     = 64
+)
+
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, internalKeyPrefix)
+}
+
+// isReplicatedKey reports whether replicas get key from their master: every
+// user key, the prepared transactions and the remembered commits. Replicas
+// take the locks of a prepared transaction themselves.
+func isReplicatedKey(key []byte) bool {
+	_, _, decision := decisionID(key)
+	return !isInternalKey(key) || decision
+}
+
+// applyLocks takes or releases the locks of the transaction that change
+// prepares or forgets, before change itself is written.
+func applyLocks(txn *badger.Txn, change Change) error {
+	id, prepared, _ := decisionID([]byte(change.Key))
+	if !prepared {
+		return nil
+	}
+	raw := change.Value
+	if change.Deleted {
+		item, err := txn.Get([]byte(change.Key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if raw, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+	}
+	var t Txn
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+	}
+	for _, key := range t.keys() {
+		if !change.Deleted {
+			if err := txn.Set(lockKey(key), []byte(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		holder, err := lockHolder(txn, key)
+		if err != nil {
+			return err
+		}
+		if holder == id {
+			if err := txn.Delete(lockKey(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lockKey holds the id of the transaction that holds key, next to the
+// transaction itself under preparedKey.
+func lockKey(key string) []byte {
+	return append(append([]byte{}, internalKeyPrefix...), "lock/"+key...)
+}
+
+// lockHolder returns the id of the transaction that holds key, or "" if it
+// is not locked. Reading the lock makes a concurrent Prepare of the key
+// conflict with the transaction.
+func lockHolder(txn *badger.Txn, key string) (string, error) {
+	item, err := txn.Get(lockKey(key))
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	id, err := item.ValueCopy(nil)
+	return string(id), err
+}
+
+// badgerCheckUnlocked fails a write to a key that a prepared transaction holds.
+func badgerCheckUnlocked(txn *badger.Txn, key string) error {
+	holder, err := lockHolder(txn, key)
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return fmt.Errorf("key %q: %w", key, ErrLocked)
+	}
+	return nil
+}
+
+// update runs fn in a read-write transaction, again for as long as it
+// conflicts with a concurrent one.
+func (db *BadgerDatabase) update(fn func(txn *badger.Txn) error) error {
+	for {
+		err := db.db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+// newEntry returns the entry that writes change, expiring natively at the
+// same time on the master and its replicas.
+func newEntry(change Change) *badger.Entry {
+	e := badger.NewEntry([]byte(change.Key), change.Value)
+	e.ExpiresAt = change.ExpiresAt
+	return e
+}
+
 type BadgerDatabase struct {
-	db *badger.DB
+	db      *badger.DB
+	replica bool
+
+	mu           sync.Mutex
+	replicas     []string
+	cursors      map[string]uint64
+	pins         []versionPin
+	retention    time.Duration
+	historyFloor uint64
+	notifier     notifier
+	ackNotifier  notifier
+}
+
+func NewBadgerDatabase(dbPath string, replica bool) (db *BadgerDatabase, closeFunc func() error, err error) {
+	return openBadgerDatabase("badgerdb-"+dbPath, replica)
 }
 
-func NewBadgerDatabase(dbPath string) (db *BadgerDatabase, closeFunc func() error, err error) {
-	badgerdb, err := badger.Open(badger.DefaultOptions("badgerdb-" + dbPath))
+// openBadgerDatabase opens the badger db in dir as it is, without the prefix
+// NewBadgerDatabase adds to the name.
+func openBadgerDatabase(dir string, replica bool) (db *BadgerDatabase, closeFunc func() error, err error) {
+	badgerdb, err := badger.Open(badger.DefaultOptions(dir))
 	if err != nil {
 		return nil, nil, err
 	}
-	db = &BadgerDatabase{db: badgerdb}
-	closeFunc = badgerdb.Close
+	db = &BadgerDatabase{db: badgerdb, replica: replica, cursors: make(map[string]uint64)}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		db.collect(stop)
+	}()
+	closeFunc = func() error {
+		close(stop)
+		<-stopped
+		db.mu.Lock()
+		db.releasePins(len(db.pins))
+		db.mu.Unlock()
+		return badgerdb.Close()
+	}
 	return db, closeFunc, nil
 }
 
 func (db *BadgerDatabase) PutKey(key string, value []byte) error {
-	db.db.Update(func(txn *badger.Txn) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	if isInternalKey([]byte(key)) {
+		return fmt.Errorf("key %q: %w", key, ErrReservedKey)
+	}
+	err := db.update(func(txn *badger.Txn) error {
+		if err := badgerCheckUnlocked(txn, key); err != nil {
+			return err
+		}
 		return txn.Set([]byte(key), value)
 	})
+	if err != nil {
+		return err
+	}
+	db.notifier.notify()
 	return nil
 }
 
 func (db *BadgerDatabase) PutKeyReplica(key string, value []byte) error {
-	return fmt.Errorf("not implemented")
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), value)
+	})
 }
 
 func (db *BadgerDatabase) GetKey(key string) ([]byte, error) {
+	if isInternalKey([]byte(key)) {
+		return nil, fmt.Errorf("key %q: %w", key, ErrReservedKey)
+	}
 	var result []byte
 	err := db.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
 		if err != nil {
 			return err
 		}
-		result, err = item.ValueCopy(nil)
+		// a copy of an empty value is nil, which would read as a missing key
+		result, err = item.ValueCopy([]byte{})
 		return err
 	})
 
@@ -48,6 +223,435 @@ func (db *BadgerDatabase) GetKey(key string) ([]byte, error) {
 	return result, nil
 }
 
+func (db *BadgerDatabase) GetBatch(keys []string) ([][]byte, error) {
+	for _, key := range keys {
+		if isInternalKey([]byte(key)) {
+			return nil, fmt.Errorf("key %q: %w", key, ErrReservedKey)
+		}
+	}
+	values := make([][]byte, len(keys))
+	err := db.db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			item, err := txn.Get([]byte(key))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if values[i], err = item.ValueCopy([]byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// PutBatch commits every change at the same version, which replicas apply
+// as a whole since GetChanges never splits a commit timestamp.
+func (db *BadgerDatabase) PutBatch(changes []Change) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	for _, change := range changes {
+		if isInternalKey([]byte(change.Key)) {
+			return fmt.Errorf("key %q: %w", change.Key, ErrReservedKey)
+		}
+	}
+	err := db.update(func(txn *badger.Txn) error {
+		for _, change := range changes {
+			if err := badgerCheckUnlocked(txn, change.Key); err != nil {
+				return err
+			}
+			var err error
+			if change.Deleted {
+				err = txn.Delete([]byte(change.Key))
+			} else {
+				err = txn.SetEntry(newEntry(change))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.notifier.notify()
+	return nil
+}
+
+// PutIf reads the key in the transaction of the write, so a concurrent write
+// to the key fails the commit with a conflict, after which the condition is
+// checked again.
+func (db *BadgerDatabase) PutIf(change Change, cond Condition) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	if isInternalKey([]byte(change.Key)) {
+		return fmt.Errorf("key %q: %w", change.Key, ErrReservedKey)
+	}
+	for {
+		err := db.db.Update(func(txn *badger.Txn) error {
+			if err := badgerCheckUnlocked(txn, change.Key); err != nil {
+				return err
+			}
+			var current []byte
+			item, err := txn.Get([]byte(change.Key))
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err == nil {
+				if current, err = item.ValueCopy([]byte{}); err != nil {
+					return err
+				}
+			}
+			if err := cond.check(current); err != nil {
+				return err
+			}
+			if change.Deleted {
+				return txn.Delete([]byte(change.Key))
+			}
+			return txn.SetEntry(newEntry(change))
+		})
+		if err == badger.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		db.notifier.notify()
+		return nil
+	}
+}
+
+func (db *BadgerDatabase) Add(key string, delta int64, expiresAt uint64) (Change, int64, error) {
+	if db.isReplica() {
+		return Change{}, 0, ErrReadOnly
+	}
+	if isInternalKey([]byte(key)) {
+		return Change{}, 0, fmt.Errorf("key %q: %w", key, ErrReservedKey)
+	}
+	for {
+		change := Change{Key: key, ExpiresAt: expiresAt}
+		var n int64
+		err := db.db.Update(func(txn *badger.Txn) error {
+			if err := badgerCheckUnlocked(txn, key); err != nil {
+				return err
+			}
+			var current []byte
+			item, err := txn.Get([]byte(key))
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err == nil {
+				if current, err = item.ValueCopy([]byte{}); err != nil {
+					return err
+				}
+				change.ExpiresAt = item.ExpiresAt()
+			}
+			if change.Value, n, err = addCounter(current, delta); err != nil {
+				return err
+			}
+			return txn.SetEntry(newEntry(change))
+		})
+		if err == badger.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return Change{}, 0, err
+		}
+		db.notifier.notify()
+		return change, n, nil
+	}
+}
+
+// Transact reads the keys of the conditions in the transaction of the
+// writes, so a concurrent write to any of them fails the commit with a
+// conflict, after which the transaction runs again.
+func (db *BadgerDatabase) Transact(t Txn) ([][]byte, error) {
+	if db.isReplica() && len(t.Writes) > 0 {
+		return nil, ErrReadOnly
+	}
+	for _, change := range t.Writes {
+		if isInternalKey([]byte(change.Key)) {
+			return nil, fmt.Errorf("key %q: %w", change.Key, ErrReservedKey)
+		}
+	}
+	for {
+		values := make([][]byte, len(t.Reads))
+		err := db.db.Update(func(txn *badger.Txn) error {
+			get := func(key string) ([]byte, error) {
+				item, err := txn.Get([]byte(key))
+				if err == badger.ErrKeyNotFound {
+					return nil, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				return item.ValueCopy([]byte{})
+			}
+			if err := t.check(get); err != nil {
+				return err
+			}
+			for i, key := range t.Reads {
+				value, err := get(key)
+				if err != nil {
+					return err
+				}
+				values[i] = value
+			}
+			for _, change := range t.Writes {
+				if err := badgerCheckUnlocked(txn, change.Key); err != nil {
+					return err
+				}
+				var err error
+				if change.Deleted {
+					err = txn.Delete([]byte(change.Key))
+				} else {
+					err = txn.SetEntry(newEntry(change))
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == badger.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(t.Writes) > 0 {
+			db.notifier.notify()
+		}
+		return values, nil
+	}
+}
+
+func (db *BadgerDatabase) Prepare(id string, t Txn) ([][]byte, error) {
+	if db.isReplica() {
+		return nil, ErrReadOnly
+	}
+	for _, key := range t.keys() {
+		if isInternalKey([]byte(key)) {
+			return nil, fmt.Errorf("key %q: %w", key, ErrReservedKey)
+		}
+	}
+	var values [][]byte
+	err := db.update(func(txn *badger.Txn) error {
+		values = make([][]byte, len(t.Reads))
+		get := func(key string) ([]byte, error) {
+			item, err := txn.Get([]byte(key))
+			if err == badger.ErrKeyNotFound {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return item.ValueCopy([]byte{})
+		}
+		_, err := txn.Get(preparedKey(id))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err == badger.ErrKeyNotFound {
+			for _, key := range t.keys() {
+				holder, err := lockHolder(txn, key)
+				if err != nil {
+					return err
+				}
+				if holder != "" && holder != id {
+					return fmt.Errorf("key %q: %w", key, ErrLocked)
+				}
+			}
+			if err := t.check(get); err != nil {
+				return err
+			}
+			raw, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(preparedKey(id), raw); err != nil {
+				return err
+			}
+			for _, key := range t.keys() {
+				if err := txn.Set(lockKey(key), []byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		for i, key := range t.Reads {
+			value, err := get(key)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// decide releases the locks of the transaction prepared under id and
+// forgets it, applying its writes and remembering the commit first if commit
+// is set.
+func (db *BadgerDatabase) decide(id string, commit bool) error {
+	applied := false
+	err := db.update(func(txn *badger.Txn) error {
+		applied = false
+		item, err := txn.Get(preparedKey(id))
+		if err == badger.ErrKeyNotFound {
+			if !commit {
+				return nil
+			}
+			// an expired commit is not found either
+			_, err := txn.Get(committedKey(id))
+			if err == badger.ErrKeyNotFound {
+				return fmt.Errorf("transaction %s: %w", id, ErrNotPrepared)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		raw, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		var t Txn
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+		}
+		if commit {
+			for _, change := range t.Writes {
+				var err error
+				if change.Deleted {
+					err = txn.Delete([]byte(change.Key))
+				} else {
+					err = txn.SetEntry(newEntry(change))
+				}
+				if err != nil {
+					return err
+				}
+			}
+			applied = len(t.Writes) > 0
+			forgetAt := uint64(time.Now().Add(committedRetention).Unix())
+			if err := txn.SetEntry(newEntry(Change{Key: string(committedKey(id)), ExpiresAt: forgetAt})); err != nil {
+				return err
+			}
+		}
+		for _, key := range t.keys() {
+			holder, err := lockHolder(txn, key)
+			if err != nil {
+				return err
+			}
+			if holder == id {
+				if err := txn.Delete(lockKey(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return txn.Delete(preparedKey(id))
+	})
+	if err != nil {
+		return err
+	}
+	if applied {
+		db.notifier.notify()
+	}
+	return nil
+}
+
+func (db *BadgerDatabase) CommitPrepared(id string) error {
+	return db.decide(id, true)
+}
+
+func (db *BadgerDatabase) AbortPrepared(id string) error {
+	return db.decide(id, false)
+}
+
+func (db *BadgerDatabase) Prepared() (map[string]Txn, error) {
+	txns := make(map[string]Txn)
+	err := db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = preparedKey("")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			id := string(it.Item().Key()[len(opts.Prefix):])
+			raw, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			var t Txn
+			if err := json.Unmarshal(raw, &t); err != nil {
+				return fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+			}
+			txns[id] = t
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txns, nil
+}
+
+func (db *BadgerDatabase) GetExpiry(key string) (uint64, error) {
+	var expiresAt uint64
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		expiresAt = item.ExpiresAt()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expiresAt, nil
+}
+
+func (db *BadgerDatabase) DeleteKey(key string) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	if isInternalKey([]byte(key)) {
+		return fmt.Errorf("key %q: %w", key, ErrReservedKey)
+	}
+	err := db.update(func(txn *badger.Txn) error {
+		if err := badgerCheckUnlocked(txn, key); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	db.notifier.notify()
+	return nil
+}
+
+func (db *BadgerDatabase) DeleteKeyReplica(key string) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
 func (db *BadgerDatabase) getBulkKeys(getKey func(string) bool) ([]string, error) {
 	var keys []string
 	err := db.db.View(func(txn *badger.Txn) error {
@@ -57,6 +661,9 @@ func (db *BadgerDatabase) getBulkKeys(getKey func(string) bool) ([]string, error
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
+			if isInternalKey(item.Key()) {
+				continue
+			}
 			if getKey(string(item.Key())) {
 				keys = append(keys, string(item.Key()))
 			}
@@ -70,8 +677,16 @@ func (db *BadgerDatabase) getBulkKeys(getKey func(string) bool) ([]string, error
 }
 
 func (db *BadgerDatabase) deleteKeys(keys []string) error {
-	err := db.db.Update(func(txn *badger.Txn) error {
+	for _, key := range keys {
+		if isInternalKey([]byte(key)) {
+			return fmt.Errorf("key %q: %w", key, ErrReservedKey)
+		}
+	}
+	err := db.update(func(txn *badger.Txn) error {
 		for _, key := range keys {
+			if err := badgerCheckUnlocked(txn, key); err != nil {
+				return err
+			}
 			if err := txn.Delete([]byte(key)); err != nil {
 				return err
 			}
@@ -97,10 +712,736 @@ func (db *BadgerDatabase) DeleteBulkKeys(deleteKey func(string) bool) error {
 	return nil
 }
 
-func (db *BadgerDatabase) GetKeyForReplication() (keyCopy, valueCopy []byte, err error) {
-	return nil, nil, fmt.Errorf("not implemented")
+func (db *BadgerDatabase) isReplica() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.replica
+}
+
+func (db *BadgerDatabase) SetReplicaMode(replica bool) {
+	db.mu.Lock()
+	db.replica = replica
+	db.mu.Unlock()
 }
 
-func (db *BadgerDatabase) DeleteReplicationKey(key, value []byte) (err error) {
-	return fmt.Errorf("not implemented")
+func metaKey(key string) []byte {
+	return append(append([]byte{}, internalKeyPrefix...), "meta/"+key...)
+}
+
+func (db *BadgerDatabase) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(metaKey(key))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (db *BadgerDatabase) PutMeta(key string, value []byte) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(metaKey(key), value)
+	})
+}
+
+func (db *BadgerDatabase) DeleteMeta(key string) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(metaKey(key))
+	})
+}
+
+func (db *BadgerDatabase) ForEachMeta(prefix string, fn func(key string, value []byte) error) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = metaKey(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key()[len(metaKey("")):])
+			err := it.Item().Value(func(value []byte) error {
+				return fn(key, value)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BadgerDatabase) SetReplicas(replicas []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.replicas = append([]string(nil), replicas...)
+	db.updatePins()
+	return nil
+}
+
+// versionPin is a read transaction held open to keep the versions it sees
+// from being compacted, and when it was taken.
+type versionPin struct {
+	txn *badger.Txn
+	at  time.Time
+}
+
+// Badger already keeps a version per write, so the change log is read
+// straight out of the LSM tree instead of keeping a second copy of every
+// value. Compaction is allowed to discard a version once no read transaction
+// older than it is open, so we hold "pins": read transactions taken every
+// pinInterval that are only released once every replica has moved past them
+// and they are older than the retention.
+//
+// updatePins must be called with db.mu held.
+func (db *BadgerDatabase) updatePins() {
+	if len(db.replicas) == 0 && db.retention == 0 {
+		db.releasePins(len(db.pins))
+		return
+	}
+
+	minAcked := db.db.MaxVersion()
+	for _, r := range db.replicas {
+		if db.cursors[r] < minAcked {
+			minAcked = db.cursors[r]
+		}
+	}
+
+	// keep the newest pin at or below the slowest replica and taken before
+	// the retention
+	retained := time.Now().Add(-db.retention)
+	release := 0
+	for release+1 < len(db.pins) && db.pins[release+1].txn.ReadTs() <= minAcked && !db.pins[release+1].at.After(retained) {
+		release++
+	}
+	db.releasePins(release)
+
+	if len(db.pins) == 0 || time.Since(db.pins[len(db.pins)-1].at) > pinInterval {
+		pin := db.db.NewTransaction(false)
+		if len(db.pins) == 0 {
+			// versions older than the first pin may already be compacted
+			db.historyFloor = pin.ReadTs()
+		}
+		db.pins = append(db.pins, versionPin{txn: pin, at: time.Now()})
+	}
+
+	// a replica that stays away keeps the oldest pin, so thin out the ones
+	// after it rather than letting them pile up
+	if len(db.pins) > maxPins {
+		db.pins[1].txn.Discard()
+		db.pins = append(db.pins[:1], db.pins[2:]...)
+	}
+}
+
+func (db *BadgerDatabase) releasePins(n int) {
+	for _, pin := range db.pins[:n] {
+		pin.txn.Discard()
+	}
+	db.pins = db.pins[n:]
+}
+
+func (db *BadgerDatabase) SetVersionRetention(retention time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.retention = retention
+	db.updatePins()
+}
+
+// collect moves the pins along as they age past the retention, which lets
+// compaction drop the versions before them, and garbage collects the value
+// log those versions leave behind.
+func (db *BadgerDatabase) collect(stop <-chan struct{}) {
+	ticker := time.NewTicker(pinInterval)
+	defer ticker.Stop()
+	gcTicker := time.NewTicker(versionGCInterval)
+	defer gcTicker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			db.mu.Lock()
+			db.updatePins()
+			db.mu.Unlock()
+		case <-gcTicker.C:
+			// each run rewrites at most one file of the value log
+			for db.db.RunValueLogGC(0.5) == nil {
+			}
+		}
+	}
+}
+
+// isConfiguredReplica must be called with db.mu held.
+func (db *BadgerDatabase) isConfiguredReplica(replica string) bool {
+	for _, r := range db.replicas {
+		if r == replica {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *BadgerDatabase) ackChanges(replica string, acked uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.isConfiguredReplica(replica) {
+		return fmt.Errorf("unknown replica %q", replica)
+	}
+
+	if acked > db.cursors[replica] {
+		db.cursors[replica] = acked
+		db.ackNotifier.notify()
+	}
+	db.updatePins()
+	return nil
+}
+
+// GetChanges returns the versions written after from-1 in commit order. A
+// batch never ends in the middle of a commit timestamp so that replicas
+// always see whole transactions.
+func (db *BadgerDatabase) GetChanges(replica string, from uint64, limit int) ([]Change, error) {
+	if from == 0 {
+		from = 1
+	}
+
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	if from-1 > txn.ReadTs() {
+		return nil, fmt.Errorf("replica is at sequence %d but the master is only at %d: %w", from-1, txn.ReadTs(), ErrReplicaAhead)
+	}
+	if err := db.ackChanges(replica, from-1); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	truncated := from-1 < db.historyFloor
+	db.mu.Unlock()
+	if truncated {
+		return nil, ErrHistoryTruncated
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.SinceTs = from - 1
+	opts.PrefetchValues = false
+
+	// The iterator walks keys rather than versions, so every version since
+	// from is visited once while only the oldest versions that make up limit
+	// changes are kept. A version is kept or dropped whole, so a batch never
+	// ends in the middle of one.
+	batch := &changeHeap{versions: make(map[uint64]int)}
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !isReplicatedKey(item.Key()) {
+			continue
+		}
+		if limit > 0 && batch.Len() >= limit && item.Version() > batch.newest() {
+			continue
+		}
+		change, err := itemChange(item)
+		if err != nil {
+			return nil, err
+		}
+		heap.Push(batch, change)
+		if limit > 0 {
+			batch.dropNewest(limit)
+		}
+	}
+
+	changes := batch.changes
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Sequence < changes[j].Sequence
+	})
+	return changes, nil
+}
+
+// itemChange returns the change a version of a key made.
+func itemChange(item *badger.Item) (Change, error) {
+	change := Change{
+		Sequence: item.Version(),
+		Key:      string(item.KeyCopy(nil)),
+		Deleted:  item.IsDeletedOrExpired(),
+	}
+	if !change.Deleted {
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return Change{}, err
+		}
+		change.Value = value
+		change.ExpiresAt = item.ExpiresAt()
+	}
+	return change, nil
+}
+
+// changeHeap keeps the newest change on top, so that a full batch can drop
+// its newest version for an older one.
+type changeHeap struct {
+	changes []Change
+	// versions counts the changes of every version in the heap
+	versions map[uint64]int
+}
+
+func (h *changeHeap) Len() int           { return len(h.changes) }
+func (h *changeHeap) Less(i, j int) bool { return h.changes[i].Sequence > h.changes[j].Sequence }
+func (h *changeHeap) Swap(i, j int)      { h.changes[i], h.changes[j] = h.changes[j], h.changes[i] }
+
+func (h *changeHeap) Push(x interface{}) {
+	change := x.(Change)
+	h.changes = append(h.changes, change)
+	h.versions[change.Sequence]++
+}
+
+func (h *changeHeap) Pop() interface{} {
+	change := h.changes[len(h.changes)-1]
+	h.changes = h.changes[:len(h.changes)-1]
+	if h.versions[change.Sequence]--; h.versions[change.Sequence] == 0 {
+		delete(h.versions, change.Sequence)
+	}
+	return change
+}
+
+// newest returns the version on top of the heap.
+func (h *changeHeap) newest() uint64 {
+	return h.changes[0].Sequence
+}
+
+// dropNewest drops the changes of the newest version for as long as limit
+// changes are left without them.
+func (h *changeHeap) dropNewest(limit int) {
+	for h.Len() > limit {
+		n := h.versions[h.newest()]
+		if h.Len()-n < limit {
+			return
+		}
+		for i := 0; i < n; i++ {
+			heap.Pop(h)
+		}
+	}
+}
+
+func (db *BadgerDatabase) WaitForChanges() <-chan struct{} {
+	return db.notifier.wait()
+}
+
+func (db *BadgerDatabase) WaitForAcks() <-chan struct{} {
+	return db.ackNotifier.wait()
+}
+
+func (db *BadgerDatabase) LastSequence() (uint64, error) {
+	return db.db.MaxVersion(), nil
+}
+
+func (db *BadgerDatabase) AckedSequences() (map[string]uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	acked := make(map[string]uint64)
+	for _, r := range db.replicas {
+		acked[r] = db.cursors[r]
+	}
+	return acked, nil
+}
+
+func (db *BadgerDatabase) ApplyChanges(changes []Change) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		from, err := getBadgerSequence(txn, badgerAppliedSequenceKey)
+		if err != nil {
+			return err
+		}
+		// the changes of a transaction share its sequence
+		applied := from
+		for _, change := range changes {
+			if change.Sequence <= from {
+				continue
+			}
+			if err := applyLocks(txn, change); err != nil {
+				return err
+			}
+			if change.Deleted {
+				if err := txn.Delete([]byte(change.Key)); err != nil {
+					return err
+				}
+			} else {
+				if err := txn.SetEntry(newEntry(change)); err != nil {
+					return err
+				}
+			}
+			applied = change.Sequence
+		}
+		return txn.Set(badgerAppliedSequenceKey, itob(applied))
+	})
+}
+
+func (db *BadgerDatabase) LastAppliedSequence() (uint64, error) {
+	var applied uint64
+	err := db.db.View(func(txn *badger.Txn) error {
+		var err error
+		applied, err = getBadgerSequence(txn, badgerAppliedSequenceKey)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+func getBadgerSequence(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err = item.Value(func(val []byte) error {
+		seq = btoi(val)
+		return nil
+	})
+	return seq, err
+}
+
+func (db *BadgerDatabase) SetAppliedSequence(seq uint64) error {
+	return db.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(badgerAppliedSequenceKey, itob(seq))
+	})
+}
+
+// Snapshot calls fn for the latest version of every key, prepared
+// transaction and remembered commit as of a single read timestamp, which is
+// the position replication resumes from.
+func (db *BadgerDatabase) Snapshot(replica string, fn func(key string, value []byte, expiresAt uint64) error) (seq uint64, err error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	seq = txn.ReadTs()
+
+	// the replica resumes right after the dump, even if it was further ahead
+	// under a previous master
+	db.mu.Lock()
+	configured := db.isConfiguredReplica(replica)
+	if configured {
+		db.cursors[replica] = seq
+	}
+	db.mu.Unlock()
+	if !configured {
+		return 0, fmt.Errorf("unknown replica %q", replica)
+	}
+
+	if err := badgerForEachReplicated(txn, fn); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// badgerForEachReplicated calls fn for the latest version txn reads of
+// every key that replicas get.
+func badgerForEachReplicated(txn *badger.Txn, fn func(key string, value []byte, expiresAt uint64) error) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !isReplicatedKey(item.Key()) {
+			continue
+		}
+		err := item.Value(func(value []byte) error {
+			return fn(string(item.Key()), value, item.ExpiresAt())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// badgerDump reads a Dump from the read transaction it holds, which keeps
+// the versions it reads from being collected.
+type badgerDump struct {
+	txn *badger.Txn
+}
+
+func (db *BadgerDatabase) Dump() (Dump, error) {
+	return &badgerDump{txn: db.db.NewTransaction(false)}, nil
+}
+
+func (d *badgerDump) ForEach(fn func(key string, value []byte, expiresAt uint64) error) error {
+	return badgerForEachReplicated(d.txn, fn)
+}
+
+func (d *badgerDump) Close() error {
+	d.txn.Discard()
+	return nil
+}
+
+// ResetReplica drops every key along with the applied sequence, the prepared
+// transactions and their locks before a snapshot is loaded. The rest of our
+// bookkeeping is carried over.
+func (db *BadgerDatabase) ResetReplica() error {
+	meta := make(map[string][]byte)
+	err := db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = metaKey("")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			meta[string(it.Item().KeyCopy(nil))] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := db.db.DropAll(); err != nil {
+		return err
+	}
+
+	return db.db.Update(func(txn *badger.Txn) error {
+		for key, value := range meta {
+			if err := txn.Set([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BadgerDatabase) LoadSnapshot(entries []Change) error {
+	wb := db.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, entry := range entries {
+		if err := wb.SetEntry(newEntry(entry)); err != nil {
+			return err
+		}
+		if id, prepared, _ := decisionID([]byte(entry.Key)); prepared {
+			var t Txn
+			if err := json.Unmarshal(entry.Value, &t); err != nil {
+				return fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+			}
+			for _, key := range t.keys() {
+				if err := wb.Set(lockKey(key), []byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return wb.Flush()
+}
+
+// ForEach calls fn for every key from a single read transaction. The value
+// is only valid until fn returns.
+func (db *BadgerDatabase) ForEach(fn func(key string, value []byte, expiresAt uint64) error) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if isInternalKey(item.Key()) {
+				continue
+			}
+			err := item.Value(func(value []byte) error {
+				return fn(string(item.Key()), value, item.ExpiresAt())
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// snapshotTs checks that the versions at ts are still retained and returns
+// it, or the timestamp txn reads at for 0. Without pins only the versions
+// txn sees are retained.
+func (db *BadgerDatabase) snapshotTs(txn *badger.Txn, ts uint64) (uint64, error) {
+	if ts == 0 {
+		return txn.ReadTs(), nil
+	}
+	return ts, db.checkRetained(txn, ts)
+}
+
+// checkRetained fails unless the versions at ts are still retained.
+func (db *BadgerDatabase) checkRetained(txn *badger.Txn, ts uint64) error {
+	latest := txn.ReadTs()
+	if ts > latest {
+		return fmt.Errorf("timestamp %d is after %d: %w", ts, latest, ErrSnapshotAhead)
+	}
+	db.mu.Lock()
+	floor := latest
+	if len(db.pins) > 0 {
+		floor = db.pins[0].txn.ReadTs()
+	}
+	db.mu.Unlock()
+	if ts < floor {
+		return fmt.Errorf("timestamp %d is before %d: %w", ts, floor, ErrSnapshotTooOld)
+	}
+	return nil
+}
+
+// GetAt iterates the versions of key from the newest, and the first one at
+// or before ts is the one it had then.
+func (db *BadgerDatabase) GetAt(key string, ts uint64) ([]byte, uint64, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	ts, err := db.snapshotTs(txn, ts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if isInternalKey([]byte(key)) {
+		return nil, ts, nil
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.Prefix = []byte(key)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid() && bytes.Equal(it.Item().Key(), []byte(key)); it.Next() {
+		item := it.Item()
+		if item.Version() > ts {
+			continue
+		}
+		if item.IsDeletedOrExpired() {
+			return nil, ts, nil
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		return value, ts, nil
+	}
+	return nil, ts, nil
+}
+
+func (db *BadgerDatabase) ScanAt(start, end, prefix string, limit int, ts uint64) ([]KeyValue, uint64, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	ts, err := db.snapshotTs(txn, ts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var kvs []KeyValue
+	var done []byte
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.Prefix = []byte(prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(scanFrom(start, prefix)); it.Valid(); it.Next() {
+		item := it.Item()
+		if isInternalKey(item.Key()) || item.Version() > ts || bytes.Equal(item.Key(), done) {
+			continue
+		}
+		if scanDone(item.Key(), end, prefix) || (limit > 0 && len(kvs) == limit) {
+			break
+		}
+		// the older versions of the key are skipped
+		done = item.KeyCopy(done[:0])
+		if item.IsDeletedOrExpired() {
+			continue
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		kvs = append(kvs, KeyValue{Key: string(done), Value: value})
+	}
+	return kvs, ts, nil
+}
+
+// ChangesSince reads the versions written after from like GetChanges does.
+// A put that has since expired is still a put, as Badger expires keys
+// without writing a delete.
+func (db *BadgerDatabase) ChangesSince(prefix string, from uint64, limit int) ([]Change, uint64, error) {
+	txn := db.db.NewTransaction(false)
+	defer txn.Discard()
+	if err := db.checkRetained(txn, from); err != nil {
+		return nil, 0, err
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.SinceTs = from
+	opts.Prefix = []byte(prefix)
+	var changes []Change
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if isInternalKey(item.Key()) || item.Version() <= from {
+			continue
+		}
+		change := Change{
+			Sequence:  item.Version(),
+			Key:       string(item.KeyCopy(nil)),
+			Deleted:   item.IsDeletedOrExpired() && item.ExpiresAt() == 0,
+			ExpiresAt: item.ExpiresAt(),
+		}
+		if !change.Deleted {
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			change.Value = value
+		}
+		changes = append(changes, change)
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Sequence < changes[j].Sequence
+	})
+
+	// stop at limit, but never in the middle of a commit timestamp
+	next := txn.ReadTs()
+	if limit > 0 && len(changes) > limit {
+		last := changes[limit-1].Sequence
+		n := limit
+		for n < len(changes) && changes[n].Sequence == last {
+			n++
+		}
+		if n < len(changes) {
+			changes, next = changes[:n], last
+		}
+	}
+	return changes, next, nil
+}
+
+func (db *BadgerDatabase) Scan(start, end, prefix string, limit int) ([]KeyValue, error) {
+	var kvs []KeyValue
+	err := db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(scanFrom(start, prefix)); it.Valid(); it.Next() {
+			item := it.Item()
+			if isInternalKey(item.Key()) {
+				continue
+			}
+			if scanDone(item.Key(), end, prefix) || (limit > 0 && len(kvs) == limit) {
+				break
+			}
+			value, err := item.ValueCopy([]byte{})
+			if err != nil {
+				return err
+			}
+			kvs = append(kvs, KeyValue{Key: string(item.Key()), Value: value})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kvs, nil
 }
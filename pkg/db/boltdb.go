@@ -2,21 +2,142 @@ package db
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 var defaultBucket = []byte("default")
-var replicaBucket = []byte("replica")
+var changeLogBucket = []byte("changelog")
+var cursorBucket = []byte("replica-cursors")
+var metaBucket = []byte("meta")
+
+// Keys with a TTL have their expiry in expiryBucket, and an entry in
+// expiryIndexBucket ordered by expiry then key, which the sweeper walks from
+// the front.
+var expiryBucket = []byte("expiry")
+var expiryIndexBucket = []byte("expiry-index")
+
+// preparedBucket holds the transactions prepared under their id, and
+// locksBucket the id of the transaction that holds each locked key.
+var preparedBucket = []byte("prepared")
+var locksBucket = []byte("locks")
+
+// committedBucket holds when each remembered commit is forgotten, under the
+// id of its transaction.
+var committedBucket = []byte("committed")
+
+// versionsBucket keeps a version of every key per write, under the key
+// followed by the timestamp of the write, for reads at an earlier timestamp.
+// Its sequence is the timestamp of the latest write. Versions before
+// versionFloorKey in the meta bucket have been garbage collected, going
+// through the version log up to versionGCCursorKey.
+var versionsBucket = []byte("versions")
+var versionFloorKey = []byte("version-floor")
+var versionGCCursorKey = []byte("version-gc-cursor")
+
+// versionLogBucket has an entry under the timestamp then the key of every
+// version, which watches read from their timestamp on like replicas read the
+// change log. The change log itself cannot serve watches, as it is only kept
+// while the shard has replicas and is truncated once they have read it,
+// whereas the versions stay until the retention passes.
+var versionLogBucket = []byte("version-log")
+
+// How often expired keys are deleted, and how many at most per transaction.
+const (
+	sweepInterval = time.Second
+	sweepBatch    = 1000
+)
+
+// versionGCBatch is how many entries of the version log are gone through at
+// most per garbage collection transaction.
+const versionGCBatch = 10000
+
+var appliedSequenceKey = []byte("applied-sequence")
+
+// Entries in the change log are prefixed with the operation so that
+// deletes are shipped to replicas as tombstones.
+const (
+	replicaOpPut    byte = 'p'
+	replicaOpDelete byte = 'd'
+	// replicaOpExpire is a put with a TTL, whose expiry follows the operation
+	replicaOpExpire byte = 'e'
+)
+
+func encodeChange(key, value []byte, deleted bool, expiresAt uint64) []byte {
+	op := replicaOpPut
+	if deleted {
+		op, value, expiresAt = replicaOpDelete, nil, 0
+	} else if expiresAt != 0 {
+		op = replicaOpExpire
+	}
+	buf := make([]byte, 1, 1+8+binary.MaxVarintLen64+len(key)+len(value))
+	buf[0] = op
+	if op == replicaOpExpire {
+		buf = append(buf, itob(expiresAt)...)
+	}
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(key)))]...)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+func decodeChange(entry []byte) (key, value []byte, deleted bool, expiresAt uint64, err error) {
+	if len(entry) == 0 {
+		return nil, nil, false, 0, fmt.Errorf("empty change log entry")
+	}
+	op, entry := entry[0], entry[1:]
+	if op == replicaOpExpire {
+		if len(entry) < 8 {
+			return nil, nil, false, 0, fmt.Errorf("corrupt change log entry")
+		}
+		expiresAt, entry = btoi(entry[:8]), entry[8:]
+	}
+	keyLen, n := binary.Uvarint(entry)
+	if n <= 0 || uint64(len(entry)-n) < keyLen {
+		return nil, nil, false, 0, fmt.Errorf("corrupt change log entry")
+	}
+	key = entry[n : n+int(keyLen)]
+	value = entry[n+int(keyLen):]
+	return key, value, op == replicaOpDelete, expiresAt, nil
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
 
 type BoltDatabase struct {
 	db      *bolt.DB
 	replica bool
+
+	mu          sync.RWMutex
+	replicas    []string
+	retention   time.Duration
+	notifier    notifier
+	ackNotifier notifier
 }
 
+// boltMmapSize is how much of the file Bolt maps up front. Growing the map
+// waits for every read transaction to end, which would hold up writes for
+// as long as a Dump is being written out.
+const boltMmapSize = 1 << 32
+
 func NewBoltDatabase(dbPath string, replica bool) (db *BoltDatabase, closeFunc func() error, err error) {
-	boltdb, err := bolt.Open(dbPath+"-boltdb", 0600, nil)
+	boltdb, err := bolt.Open(dbPath+"-boltdb", 0600, &bolt.Options{InitialMmapSize: boltMmapSize})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -25,13 +146,22 @@ func NewBoltDatabase(dbPath string, replica bool) (db *BoltDatabase, closeFunc f
 	boltdb.NoSync = true
 
 	db = &BoltDatabase{db: boltdb, replica: replica}
-	closeFunc = boltdb.Close
 
 	if err := db.createBuckets(); err != nil {
-		closeFunc()
+		boltdb.Close()
 		return nil, nil, fmt.Errorf("creating buckets: %w", err)
 	}
 
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		db.sweep(stop)
+	}()
+	closeFunc = func() error {
+		close(stop)
+		<-stopped
+		return boltdb.Close()
+	}
 	return db, closeFunc, nil
 }
 
@@ -40,41 +170,258 @@ func (db *BoltDatabase) createBuckets() error {
 		if _, err := tx.CreateBucketIfNotExists(defaultBucket); err != nil {
 			return err
 		}
-		if _, err := tx.CreateBucketIfNotExists(replicaBucket); err != nil {
+		if _, err := tx.CreateBucketIfNotExists(changeLogBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(cursorBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(expiryBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(expiryIndexBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(preparedBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(locksBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(committedBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(versionLogBucket); err != nil {
 			return err
 		}
+		if tx.Bucket(versionsBucket) == nil {
+			return createVersions(tx)
+		}
 		return nil
 	})
 }
 
-func (db *BoltDatabase) PutKey(key string, value []byte) error {
-	if db.replica {
-		return fmt.Errorf("replicas only allow read operations")
+// createVersions creates the versions bucket with a first version of every
+// key, which a database that predates it only has the latest value of.
+func createVersions(tx *bolt.Tx) error {
+	if _, err := tx.CreateBucket(versionsBucket); err != nil {
+		return err
+	}
+	ts, err := nextVersion(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(metaBucket).Put(versionFloorKey, itob(ts)); err != nil {
+		return err
+	}
+	expiry := tx.Bucket(expiryBucket)
+	return tx.Bucket(defaultBucket).ForEach(func(key, value []byte) error {
+		return putVersion(tx, ts, Change{Key: string(key), Value: value, ExpiresAt: btoi(expiry.Get(key))})
+	})
+}
+
+// versionPrefix escapes every 0x00 of key as 0x00 0xff and ends it with
+// 0x00 0x01, so that the versions of a key are sorted together and in the
+// same order as the keys, even when one key is a prefix of another.
+func versionPrefix(key []byte) []byte {
+	prefix := make([]byte, 0, len(key)+2)
+	for _, c := range key {
+		prefix = append(prefix, c)
+		if c == 0 {
+			prefix = append(prefix, 0xff)
+		}
+	}
+	return append(prefix, 0, 1)
+}
+
+// versionKey is where the version of key written at ts is kept.
+func versionKey(key []byte, ts uint64) []byte {
+	return append(versionPrefix(key), itob(ts)...)
+}
+
+// splitVersionKey returns the prefix, key and timestamp of a version.
+func splitVersionKey(k []byte) (prefix, key []byte, ts uint64) {
+	prefix, ts = k[:len(k)-8], btoi(k[len(k)-8:])
+	escaped := prefix[:len(prefix)-2]
+	key = make([]byte, 0, len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		key = append(key, escaped[i])
+		if escaped[i] == 0 {
+			i++
+		}
 	}
-	db.db.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket(defaultBucket).Put([]byte(key), value); err != nil {
+	return prefix, key, ts
+}
+
+// A version is its kind, when it was written in unix nanoseconds, when it
+// expires and the value.
+const versionHeader = 1 + 8 + 8
+
+// The kinds of versions. The newest version of a key is current, and has
+// the value in the default bucket rather than one of its own, which it only
+// gets once it is overwritten so that no value is stored twice.
+const (
+	versionPut     byte = 0
+	versionDeleted byte = 1
+	versionCurrent byte = 2
+)
+
+func encodeVersion(change Change, writtenAt uint64) []byte {
+	buf := make([]byte, versionHeader)
+	buf[0] = versionCurrent
+	if change.Deleted {
+		buf[0] = versionDeleted
+	}
+	binary.BigEndian.PutUint64(buf[1:], writtenAt)
+	binary.BigEndian.PutUint64(buf[9:], change.ExpiresAt)
+	return buf
+}
+
+func decodeVersion(v []byte) (deleted bool, writtenAt, expiresAt uint64, value []byte) {
+	return v[0] == versionDeleted, btoi(v[1:9]), btoi(v[9:17]), v[versionHeader:]
+}
+
+// fullVersion returns the version v of key with its value, which a current
+// version takes from the default bucket.
+func fullVersion(tx *bolt.Tx, key, v []byte) []byte {
+	if v[0] != versionCurrent {
+		return v
+	}
+	value := tx.Bucket(defaultBucket).Get(key)
+	full := make([]byte, versionHeader, versionHeader+len(value))
+	copy(full, v)
+	full[0] = versionPut
+	return append(full, value...)
+}
+
+// versionBefore returns the newest version of key written before ts, or nil
+// if there is none.
+func versionBefore(c *bolt.Cursor, key []byte, ts uint64) (k, v []byte) {
+	prefix := versionPrefix(key)
+	k, v = c.Seek(versionKey(key, ts))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	if k != nil && len(k) == len(prefix)+8 && bytes.HasPrefix(k, prefix) {
+		return k, v
+	}
+	return nil, nil
+}
+
+// nextVersion returns the timestamp of the writes of tx. Every write of a
+// transaction shares it, so that a read sees all of them or none.
+func nextVersion(tx *bolt.Tx) (uint64, error) {
+	return tx.Bucket(versionsBucket).NextSequence()
+}
+
+// putVersion keeps change as the current version of its key at ts. It is
+// called before the default bucket is written, so that the version it
+// replaces as the current one gets the value it had.
+func putVersion(tx *bolt.Tx, ts uint64, change Change) error {
+	versions, key := tx.Bucket(versionsBucket), []byte(change.Key)
+	if k, v := versionBefore(versions.Cursor(), key, ts); k != nil && v[0] == versionCurrent {
+		if err := versions.Put(copyValueIntoSlice(k), fullVersion(tx, key, v)); err != nil {
 			return err
 		}
+	}
+	value := encodeVersion(change, uint64(time.Now().UnixNano()))
+	if err := versions.Put(versionKey(key, ts), value); err != nil {
+		return err
+	}
+	return tx.Bucket(versionLogBucket).Put(versionLogKey(ts, key), []byte{})
+}
+
+func versionLogKey(ts uint64, key []byte) []byte {
+	return append(itob(ts), key...)
+}
+
+func unixNow() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+func expiryIndexKey(expiresAt uint64, key []byte) []byte {
+	return append(itob(expiresAt), key...)
+}
 
-		if err := tx.Bucket(replicaBucket).Put([]byte(key), value); err != nil {
+// setExpiry records when key expires, or that it does not for 0.
+func setExpiry(tx *bolt.Tx, key []byte, expiresAt uint64) error {
+	expiry, index := tx.Bucket(expiryBucket), tx.Bucket(expiryIndexBucket)
+	if old := expiry.Get(key); old != nil {
+		if err := index.Delete(expiryIndexKey(btoi(old), key)); err != nil {
 			return err
 		}
-		return nil
+	}
+	if expiresAt == 0 {
+		return expiry.Delete(key)
+	}
+	if err := expiry.Put(key, itob(expiresAt)); err != nil {
+		return err
+	}
+	return index.Put(expiryIndexKey(expiresAt, key), []byte{})
+}
+
+// expired reports whether key has outlived its TTL. Expired keys read as
+// missing until the sweeper deletes them.
+func expired(tx *bolt.Tx, key []byte, now uint64) bool {
+	expiresAt := btoi(tx.Bucket(expiryBucket).Get(key))
+	return expiresAt != 0 && expiresAt <= now
+}
+
+// checkUnlocked fails a write to a key that a prepared transaction holds.
+func checkUnlocked(tx *bolt.Tx, key string) error {
+	if tx.Bucket(locksBucket).Get([]byte(key)) != nil {
+		return fmt.Errorf("key %q: %w", key, ErrLocked)
+	}
+	return nil
+}
+
+func (db *BoltDatabase) PutKey(key string, value []byte) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		if err := checkUnlocked(tx, key); err != nil {
+			return err
+		}
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		if err := putChange(tx, ts, Change{Key: key, Value: value}); err != nil {
+			return err
+		}
+
+		return db.appendChange(tx, []byte(key), value, false, 0)
 	})
+	if err != nil {
+		return err
+	}
+	db.notifier.notify()
 	return nil
 }
 
 func (db *BoltDatabase) PutKeyReplica(key string, value []byte) error {
-	db.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(defaultBucket).Put([]byte(key), value)
+	return db.db.Update(func(tx *bolt.Tx) error {
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		return putChange(tx, ts, Change{Key: key, Value: value})
 	})
-	return nil
 }
 
 func (db *BoltDatabase) GetKey(key string) ([]byte, error) {
 	var result []byte
 	err := db.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(defaultBucket)
+		if expired(tx, []byte(key), unixNow()) {
+			return nil
+		}
 		result = b.Get([]byte(key))
 		return nil
 	})
@@ -85,28 +432,41 @@ func (db *BoltDatabase) GetKey(key string) ([]byte, error) {
 	return result, nil
 }
 
-func (db *BoltDatabase) getBulkKeys(getKey func(string) bool) ([]string, error) {
-	var keys []string
+func (db *BoltDatabase) GetBatch(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
 	err := db.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(defaultBucket)
-		return b.ForEach(func(key, value []byte) error {
-			if getKey(string(key)) {
-				keys = append(keys, string(key))
+		now := unixNow()
+		for i, key := range keys {
+			if !expired(tx, []byte(key), now) {
+				values[i] = copyValueIntoSlice(b.Get([]byte(key)))
 			}
-			return nil
-		})
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return keys, nil
+	return values, nil
 }
 
-func (db *BoltDatabase) deleteKeys(keys []string) error {
+func (db *BoltDatabase) PutBatch(changes []Change) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
 	err := db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
-		for _, key := range keys {
-			if err := b.Delete([]byte(key)); err != nil {
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err := checkUnlocked(tx, change.Key); err != nil {
+				return err
+			}
+			if err := putChange(tx, ts, change); err != nil {
+				return err
+			}
+			if err := db.appendChange(tx, []byte(change.Key), change.Value, change.Deleted, change.ExpiresAt); err != nil {
 				return err
 			}
 		}
@@ -115,58 +475,1210 @@ func (db *BoltDatabase) deleteKeys(keys []string) error {
 	if err != nil {
 		return err
 	}
+	db.notifier.notify()
 	return nil
 }
 
-func (db *BoltDatabase) DeleteBulkKeys(deleteKey func(string) bool) error {
-	keys, err := db.getBulkKeys(deleteKey)
-	if err != nil {
+// putChange writes or deletes the key of change along with its expiry, and
+// keeps it as the version of the key at ts.
+func putChange(tx *bolt.Tx, ts uint64, change Change) error {
+	if err := putVersion(tx, ts, change); err != nil {
+		return err
+	}
+	b := tx.Bucket(defaultBucket)
+	if change.Deleted {
+		if err := b.Delete([]byte(change.Key)); err != nil {
+			return err
+		}
+		return setExpiry(tx, []byte(change.Key), 0)
+	}
+	if err := b.Put([]byte(change.Key), change.Value); err != nil {
 		return err
 	}
+	return setExpiry(tx, []byte(change.Key), change.ExpiresAt)
+}
 
-	if err = db.deleteKeys(keys); err != nil {
+func (db *BoltDatabase) PutIf(change Change, cond Condition) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		if err := checkUnlocked(tx, change.Key); err != nil {
+			return err
+		}
+		var current []byte
+		if !expired(tx, []byte(change.Key), unixNow()) {
+			current = tx.Bucket(defaultBucket).Get([]byte(change.Key))
+		}
+		if err := cond.check(current); err != nil {
+			return err
+		}
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		if err := putChange(tx, ts, change); err != nil {
+			return err
+		}
+		return db.appendChange(tx, []byte(change.Key), change.Value, change.Deleted, change.ExpiresAt)
+	})
+	if err != nil {
 		return err
 	}
+	db.notifier.notify()
 	return nil
 }
 
-func copyValueIntoSlice(b []byte) []byte {
-	if b == nil {
+func (db *BoltDatabase) Add(key string, delta int64, expiresAt uint64) (Change, int64, error) {
+	if db.isReplica() {
+		return Change{}, 0, ErrReadOnly
+	}
+	change := Change{Key: key, ExpiresAt: expiresAt}
+	var n int64
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		if err := checkUnlocked(tx, key); err != nil {
+			return err
+		}
+		var current []byte
+		if !expired(tx, []byte(key), unixNow()) {
+			current = tx.Bucket(defaultBucket).Get([]byte(key))
+		}
+		if current != nil {
+			change.ExpiresAt = btoi(tx.Bucket(expiryBucket).Get([]byte(key)))
+		}
+		var err error
+		if change.Value, n, err = addCounter(current, delta); err != nil {
+			return err
+		}
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		if err := putChange(tx, ts, change); err != nil {
+			return err
+		}
+		return db.appendChange(tx, []byte(key), change.Value, false, change.ExpiresAt)
+	})
+	if err != nil {
+		return Change{}, 0, err
+	}
+	db.notifier.notify()
+	return change, n, nil
+}
+
+func (db *BoltDatabase) Transact(txn Txn) ([][]byte, error) {
+	if db.isReplica() && len(txn.Writes) > 0 {
+		return nil, ErrReadOnly
+	}
+	values := make([][]byte, len(txn.Reads))
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(defaultBucket)
+		now := unixNow()
+		get := func(key string) ([]byte, error) {
+			if expired(tx, []byte(key), now) {
+				return nil, nil
+			}
+			return b.Get([]byte(key)), nil
+		}
+		if err := txn.check(get); err != nil {
+			return err
+		}
+		for i, key := range txn.Reads {
+			value, _ := get(key)
+			values[i] = copyValueIntoSlice(value)
+		}
+		if len(txn.Writes) == 0 {
+			return nil
+		}
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, change := range txn.Writes {
+			if err := checkUnlocked(tx, change.Key); err != nil {
+				return err
+			}
+			if err := putChange(tx, ts, change); err != nil {
+				return err
+			}
+			if err := db.appendChange(tx, []byte(change.Key), change.Value, change.Deleted, change.ExpiresAt); err != nil {
+				return err
+			}
+		}
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	res := make([]byte, len(b))
-	copy(res, b)
-	return res
+	if len(txn.Writes) > 0 {
+		db.notifier.notify()
+	}
+	return values, nil
 }
 
-func (db *BoltDatabase) GetKeyForReplication() (keyCopy, valueCopy []byte, err error) {
-	err = db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-		key, value := b.Cursor().First()
-		keyCopy = copyValueIntoSlice(key)
-		valueCopy = copyValueIntoSlice(value)
+func (db *BoltDatabase) Prepare(id string, txn Txn) ([][]byte, error) {
+	if db.isReplica() {
+		return nil, ErrReadOnly
+	}
+	values := make([][]byte, len(txn.Reads))
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		b, prepared, locks := tx.Bucket(defaultBucket), tx.Bucket(preparedBucket), tx.Bucket(locksBucket)
+		now := unixNow()
+		get := func(key string) ([]byte, error) {
+			if expired(tx, []byte(key), now) {
+				return nil, nil
+			}
+			return b.Get([]byte(key)), nil
+		}
+		if prepared.Get([]byte(id)) == nil {
+			for _, key := range txn.keys() {
+				if holder := locks.Get([]byte(key)); holder != nil && string(holder) != id {
+					return fmt.Errorf("key %q: %w", key, ErrLocked)
+				}
+			}
+			if err := txn.check(get); err != nil {
+				return err
+			}
+			raw, err := putPrepared(tx, id, txn)
+			if err != nil {
+				return err
+			}
+			if err := db.appendChange(tx, preparedKey(id), raw, false, 0); err != nil {
+				return err
+			}
+		}
+		for i, key := range txn.Reads {
+			value, _ := get(key)
+			values[i] = copyValueIntoSlice(value)
+		}
 		return nil
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return keyCopy, valueCopy, nil
+	return values, nil
 }
 
-func (db *BoltDatabase) DeleteReplicationKey(key, value []byte) (err error) {
-	err = db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-		replicaValue := b.Get(key)
-		if replicaValue == nil {
-			return fmt.Errorf("key does not exist")
+// decide releases the locks of the transaction prepared under id and
+// forgets it, applying its writes and remembering the commit first if commit
+// is set. The decision goes to the change log after the writes, so that a
+// replica never releases the locks before it has the writes.
+func (db *BoltDatabase) decide(id string, commit bool) error {
+	applied := false
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		now := unixNow()
+		raw := tx.Bucket(preparedBucket).Get([]byte(id))
+		if raw == nil {
+			if commit && !committed(tx, id, now) {
+				return fmt.Errorf("transaction %s: %w", id, ErrNotPrepared)
+			}
+			return nil
+		}
+		var txn Txn
+		if err := json.Unmarshal(raw, &txn); err != nil {
+			return fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+		}
+		if commit {
+			ts, err := nextVersion(tx)
+			if err != nil {
+				return err
+			}
+			for _, change := range txn.Writes {
+				if err := putChange(tx, ts, change); err != nil {
+					return err
+				}
+				if err := db.appendChange(tx, []byte(change.Key), change.Value, change.Deleted, change.ExpiresAt); err != nil {
+					return err
+				}
+			}
+			applied = len(txn.Writes) > 0
+			forgetAt := now + uint64(committedRetention/time.Second)
+			if err := tx.Bucket(committedBucket).Put([]byte(id), itob(forgetAt)); err != nil {
+				return err
+			}
+			if err := db.appendChange(tx, committedKey(id), nil, false, forgetAt); err != nil {
+				return err
+			}
 		}
-		if !bytes.Equal(replicaValue, value) {
-			return fmt.Errorf("values do not match.")
+		if err := deletePrepared(tx, id, txn); err != nil {
+			return err
 		}
-		return b.Delete(key)
+		return db.appendChange(tx, preparedKey(id), nil, true, 0)
 	})
 	if err != nil {
 		return err
 	}
+	if applied {
+		db.notifier.notify()
+	}
 	return nil
 }
+
+// putPrepared records txn as prepared under id along with its locks, and
+// returns the record.
+func putPrepared(tx *bolt.Tx, id string, txn Txn) ([]byte, error) {
+	raw, err := json.Marshal(txn)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(preparedBucket).Put([]byte(id), raw); err != nil {
+		return nil, err
+	}
+	locks := tx.Bucket(locksBucket)
+	for _, key := range txn.keys() {
+		if err := locks.Put([]byte(key), []byte(id)); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// deletePrepared releases the locks txn, prepared under id, still holds and
+// forgets it.
+func deletePrepared(tx *bolt.Tx, id string, txn Txn) error {
+	locks := tx.Bucket(locksBucket)
+	for _, key := range txn.keys() {
+		if string(locks.Get([]byte(key))) == id {
+			if err := locks.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Bucket(preparedBucket).Delete([]byte(id))
+}
+
+// committed reports whether the commit of id is still remembered.
+func committed(tx *bolt.Tx, id string, now uint64) bool {
+	return btoi(tx.Bucket(committedBucket).Get([]byte(id))) > now
+}
+
+// applyDecision applies a change the master made to a prepared transaction
+// or a remembered commit, and reports whether change was one.
+func applyDecision(tx *bolt.Tx, change Change) (bool, error) {
+	id, prepared, ok := decisionID([]byte(change.Key))
+	switch {
+	case !ok:
+		return false, nil
+	case prepared && change.Deleted:
+		raw := tx.Bucket(preparedBucket).Get([]byte(id))
+		if raw == nil {
+			return true, nil
+		}
+		var txn Txn
+		if err := json.Unmarshal(raw, &txn); err != nil {
+			return true, fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+		}
+		return true, deletePrepared(tx, id, txn)
+	case prepared:
+		var txn Txn
+		if err := json.Unmarshal(change.Value, &txn); err != nil {
+			return true, fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+		}
+		_, err := putPrepared(tx, id, txn)
+		return true, err
+	case change.Deleted:
+		return true, tx.Bucket(committedBucket).Delete([]byte(id))
+	}
+	return true, tx.Bucket(committedBucket).Put([]byte(id), itob(change.ExpiresAt))
+}
+
+// forEachDecision calls fn for every prepared transaction and remembered
+// commit the way the change log ships them.
+func forEachDecision(tx *bolt.Tx, fn func(key string, value []byte, expiresAt uint64) error) error {
+	err := tx.Bucket(preparedBucket).ForEach(func(id, raw []byte) error {
+		return fn(string(preparedKey(string(id))), raw, 0)
+	})
+	if err != nil {
+		return err
+	}
+	now := unixNow()
+	return tx.Bucket(committedBucket).ForEach(func(id, v []byte) error {
+		if btoi(v) <= now {
+			return nil
+		}
+		return fn(string(committedKey(string(id))), nil, btoi(v))
+	})
+}
+
+// sweepCommitted forgets the commits past their retention. Every node does
+// so on its own, as when that happens is the same everywhere.
+func (db *BoltDatabase) sweepCommitted() error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		now := unixNow()
+		b := tx.Bucket(committedBucket)
+		var ids [][]byte
+		err := b.ForEach(func(id, v []byte) error {
+			if btoi(v) <= now {
+				ids = append(ids, copyValueIntoSlice(id))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := b.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDatabase) CommitPrepared(id string) error {
+	return db.decide(id, true)
+}
+
+func (db *BoltDatabase) AbortPrepared(id string) error {
+	return db.decide(id, false)
+}
+
+func (db *BoltDatabase) Prepared() (map[string]Txn, error) {
+	txns := make(map[string]Txn)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(preparedBucket).ForEach(func(id, raw []byte) error {
+			var txn Txn
+			if err := json.Unmarshal(raw, &txn); err != nil {
+				return fmt.Errorf("decoding prepared transaction %s: %w", id, err)
+			}
+			txns[string(id)] = txn
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txns, nil
+}
+
+func (db *BoltDatabase) GetExpiry(key string) (uint64, error) {
+	var expiresAt uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		expiresAt = btoi(tx.Bucket(expiryBucket).Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expiresAt, nil
+}
+
+func (db *BoltDatabase) DeleteKey(key string) error {
+	if db.isReplica() {
+		return ErrReadOnly
+	}
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		if err := checkUnlocked(tx, key); err != nil {
+			return err
+		}
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		if err := putChange(tx, ts, Change{Key: key, Deleted: true}); err != nil {
+			return err
+		}
+		return db.appendChange(tx, []byte(key), nil, true, 0)
+	})
+	if err != nil {
+		return err
+	}
+	db.notifier.notify()
+	return nil
+}
+
+func (db *BoltDatabase) DeleteKeyReplica(key string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		return putChange(tx, ts, Change{Key: key, Deleted: true})
+	})
+}
+
+func (db *BoltDatabase) getBulkKeys(getKey func(string) bool) ([]string, error) {
+	var keys []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(defaultBucket)
+		return b.ForEach(func(key, value []byte) error {
+			if getKey(string(key)) {
+				keys = append(keys, string(key))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// deleteKeys deletes keys in a single transaction. On a master the deletes
+// go to the change log like any other, so that the replicas drop the keys
+// too.
+func (db *BoltDatabase) deleteKeys(keys []string) error {
+	master := !db.isReplica()
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if master {
+				if err := checkUnlocked(tx, key); err != nil {
+					return err
+				}
+			}
+			if err := putChange(tx, ts, Change{Key: key, Deleted: true}); err != nil {
+				return err
+			}
+			if master {
+				if err := db.appendChange(tx, []byte(key), nil, true, 0); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if master {
+		db.notifier.notify()
+	}
+	return nil
+}
+
+func (db *BoltDatabase) DeleteBulkKeys(deleteKey func(string) bool) error {
+	keys, err := db.getBulkKeys(deleteKey)
+	if err != nil {
+		return err
+	}
+
+	if err = db.deleteKeys(keys); err != nil {
+		return err
+	}
+	return nil
+}
+
+func copyValueIntoSlice(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	res := make([]byte, len(b))
+	copy(res, b)
+	return res
+}
+
+func (db *BoltDatabase) isReplica() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.replica
+}
+
+// SetReplicaMode switches the database between a read-only replica and a
+// master when a shard fails over.
+func (db *BoltDatabase) SetReplicaMode(replica bool) {
+	db.mu.Lock()
+	db.replica = replica
+	db.mu.Unlock()
+}
+
+func (db *BoltDatabase) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		value = copyValueIntoSlice(tx.Bucket(metaBucket).Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (db *BoltDatabase) PutMeta(key string, value []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(key), value)
+	})
+}
+
+func (db *BoltDatabase) DeleteMeta(key string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Delete([]byte(key))
+	})
+}
+
+func (db *BoltDatabase) ForEachMeta(prefix string, fn func(key string, value []byte) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(metaBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltDatabase) SetReplicas(replicas []string) error {
+	db.mu.Lock()
+	db.replicas = append([]string(nil), replicas...)
+	db.mu.Unlock()
+
+	// cursors of replicas that were removed from the config must not hold
+	// back garbage collection of the change log
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return db.collectChangeLog(tx)
+	})
+}
+
+func (db *BoltDatabase) isConfiguredReplica(replica string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, r := range db.replicas {
+		if r == replica {
+			return true
+		}
+	}
+	return false
+}
+
+// appendChange records a write in the change log. When the shard has no
+// replicas only the sequence is bumped, so that a replica added later can
+// tell it missed those writes and needs a snapshot.
+func (db *BoltDatabase) appendChange(tx *bolt.Tx, key, value []byte, deleted bool, expiresAt uint64) error {
+	b := tx.Bucket(changeLogBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	numReplicas := len(db.replicas)
+	db.mu.RUnlock()
+	if numReplicas == 0 {
+		return nil
+	}
+	return b.Put(itob(seq), encodeChange(key, value, deleted, expiresAt))
+}
+
+// collectChangeLog removes every change log entry that all the configured
+// replicas have acknowledged.
+func (db *BoltDatabase) collectChangeLog(tx *bolt.Tx) error {
+	db.mu.RLock()
+	replicas := db.replicas
+	db.mu.RUnlock()
+
+	cursors := tx.Bucket(cursorBucket)
+	minAcked := tx.Bucket(changeLogBucket).Sequence()
+	for _, r := range replicas {
+		acked := btoi(cursors.Get([]byte(r)))
+		if acked < minAcked {
+			minAcked = acked
+		}
+	}
+
+	var keys [][]byte
+	c := tx.Bucket(changeLogBucket).Cursor()
+	for k, _ := c.First(); k != nil && btoi(k) <= minAcked; k, _ = c.Next() {
+		keys = append(keys, copyValueIntoSlice(k))
+	}
+	for _, k := range keys {
+		if err := tx.Bucket(changeLogBucket).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChanges returns up to limit change log entries starting at sequence
+// from. Asking for from acknowledges every entry before it for the replica.
+func (db *BoltDatabase) GetChanges(replica string, from uint64, limit int) ([]Change, error) {
+	if !db.isConfiguredReplica(replica) {
+		return nil, fmt.Errorf("unknown replica %q", replica)
+	}
+	if from == 0 {
+		from = 1
+	}
+
+	var changes []Change
+	acked := false
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket(changeLogBucket)
+		if from-1 > log.Sequence() {
+			return fmt.Errorf("replica is at sequence %d but the master is only at %d: %w", from-1, log.Sequence(), ErrReplicaAhead)
+		}
+		oldest := log.Sequence() + 1
+		if k, _ := log.Cursor().First(); k != nil {
+			oldest = btoi(k)
+		}
+		if from < oldest {
+			return ErrHistoryTruncated
+		}
+
+		cursors := tx.Bucket(cursorBucket)
+		if from-1 > btoi(cursors.Get([]byte(replica))) {
+			if err := cursors.Put([]byte(replica), itob(from-1)); err != nil {
+				return err
+			}
+			if err := db.collectChangeLog(tx); err != nil {
+				return err
+			}
+			acked = true
+		}
+
+		c := log.Cursor()
+		for k, entry := c.Seek(itob(from)); k != nil && (limit <= 0 || len(changes) < limit); k, entry = c.Next() {
+			key, value, deleted, expiresAt, err := decodeChange(entry)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, Change{
+				Sequence:  btoi(k),
+				Key:       string(key),
+				Value:     copyValueIntoSlice(value),
+				Deleted:   deleted,
+				ExpiresAt: expiresAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acked {
+		db.ackNotifier.notify()
+	}
+	return changes, nil
+}
+
+func (db *BoltDatabase) WaitForChanges() <-chan struct{} {
+	return db.notifier.wait()
+}
+
+func (db *BoltDatabase) WaitForAcks() <-chan struct{} {
+	return db.ackNotifier.wait()
+}
+
+func (db *BoltDatabase) LastSequence() (uint64, error) {
+	var seq uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(changeLogBucket).Sequence()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// AckedSequences returns the last sequence acknowledged by each configured
+// replica.
+func (db *BoltDatabase) AckedSequences() (map[string]uint64, error) {
+	db.mu.RLock()
+	replicas := db.replicas
+	db.mu.RUnlock()
+
+	acked := make(map[string]uint64)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		cursors := tx.Bucket(cursorBucket)
+		for _, r := range replicas {
+			acked[r] = btoi(cursors.Get([]byte(r)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acked, nil
+}
+
+// ApplyChanges applies a batch from the master's change log and records the
+// last applied sequence in the same transaction so that a restarted replica
+// resumes where it left off.
+func (db *BoltDatabase) ApplyChanges(changes []Change) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		applied := btoi(meta.Get(appliedSequenceKey))
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if change.Sequence <= applied {
+				continue
+			}
+			if ok, err := applyDecision(tx, change); err != nil {
+				return err
+			} else if !ok {
+				if err := putChange(tx, ts, change); err != nil {
+					return err
+				}
+			}
+			applied = change.Sequence
+		}
+		return meta.Put(appliedSequenceKey, itob(applied))
+	})
+}
+
+func (db *BoltDatabase) LastAppliedSequence() (uint64, error) {
+	var applied uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		applied = btoi(tx.Bucket(metaBucket).Get(appliedSequenceKey))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return applied, nil
+}
+
+func (db *BoltDatabase) SetAppliedSequence(seq uint64) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(appliedSequenceKey, itob(seq))
+	})
+}
+
+// Snapshot calls fn for every key, prepared transaction and remembered commit
+// from a single read transaction and returns the change log position the
+// dump corresponds to.
+func (db *BoltDatabase) Snapshot(replica string, fn func(key string, value []byte, expiresAt uint64) error) (seq uint64, err error) {
+	if !db.isConfiguredReplica(replica) {
+		return 0, fmt.Errorf("unknown replica %q", replica)
+	}
+	// The replica resumes right after the dump, so move its cursor there even
+	// if it was further ahead under a previous master. The dump itself may
+	// end up a little later, which only retains a few more entries.
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		seq := tx.Bucket(changeLogBucket).Sequence()
+		return tx.Bucket(cursorBucket).Put([]byte(replica), itob(seq))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(changeLogBucket).Sequence()
+		return forEachReplicated(tx, fn)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// ResetReplica drops every key along with the applied sequence, the prepared
+// transactions and their locks before a snapshot is loaded. The versions go
+// too, but their timestamps carry on from where they were so that an
+// earlier timestamp is never reused.
+func (db *BoltDatabase) ResetReplica() error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(defaultBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(defaultBucket); err != nil {
+			return err
+		}
+		ts := tx.Bucket(versionsBucket).Sequence()
+		for _, name := range [][]byte{versionsBucket, versionLogBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		versions := tx.Bucket(versionsBucket)
+		if err := versions.SetSequence(ts); err != nil {
+			return err
+		}
+		if err := tx.Bucket(metaBucket).Put(versionFloorKey, itob(ts+1)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(metaBucket).Delete(versionGCCursorKey); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{expiryBucket, expiryIndexBucket, preparedBucket, locksBucket, committedBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Delete(appliedSequenceKey)
+	})
+}
+
+func (db *BoltDatabase) LoadSnapshot(entries []Change) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if ok, err := applyDecision(tx, entry); err != nil {
+				return err
+			} else if ok {
+				continue
+			}
+			if err := putChange(tx, ts, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls fn for every key from a single read transaction. The value
+// is only valid until fn returns.
+func (db *BoltDatabase) ForEach(fn func(key string, value []byte, expiresAt uint64) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		return forEachLive(tx, fn)
+	})
+}
+
+// boltDump reads a Dump from the read transaction it holds.
+type boltDump struct {
+	tx *bolt.Tx
+}
+
+func (db *BoltDatabase) Dump() (Dump, error) {
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltDump{tx: tx}, nil
+}
+
+func (d *boltDump) ForEach(fn func(key string, value []byte, expiresAt uint64) error) error {
+	return forEachReplicated(d.tx, fn)
+}
+
+func (d *boltDump) Close() error {
+	return d.tx.Rollback()
+}
+
+// forEachReplicated calls fn for every key that has not expired, prepared
+// transaction and remembered commit, which is what replicas get.
+func forEachReplicated(tx *bolt.Tx, fn func(key string, value []byte, expiresAt uint64) error) error {
+	if err := forEachLive(tx, fn); err != nil {
+		return err
+	}
+	return forEachDecision(tx, fn)
+}
+
+// forEachLive calls fn for every key that has not expired.
+func forEachLive(tx *bolt.Tx, fn func(key string, value []byte, expiresAt uint64) error) error {
+	expiry := tx.Bucket(expiryBucket)
+	now := unixNow()
+	return tx.Bucket(defaultBucket).ForEach(func(key, value []byte) error {
+		expiresAt := btoi(expiry.Get(key))
+		if expiresAt != 0 && expiresAt <= now {
+			return nil
+		}
+		return fn(string(key), value, expiresAt)
+	})
+}
+
+func (db *BoltDatabase) Scan(start, end, prefix string, limit int) ([]KeyValue, error) {
+	var kvs []KeyValue
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(defaultBucket).Cursor()
+		now := unixNow()
+		for k, v := c.Seek(scanFrom(start, prefix)); k != nil && !scanDone(k, end, prefix); k, v = c.Next() {
+			if expired(tx, k, now) {
+				continue
+			}
+			if limit > 0 && len(kvs) == limit {
+				break
+			}
+			kvs = append(kvs, KeyValue{Key: string(k), Value: copyValueIntoSlice(v)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// snapshotTs checks that the versions at ts are still retained and returns
+// it, or the latest timestamp for 0.
+func snapshotTs(tx *bolt.Tx, ts uint64) (uint64, error) {
+	if ts == 0 {
+		return tx.Bucket(versionsBucket).Sequence(), nil
+	}
+	return ts, checkRetained(tx, ts)
+}
+
+// checkRetained fails unless the versions at ts are still retained.
+func checkRetained(tx *bolt.Tx, ts uint64) error {
+	if latest := tx.Bucket(versionsBucket).Sequence(); ts > latest {
+		return fmt.Errorf("timestamp %d is after %d: %w", ts, latest, ErrSnapshotAhead)
+	}
+	if floor := btoi(tx.Bucket(metaBucket).Get(versionFloorKey)); ts < floor {
+		return fmt.Errorf("timestamp %d is before %d: %w", ts, floor, ErrSnapshotTooOld)
+	}
+	return nil
+}
+
+// liveVersion returns the value of a version, or nil if it is a delete or
+// has expired.
+func liveVersion(v []byte, now uint64) []byte {
+	deleted, _, expiresAt, value := decodeVersion(v)
+	if deleted || (expiresAt != 0 && expiresAt <= now) {
+		return nil
+	}
+	return value
+}
+
+func (db *BoltDatabase) GetAt(key string, ts uint64) ([]byte, uint64, error) {
+	var result []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if ts, err = snapshotTs(tx, ts); err != nil {
+			return err
+		}
+		if k, v := versionBefore(tx.Bucket(versionsBucket).Cursor(), []byte(key), ts+1); k != nil {
+			result = copyValueIntoSlice(liveVersion(fullVersion(tx, []byte(key), v), unixNow()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, ts, nil
+}
+
+func (db *BoltDatabase) ScanAt(start, end, prefix string, limit int, ts uint64) ([]KeyValue, uint64, error) {
+	var kvs []KeyValue
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if ts, err = snapshotTs(tx, ts); err != nil {
+			return err
+		}
+		now := unixNow()
+		var current, currentKey, value []byte
+		// flush keeps the key whose versions were just walked if it was
+		// live at ts
+		flush := func() {
+			if value != nil {
+				kvs = append(kvs, KeyValue{Key: string(currentKey), Value: copyValueIntoSlice(value)})
+			}
+			value = nil
+		}
+		// the escaped start without its end sorts right before its versions
+		from := versionPrefix(scanFrom(start, prefix))
+		c := tx.Bucket(versionsBucket).Cursor()
+		for k, v := c.Seek(from[:len(from)-2]); k != nil; k, v = c.Next() {
+			p, key, version := splitVersionKey(k)
+			if !bytes.Equal(p, current) {
+				flush()
+				if limit > 0 && len(kvs) == limit {
+					return nil
+				}
+				if scanDone(key, end, prefix) {
+					return nil
+				}
+				current, currentKey = p, key
+			}
+			if version <= ts {
+				value = liveVersion(fullVersion(tx, key, v), now)
+			}
+		}
+		flush()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return kvs, ts, nil
+}
+
+func (db *BoltDatabase) ChangesSince(prefix string, from uint64, limit int) ([]Change, uint64, error) {
+	var changes []Change
+	var next uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		if err := checkRetained(tx, from); err != nil {
+			return err
+		}
+		next = tx.Bucket(versionsBucket).Sequence()
+		versions := tx.Bucket(versionsBucket)
+		c := tx.Bucket(versionLogBucket).Cursor()
+		for k, _ := c.Seek(itob(from + 1)); k != nil; k, _ = c.Next() {
+			ts, key := btoi(k[:8]), k[8:]
+			if limit > 0 && len(changes) >= limit && ts != changes[len(changes)-1].Sequence {
+				next = changes[len(changes)-1].Sequence
+				break
+			}
+			if !bytes.HasPrefix(key, []byte(prefix)) {
+				continue
+			}
+			deleted, _, expiresAt, value := decodeVersion(fullVersion(tx, key, versions.Get(versionKey(key, ts))))
+			change := Change{Sequence: ts, Key: string(key), Deleted: deleted, ExpiresAt: expiresAt}
+			if !deleted {
+				change.Value = copyValueIntoSlice(value)
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return changes, next, nil
+}
+
+func (db *BoltDatabase) SetVersionRetention(retention time.Duration) {
+	db.mu.Lock()
+	db.retention = retention
+	db.mu.Unlock()
+}
+
+// collectVersions goes through up to versionGCBatch entries of the version
+// log written longer than the retention ago, from where it stopped last
+// time, and returns how many it went through. Each of them overwrites the
+// version of its key before it, which is deleted, as no read at or after the
+// entry needs it. A delete is deleted too, since reading before the first
+// version of a key reads nothing just the same. The floor follows the
+// entries gone through.
+func (db *BoltDatabase) collectVersions() (int, error) {
+	db.mu.RLock()
+	cutoff := uint64(time.Now().Add(-db.retention).UnixNano())
+	db.mu.RUnlock()
+
+	walked := 0
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		meta, versions, versionLog := tx.Bucket(metaBucket), tx.Bucket(versionsBucket), tx.Bucket(versionLogBucket)
+		floor := btoi(meta.Get(versionFloorKey))
+		cursor := meta.Get(versionGCCursorKey)
+		c, vc := versionLog.Cursor(), versions.Cursor()
+		k, _ := c.Seek(itob(floor))
+		if cursor != nil {
+			if k, _ = c.Seek(cursor); bytes.Equal(k, cursor) {
+				k, _ = c.Next()
+			}
+		}
+		var doomed [][]byte
+		for ; k != nil && walked < versionGCBatch; k, _ = c.Next() {
+			ts, key := btoi(k[:8]), k[8:]
+			deleted, writtenAt, _, _ := decodeVersion(versions.Get(versionKey(key, ts)))
+			if writtenAt > cutoff {
+				break
+			}
+			if prev, _ := versionBefore(vc, key, ts); prev != nil {
+				doomed = append(doomed, copyValueIntoSlice(prev))
+			}
+			if deleted {
+				doomed = append(doomed, versionKey(key, ts))
+			}
+			floor, cursor = ts, copyValueIntoSlice(k)
+			walked++
+		}
+
+		for _, k := range doomed {
+			_, key, ts := splitVersionKey(k)
+			if err := versions.Delete(k); err != nil {
+				return err
+			}
+			if err := versionLog.Delete(versionLogKey(ts, key)); err != nil {
+				return err
+			}
+		}
+		if cursor != nil {
+			if err := meta.Put(versionGCCursorKey, cursor); err != nil {
+				return err
+			}
+		}
+		return meta.Put(versionFloorKey, itob(floor))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return walked, nil
+}
+
+// sweepExpired deletes up to sweepBatch keys whose TTL has passed and
+// returns how many it deleted. Only the master sweeps, and the deletes go
+// through the change log like any other, so that replicas drop the keys
+// too. Replicas hide expired keys on their own until then. Keys locked by a
+// prepared transaction are left to its commit or abort, and swept after.
+func (db *BoltDatabase) sweepExpired() (int, error) {
+	if db.isReplica() {
+		return 0, nil
+	}
+	swept := 0
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		now := unixNow()
+		var keys [][]byte
+		c := tx.Bucket(expiryIndexBucket).Cursor()
+		for k, _ := c.First(); k != nil && len(keys) < sweepBatch && btoi(k[:8]) <= now; k, _ = c.Next() {
+			if checkUnlocked(tx, string(k[8:])) != nil {
+				continue
+			}
+			keys = append(keys, copyValueIntoSlice(k[8:]))
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		ts, err := nextVersion(tx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := putChange(tx, ts, Change{Key: string(key), Deleted: true}); err != nil {
+				return err
+			}
+			if err := db.appendChange(tx, key, nil, true, 0); err != nil {
+				return err
+			}
+		}
+		swept = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if swept > 0 {
+		db.notifier.notify()
+	}
+	return swept, nil
+}
+
+func (db *BoltDatabase) sweep(stop <-chan struct{}) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	gcTicker := time.NewTicker(versionGCInterval)
+	defer gcTicker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for {
+				swept, err := db.sweepExpired()
+				if err != nil {
+					log.Printf("sweeping expired keys failed: %v", err)
+				}
+				if err != nil || swept < sweepBatch {
+					break
+				}
+			}
+		case <-gcTicker.C:
+			if err := db.sweepCommitted(); err != nil {
+				log.Printf("forgetting old commits failed: %v", err)
+			}
+			for {
+				walked, err := db.collectVersions()
+				if err != nil {
+					log.Printf("collecting old versions failed: %v", err)
+				}
+				if err != nil || walked < versionGCBatch {
+					break
+				}
+			}
+		}
+	}
+}
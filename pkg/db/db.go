@@ -1,14 +1,380 @@
 package db
 
-import "fmt"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
 
 type Database interface {
 	PutKey(key string, value []byte) error
 	PutKeyReplica(key string, value []byte) error
 	GetKey(key string) ([]byte, error)
+	// GetBatch returns the values of keys from a single read transaction,
+	// nil for the keys that do not exist.
+	GetBatch(keys []string) ([][]byte, error)
+	// PutBatch writes and deletes keys in a single transaction.
+	PutBatch(changes []Change) error
+	// GetExpiry returns when key expires, or 0 if it does not.
+	GetExpiry(key string) (uint64, error)
+	// PutIf writes or deletes the key of change only if it meets cond, which
+	// is checked in the same transaction as the write.
+	PutIf(change Change, cond Condition) error
+	// Add adds delta to the integer value of key in a single transaction and
+	// returns the change it wrote along with the new value. A key that does
+	// not exist counts from 0 and expires at expiresAt, while an existing key
+	// keeps its expiry.
+	Add(key string, delta int64, expiresAt uint64) (Change, int64, error)
+	// Transact checks the conditions of txn, reads its keys and applies its
+	// writes in a single transaction. The reads see the keys as they were
+	// before the writes, nil for the keys that do not exist, and nothing is
+	// written unless every condition holds.
+	Transact(txn Txn) ([][]byte, error)
+	// Prepare is the first phase of a transaction that spans shards. It
+	// checks the conditions of txn, locks its keys and durably records it
+	// under id, all in a single transaction, and returns what it read. Other
+	// writes to the locked keys fail with ErrLocked until the transaction is
+	// committed or aborted. Preparing id again returns its reads again.
+	Prepare(id string, txn Txn) ([][]byte, error)
+	// CommitPrepared applies the writes of the transaction prepared under id
+	// and releases its locks. AbortPrepared only releases them and leaves an
+	// id that is not prepared alone. A commit is remembered for
+	// committedRetention, during which committing id again succeeds, and
+	// committing any other id that is not prepared fails with
+	// ErrNotPrepared. Prepared transactions and remembered commits are
+	// replicated and snapshotted along with the keys.
+	CommitPrepared(id string) error
+	AbortPrepared(id string) error
+	// Prepared returns the transactions that are prepared but not decided.
+	Prepared() (map[string]Txn, error)
+	DeleteKey(key string) error
+	DeleteKeyReplica(key string) error
 	DeleteBulkKeys(deleteKey func(string) bool) error
-	GetKeyForReplication() (keyCopy, valueCopy []byte, err error)
-	DeleteReplicationKey(key, value []byte) (err error)
+	SetReplicas(replicas []string) error
+	SetReplicaMode(replica bool)
+	GetMeta(key string) ([]byte, error)
+	PutMeta(key string, value []byte) error
+	DeleteMeta(key string) error
+	// ForEachMeta calls fn for every meta key that begins with prefix, in
+	// order. The value is only valid until fn returns.
+	ForEachMeta(prefix string, fn func(key string, value []byte) error) error
+	// GetChanges returns the changes from the sequence from on for replica,
+	// at most limit of them, or all of them for a limit of 0, and records
+	// that replica has every change before from.
+	GetChanges(replica string, from uint64, limit int) ([]Change, error)
+	WaitForChanges() <-chan struct{}
+	WaitForAcks() <-chan struct{}
+	LastSequence() (uint64, error)
+	AckedSequences() (map[string]uint64, error)
+	ApplyChanges(changes []Change) error
+	LastAppliedSequence() (uint64, error)
+	SetAppliedSequence(seq uint64) error
+	Snapshot(replica string, fn func(key string, value []byte, expiresAt uint64) error) (seq uint64, err error)
+	ResetReplica() error
+	LoadSnapshot(entries []Change) error
+	// Dump pins the keys, prepared transactions and remembered commits as of
+	// now, for a copy that is written out while writes go on. It hands them
+	// out the way Snapshot does, which LoadSnapshot takes back.
+	Dump() (Dump, error)
+	ForEach(fn func(key string, value []byte, expiresAt uint64) error) error
+	// Scan returns the keys from start up to but not including end that begin
+	// with prefix, in order and at most limit of them. An empty end has no
+	// upper bound and a limit of 0 has no limit.
+	Scan(start, end, prefix string, limit int) ([]KeyValue, error)
+	// GetAt returns the value key had at the read timestamp ts, nil if it did
+	// not exist, along with the timestamp it was read at. A ts of 0 reads at
+	// the latest timestamp, and reading again at the timestamp returned sees
+	// the same value for as long as the versions are retained.
+	GetAt(key string, ts uint64) ([]byte, uint64, error)
+	// ScanAt is Scan at the read timestamp ts, or at the latest one for 0,
+	// and returns the timestamp it was read at.
+	ScanAt(start, end, prefix string, limit int, ts uint64) ([]KeyValue, uint64, error)
+	// ChangesSince returns the changes to the keys that begin with prefix
+	// written after the timestamp from, in timestamp order with Sequence set
+	// to their timestamp. It stops after about limit changes, never in the
+	// middle of a timestamp, or returns all of them for a limit of 0. It also
+	// returns the timestamp to continue from, which is the latest one once
+	// every change has been returned.
+	ChangesSince(prefix string, from uint64, limit int) ([]Change, uint64, error)
+	// SetVersionRetention sets how long a version stays readable after it is
+	// overwritten or deleted. Older versions are garbage collected in the
+	// background, and reading at a timestamp before them fails with
+	// ErrSnapshotTooOld.
+	SetVersionRetention(retention time.Duration)
+}
+
+// Dump is a copy of a db as of when it was taken, read from a single read
+// transaction that is held until Close.
+type Dump interface {
+	// ForEach calls fn for every entry of the dump. The value is only valid
+	// until fn returns.
+	ForEach(fn func(key string, value []byte, expiresAt uint64) error) error
+	Close() error
+}
+
+// ReservedPrefix begins the keys the nodes keep for themselves, such as the
+// bookkeeping of Badger and the leases of the api, which clients cannot use.
+const ReservedPrefix = "\x00kv"
+
+// ErrReservedKey is returned for a key of ReservedPrefix that the store keeps
+// for itself.
+var ErrReservedKey = errors.New("key is reserved")
+
+// ErrHistoryTruncated is returned when a replica asks for changes that are no
+// longer retained, the replica has to start over from a snapshot.
+var ErrHistoryTruncated = errors.New("requested changes are no longer retained")
+
+// ErrReplicaAhead is returned when a replica asks for changes past the end of
+// the log, which happens when it applied writes of a previous master that
+// never made it to the current one.
+var ErrReplicaAhead = errors.New("replica is ahead of the master")
+
+// ErrReadOnly is returned for writes to a replica, which only the master of
+// the shard may write to.
+var ErrReadOnly = errors.New("replicas only allow read operations")
+
+// ErrKeyExists is returned by a conditional write that requires its key to
+// be absent.
+var ErrKeyExists = errors.New("key already exists")
+
+// ErrVersionMismatch is returned by a conditional write whose key is missing
+// or at another version than the one it requires.
+var ErrVersionMismatch = errors.New("key is not at the expected version")
+
+// ErrNotInteger is returned by Add for a key whose value is not an integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+// ErrOverflow is returned by Add when the new value would not fit in 64 bits.
+var ErrOverflow = errors.New("value would overflow")
+
+// ErrLocked is returned for a write to a key that a prepared transaction
+// holds a lock on.
+var ErrLocked = errors.New("key is locked by a prepared transaction")
+
+// ErrNotPrepared is returned for a commit of a transaction that is neither
+// prepared nor committed, which a master lost to a failover would otherwise
+// acknowledge without applying anything.
+var ErrNotPrepared = errors.New("transaction is not prepared")
+
+// committedRetention is how long a commit is remembered, during which its
+// coordinator can deliver it again.
+const committedRetention = 24 * time.Hour
+
+// ErrSnapshotTooOld is returned for a read at a timestamp whose versions are
+// no longer retained.
+var ErrSnapshotTooOld = errors.New("versions at the read timestamp are no longer retained")
+
+// ErrSnapshotAhead is returned for a read at a timestamp past the latest
+// write, which later writes could still change.
+var ErrSnapshotAhead = errors.New("read timestamp is ahead of the database")
+
+// How often the versions past their retention are garbage collected.
+const versionGCInterval = 10 * time.Second
+
+// Condition is what a conditional write requires of its key.
+type Condition struct {
+	// Absent requires that the key does not exist.
+	Absent bool
+	// Version, when set, requires that the key exists at this version.
+	Version string
+}
+
+// check returns why current, the value of the key or nil if it does not
+// exist, fails the condition.
+func (c Condition) check(current []byte) error {
+	if c.Absent && current != nil {
+		return ErrKeyExists
+	}
+	if c.Version != "" && (current == nil || Version(current) != c.Version) {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// Version returns the version of a stored value, which conditional writes
+// compare against. It is a digest of the value, so that every node and
+// backend agrees on it without keeping any state, and a key that is written
+// back to an earlier value is at the earlier version again.
+func Version(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:8])
+}
+
+// counterContentType is the content type of a counter that Add created.
+const counterContentType = "text/plain"
+
+// addCounter adds delta to current, the stored value of a counter or nil if
+// it does not exist, and returns the value to store and the new count. The
+// count is kept as a decimal in a record, so that it reads back like any
+// other value and keeps the content type it was written with.
+func addCounter(current []byte, delta int64) ([]byte, int64, error) {
+	rec := Record{ContentType: counterContentType}
+	var n int64
+	if current != nil {
+		var err error
+		if rec, err = DecodeRecord(current); err != nil {
+			return nil, 0, err
+		}
+		if n, err = strconv.ParseInt(string(rec.Value), 10, 64); err != nil {
+			return nil, 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return nil, 0, ErrOverflow
+	}
+	n += delta
+	rec.Value = strconv.AppendInt(nil, n, 10)
+	return EncodeRecord(rec), n, nil
+}
+
+// KeyCondition is a condition on a single key of a transaction.
+type KeyCondition struct {
+	Key string
+	Condition
+}
+
+// Txn is a set of conditions, reads and writes that Transact runs together.
+type Txn struct {
+	Conditions []KeyCondition `json:",omitempty"`
+	Reads      []string       `json:",omitempty"`
+	Writes     []Change       `json:",omitempty"`
+}
+
+// check returns why the transaction fails its conditions, given get to read
+// the current value of a key.
+func (txn Txn) check(get func(key string) ([]byte, error)) error {
+	for _, c := range txn.Conditions {
+		current, err := get(c.Key)
+		if err != nil {
+			return err
+		}
+		if err := c.check(current); err != nil {
+			return fmt.Errorf("key %q: %w", c.Key, err)
+		}
+	}
+	return nil
+}
+
+// preparedKey holds the transaction prepared under id in the change log and
+// snapshots, and in Badger itself, until it is decided. committedKey holds
+// the commit of id the same way, expiring once it is no longer remembered.
+func preparedKey(id string) []byte {
+	return append(append([]byte{}, internalKeyPrefix...), "prepared/"+id...)
+}
+
+func committedKey(id string) []byte {
+	return append(append([]byte{}, internalKeyPrefix...), "committed/"+id...)
+}
+
+// decisionID returns the id of a change to preparedKey or committedKey, and
+// whether it is one.
+func decisionID(key []byte) (id string, prepared bool, ok bool) {
+	if bytes.HasPrefix(key, preparedKey("")) {
+		return string(key[len(preparedKey("")):]), true, true
+	}
+	if bytes.HasPrefix(key, committedKey("")) {
+		return string(key[len(committedKey("")):]), false, true
+	}
+	return "", false, false
+}
+
+// keys returns every key the transaction touches, which Prepare locks.
+func (txn Txn) keys() []string {
+	keys := make([]string, 0, len(txn.Conditions)+len(txn.Reads)+len(txn.Writes))
+	for _, c := range txn.Conditions {
+		keys = append(keys, c.Key)
+	}
+	keys = append(keys, txn.Reads...)
+	for _, change := range txn.Writes {
+		keys = append(keys, change.Key)
+	}
+	return keys
+}
+
+type Change struct {
+	Sequence uint64
+	Key      string
+	Value    []byte
+	Deleted  bool
+	// ExpiresAt is when the key expires in unix seconds, or 0 if it does not.
+	// It is absolute so that replicas drop the key at the same time.
+	ExpiresAt uint64
+}
+
+// KeyValue is a key and its value as returned by Scan.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// scanFrom returns where a scan starts, the later of start and prefix since
+// every key before prefix sorts outside of it.
+func scanFrom(start, prefix string) []byte {
+	if prefix > start {
+		return []byte(prefix)
+	}
+	return []byte(start)
+}
+
+// scanDone reports whether key is past the end of a scan.
+func scanDone(key []byte, end, prefix string) bool {
+	return (end != "" && string(key) >= end) || !bytes.HasPrefix(key, []byte(prefix))
+}
+
+// notifier lets readers of the change log block until the next write.
+type notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// Lookup reads key and reports whether it exists, which the backends tell
+// apart differently: Bolt returns no value and Badger returns
+// badger.ErrKeyNotFound.
+func Lookup(database Database, key string) (value []byte, found bool, err error) {
+	value, err = database.GetKey(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, value != nil, nil
+}
+
+// ForEachValue returns the ForEach of database for callers that have no use
+// for expiries, such as building merkle trees.
+func ForEachValue(database Database) func(fn func(key string, value []byte) error) error {
+	return func(fn func(key string, value []byte) error) error {
+		return database.ForEach(func(key string, value []byte, _ uint64) error {
+			return fn(key, value)
+		})
+	}
 }
 
 func NewDatabase(dbPath string, dbType string, replica bool) (db Database, closeFunc func() error, err error) {
@@ -16,7 +382,7 @@ func NewDatabase(dbPath string, dbType string, replica bool) (db Database, close
 		return NewBoltDatabase(dbPath, replica)
 	}
 	if dbType == "badger" {
-		return NewBadgerDatabase(dbPath)
+		return NewBadgerDatabase(dbPath, replica)
 	}
 	return nil, nil, fmt.Errorf("Invalid dbType")
 }
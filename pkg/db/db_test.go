@@ -2,9 +2,20 @@ package db
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dgraph-io/badger/v3"
 )
 
 func TestNewDataBase(t *testing.T) {
@@ -209,3 +220,1439 @@ func TestDeleteBulkKeys(t *testing.T) {
 		t.Error("Unexpected error with deleting the file: %w", err)
 	}
 }
+
+func TestDeleteKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	db, closeFunc, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeFunc()
+
+	if err := db.SetReplicas([]string{"replica-1"}); err != nil {
+		t.Fatalf("Unexpected error with SetReplicas: %v", err)
+	}
+	if err := db.PutKey("key-1", []byte("value-1")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+
+	// test deleting the key
+	if err := db.DeleteKey("key-1"); err != nil {
+		t.Fatalf("Unexpected error with DeleteKey: %v", err)
+	}
+	val, err := db.GetKey("key-1")
+	if err != nil {
+		t.Fatalf("Unexpected error with GetKey: %v", err)
+	}
+	if val != nil {
+		t.Errorf("Unexpected value after delete. Got: %v Expected: nil", val)
+	}
+
+	// test that a tombstone is queued for the replicas after the put
+	changes, err := db.GetChanges("replica-1", 2, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Key != "key-1" || !changes[0].Deleted {
+		t.Errorf("Unexpected replication entries. Got: %+v", changes)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestDeleteKeyReadOnly(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	dbReadOnly, closeFunc, err := NewBoltDatabase(f.Name(), true)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeFunc()
+
+	if err := dbReadOnly.PutKeyReplica("a", []byte("b")); err != nil {
+		t.Fatalf("Unexpected error with PutKeyReplica: %v", err)
+	}
+
+	// test invalid Delete
+	if err := dbReadOnly.DeleteKey("a"); err == nil {
+		t.Fatalf("Expected error from deleting on a readonly")
+	}
+
+	// test delete on default bucket
+	if err := dbReadOnly.DeleteKeyReplica("a"); err != nil {
+		t.Fatalf("Unexpected error with DeleteKeyReplica: %v", err)
+	}
+	val, err := dbReadOnly.GetKey("a")
+	if err != nil {
+		t.Fatalf("Unexpected error with GetKey: %v", err)
+	}
+	if val != nil {
+		t.Errorf("Unexpected value after delete. Got: %v Expected: nil", val)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestDeleteBulkKeysReplicated(t *testing.T) {
+	db, closeFunc, err := NewBoltDatabase(filepath.Join(t.TempDir(), "db"), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeFunc()
+
+	if err := db.SetReplicas([]string{"replica-1"}); err != nil {
+		t.Fatalf("Unexpected error with SetReplicas: %v", err)
+	}
+	for _, key := range []string{"key-1", "key-2"} {
+		if err := db.PutKey(key, []byte("value")); err != nil {
+			t.Fatalf("Unexpected error with PutKey: %v", err)
+		}
+	}
+	if err := db.DeleteBulkKeys(func(key string) bool { return key == "key-2" }); err != nil {
+		t.Fatalf("Unexpected error with DeleteBulkKeys: %v", err)
+	}
+
+	// test that the replicas are sent the deletes
+	changes, err := db.GetChanges("replica-1", 1, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 3 || changes[2].Key != "key-2" || !changes[2].Deleted {
+		t.Fatalf("Expected the delete of key-2 in the change log, got: %+v", changes)
+	}
+}
+
+func TestGetChanges(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	db, closeFunc, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeFunc()
+
+	if err := db.SetReplicas([]string{"replica-1", "replica-2"}); err != nil {
+		t.Fatalf("Unexpected error with SetReplicas: %v", err)
+	}
+	if err := db.PutKey("key-1", []byte("value-1")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	if err := db.PutKey("key-1", []byte("value-2")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	if err := db.PutKey("key-2", []byte("value-3")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+
+	// test that unknown replicas are rejected
+	if _, err := db.GetChanges("replica-3", 1, 10); err == nil {
+		t.Fatalf("Expected error for a replica that is not configured")
+	}
+
+	// test that batches come back in sequence order
+	changes, err := db.GetChanges("replica-1", 1, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Sequence != 1 || string(changes[1].Value) != "value-2" {
+		t.Fatalf("Unexpected first batch. Got: %+v", changes)
+	}
+	changes, err = db.GetChanges("replica-1", 3, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Sequence != 3 || changes[0].Key != "key-2" {
+		t.Fatalf("Unexpected second batch. Got: %+v", changes)
+	}
+
+	// test that a replica cannot be ahead of the master
+	if _, err := db.GetChanges("replica-1", 5, 2); err == nil {
+		t.Fatalf("Expected error for a sequence that has not been written")
+	}
+
+	// test that the second replica still sees every write
+	changes, err = db.GetChanges("replica-2", 1, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("Unexpected number of changes for replica-2. Got: %+v", changes)
+	}
+
+	// test that the log is collected once every replica acknowledged it
+	if _, err := db.GetChanges("replica-1", 4, 10); err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if _, err := db.GetChanges("replica-2", 4, 10); err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	var entries int
+	db.db.View(func(tx *bolt.Tx) error {
+		entries = tx.Bucket(changeLogBucket).Stats().KeyN
+		return nil
+	})
+	if entries != 0 {
+		t.Errorf("Expected the change log to be empty, got %d entries", entries)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		if err := db.PutKey("key-1", []byte("value-1")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		changes := []Change{
+			{Key: "key-1", Deleted: true},
+			{Key: "key-2", Value: []byte("value-2")},
+			{Key: "key-3", Value: []byte{}},
+		}
+		if err := db.PutBatch(changes); err != nil {
+			t.Fatalf("%s: Unexpected error with PutBatch: %v", name, err)
+		}
+
+		values, err := db.GetBatch([]string{"key-1", "key-2", "key-3", "key-4"})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with GetBatch: %v", name, err)
+		}
+		if values[0] != nil || values[3] != nil {
+			t.Errorf("%s: Unexpected values for missing keys. Got: %v %v Expected: nil", name, values[0], values[3])
+		}
+		if !bytes.Equal(values[1], []byte("value-2")) {
+			t.Errorf("%s: Unexpected value. Got: %v Expected: %v", name, values[1], []byte("value-2"))
+		}
+		if values[2] == nil || len(values[2]) != 0 {
+			t.Errorf("%s: Unexpected value for empty key. Got: %v Expected: []", name, values[2])
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	tests := []struct {
+		start, end, prefix string
+		limit              int
+		expected           []string
+	}{
+		{"", "", "", 0, []string{"a", "b/1", "b/2", "b/3", "c"}},
+		{"", "", "b/", 0, []string{"b/1", "b/2", "b/3"}},
+		{"b/2", "", "b/", 0, []string{"b/2", "b/3"}},
+		{"", "b/3", "b/", 0, []string{"b/1", "b/2"}},
+		{"a", "", "", 2, []string{"a", "b/1"}},
+		{"c\x00", "", "", 0, nil},
+	}
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		// a meta key must not show up in a scan of badger
+		if err := db.PutMeta("layout", []byte("meta")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutMeta: %v", name, err)
+		}
+		for _, key := range []string{"c", "b/2", "a", "b/1", "b/3"} {
+			if err := db.PutKey(key, []byte("value-"+key)); err != nil {
+				t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+			}
+		}
+
+		for _, test := range tests {
+			kvs, err := db.Scan(test.start, test.end, test.prefix, test.limit)
+			if err != nil {
+				t.Fatalf("%s: Unexpected error with Scan: %v", name, err)
+			}
+			var keys []string
+			for _, kv := range kvs {
+				keys = append(keys, kv.Key)
+				if !bytes.Equal(kv.Value, []byte("value-"+kv.Key)) {
+					t.Errorf("%s: Unexpected value for %s. Got: %s", name, kv.Key, kv.Value)
+				}
+			}
+			if !reflect.DeepEqual(keys, test.expected) {
+				t.Errorf("%s: Unexpected keys for %+v. Got: %q Expected: %q", name, test, keys, test.expected)
+			}
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	boltDB, closeBolt, err := NewBoltDatabase(filepath.Join(t.TempDir(), "db"), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		for _, key := range []string{"txn/b", "layout", "txn/a", "txn/c"} {
+			if err := db.PutMeta(key, []byte("value-"+key)); err != nil {
+				t.Fatalf("%s: Unexpected error with PutMeta: %v", name, err)
+			}
+		}
+		if err := db.DeleteMeta("txn/b"); err != nil {
+			t.Fatalf("%s: Unexpected error with DeleteMeta: %v", name, err)
+		}
+		if value, err := db.GetMeta("txn/b"); err != nil || value != nil {
+			t.Errorf("%s: Unexpected deleted meta key. Got: %q %v", name, value, err)
+		}
+
+		var keys []string
+		err := db.ForEachMeta("txn/", func(key string, value []byte) error {
+			if string(value) != "value-"+key {
+				t.Errorf("%s: Unexpected value for %s. Got: %s", name, key, value)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with ForEachMeta: %v", name, err)
+		}
+		if !reflect.DeepEqual(keys, []string{"txn/a", "txn/c"}) {
+			t.Errorf("%s: Unexpected meta keys. Got: %q Expected: %q", name, keys, []string{"txn/a", "txn/c"})
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	now := uint64(time.Now().Unix())
+	later := now + 3600
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		if err := db.SetReplicas([]string{"replica-1"}); err != nil {
+			t.Fatalf("%s: Unexpected error with SetReplicas: %v", name, err)
+		}
+		changes := []Change{
+			{Key: "expired", Value: []byte("value"), ExpiresAt: now - 1},
+			{Key: "expiring", Value: []byte("value"), ExpiresAt: later},
+			{Key: "renewed", Value: []byte("value"), ExpiresAt: now - 1},
+		}
+		if err := db.PutBatch(changes); err != nil {
+			t.Fatalf("%s: Unexpected error with PutBatch: %v", name, err)
+		}
+		// a plain put drops the ttl
+		if err := db.PutKey("renewed", []byte("value")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+
+		if _, found, err := Lookup(db, "expired"); err != nil || found {
+			t.Errorf("%s: Unexpected lookup of expired key. Got: %v %v Expected: not found", name, found, err)
+		}
+		for key, expected := range map[string]uint64{"expiring": later, "renewed": 0} {
+			if _, found, err := Lookup(db, key); err != nil || !found {
+				t.Errorf("%s: Unexpected lookup of %s. Got: %v %v Expected: found", name, key, found, err)
+			}
+			expiresAt, err := db.GetExpiry(key)
+			if err != nil {
+				t.Fatalf("%s: Unexpected error with GetExpiry: %v", name, err)
+			}
+			if expiresAt != expected {
+				t.Errorf("%s: Unexpected expiry of %s. Got: %d Expected: %d", name, key, expiresAt, expected)
+			}
+		}
+
+		var keys []string
+		err := db.ForEach(func(key string, value []byte, expiresAt uint64) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with ForEach: %v", name, err)
+		}
+		if !reflect.DeepEqual(keys, []string{"expiring", "renewed"}) {
+			t.Errorf("%s: Unexpected keys. Got: %q Expected: %q", name, keys, []string{"expiring", "renewed"})
+		}
+
+		// test that the expiry is shipped to replicas
+		replicated, err := db.GetChanges("replica-1", 1, 10)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with GetChanges: %v", name, err)
+		}
+		found := false
+		for _, change := range replicated {
+			if change.Key == "expiring" {
+				found = true
+				if change.ExpiresAt != later {
+					t.Errorf("%s: Unexpected replicated expiry. Got: %d Expected: %d", name, change.ExpiresAt, later)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: Expiring key was not replicated. Got: %+v", name, replicated)
+		}
+	}
+
+	// test that the sweeper leaves an expired key locked by a transaction
+	if err := boltDB.PutBatch([]Change{{Key: "locked", Value: []byte("value"), ExpiresAt: now - 1}}); err != nil {
+		t.Fatalf("Unexpected error with PutBatch: %v", err)
+	}
+	if _, err := boltDB.Prepare("txn-1", Txn{Writes: []Change{{Key: "locked", Value: []byte("other")}}}); err != nil {
+		t.Fatalf("Unexpected error with Prepare: %v", err)
+	}
+
+	// test that the sweeper deletes the expired key and queues a tombstone
+	seq, err := boltDB.LastSequence()
+	if err != nil {
+		t.Fatalf("Unexpected error with LastSequence: %v", err)
+	}
+	swept, err := boltDB.sweepExpired()
+	if err != nil {
+		t.Fatalf("Unexpected error with sweepExpired: %v", err)
+	}
+	if swept != 1 {
+		t.Errorf("Unexpected number of swept keys. Got: %d Expected: 1", swept)
+	}
+	changes, err := boltDB.GetChanges("replica-1", seq+1, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Key != "expired" || !changes[0].Deleted {
+		t.Errorf("Unexpected replication entries. Got: %+v", changes)
+	}
+
+	// test that the locked key is swept once the transaction lets go of it
+	if err := boltDB.AbortPrepared("txn-1"); err != nil {
+		t.Fatalf("Unexpected error with AbortPrepared: %v", err)
+	}
+	if swept, err := boltDB.sweepExpired(); err != nil || swept != 1 {
+		t.Errorf("Unexpected result of sweeping after the abort. Got: %d %v Expected: 1", swept, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestPutIf(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		put := Change{Key: "key", Value: []byte("value-1")}
+		if err := db.PutIf(put, Condition{Absent: true}); err != nil {
+			t.Fatalf("%s: Unexpected error with PutIf absent: %v", name, err)
+		}
+		if err := db.PutIf(put, Condition{Absent: true}); !errors.Is(err, ErrKeyExists) {
+			t.Errorf("%s: Unexpected error with PutIf on an existing key. Got: %v Expected: %v", name, err, ErrKeyExists)
+		}
+
+		version := Version([]byte("value-1"))
+		update := Change{Key: "key", Value: []byte("value-2")}
+		if err := db.PutIf(update, Condition{Version: Version([]byte("other"))}); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("%s: Unexpected error with PutIf on another version. Got: %v Expected: %v", name, err, ErrVersionMismatch)
+		}
+		if err := db.PutIf(update, Condition{Version: version}); err != nil {
+			t.Fatalf("%s: Unexpected error with PutIf on the version: %v", name, err)
+		}
+		value, err := db.GetKey("key")
+		if err != nil || !bytes.Equal(value, []byte("value-2")) {
+			t.Errorf("%s: Unexpected value. Got: %v %v Expected: %v", name, value, err, []byte("value-2"))
+		}
+
+		remove := Change{Key: "key", Deleted: true}
+		if err := db.PutIf(remove, Condition{Version: version}); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("%s: Unexpected error with deleting an old version. Got: %v Expected: %v", name, err, ErrVersionMismatch)
+		}
+		if err := db.PutIf(remove, Condition{Version: Version([]byte("value-2"))}); err != nil {
+			t.Fatalf("%s: Unexpected error with deleting the version: %v", name, err)
+		}
+		if _, found, err := Lookup(db, "key"); err != nil || found {
+			t.Errorf("%s: Unexpected key after delete. Got: %v %v Expected: not found", name, found, err)
+		}
+		if err := db.PutIf(update, Condition{Version: version}); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("%s: Unexpected error with PutIf on a missing key. Got: %v Expected: %v", name, err, ErrVersionMismatch)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, _, err := db.Add("counter", 5, 0); err != nil {
+					t.Errorf("%s: Unexpected error with Add: %v", name, err)
+				}
+			}()
+		}
+		wg.Wait()
+		change, n, err := db.Add("counter", -1, 0)
+		if err != nil || n != 99 {
+			t.Errorf("%s: Unexpected count. Got: %v %v Expected: 99", name, n, err)
+		}
+		value, err := db.GetKey("counter")
+		if err != nil || !bytes.Equal(value, change.Value) {
+			t.Errorf("%s: Unexpected value. Got: %v %v Expected: %v", name, value, err, change.Value)
+		}
+		rec, err := DecodeRecord(value)
+		if err != nil || string(rec.Value) != "99" {
+			t.Errorf("%s: Unexpected record. Got: %q %v Expected: 99", name, rec.Value, err)
+		}
+
+		if err := db.PutKey("text", []byte("value")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		if _, _, err := db.Add("text", 1, 0); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("%s: Unexpected error with Add on text. Got: %v Expected: %v", name, err, ErrNotInteger)
+		}
+		if err := db.PutKey("max", []byte(strconv.FormatInt(math.MaxInt64, 10))); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		if _, _, err := db.Add("max", 1, 0); !errors.Is(err, ErrOverflow) {
+			t.Errorf("%s: Unexpected error with Add past the maximum. Got: %v Expected: %v", name, err, ErrOverflow)
+		}
+
+		expiresAt := uint64(time.Now().Add(time.Hour).Unix())
+		if _, _, err := db.Add("window", 1, expiresAt); err != nil {
+			t.Fatalf("%s: Unexpected error with Add: %v", name, err)
+		}
+		if _, _, err := db.Add("window", 1, expiresAt+60); err != nil {
+			t.Fatalf("%s: Unexpected error with Add: %v", name, err)
+		}
+		if got, err := db.GetExpiry("window"); err != nil || got != expiresAt {
+			t.Errorf("%s: Unexpected expiry. Got: %v %v Expected: %v", name, got, err, expiresAt)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestTransact(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		if err := db.PutKey("index", []byte("order-1")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		txn := Txn{
+			Conditions: []KeyCondition{
+				{Key: "order-2", Condition: Condition{Absent: true}},
+				{Key: "index", Condition: Condition{Version: Version([]byte("order-1"))}},
+			},
+			Reads: []string{"index", "order-2"},
+			Writes: []Change{
+				{Key: "order-2", Value: []byte("pending")},
+				{Key: "index", Value: []byte("order-1,order-2")},
+			},
+		}
+		values, err := db.Transact(txn)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with Transact: %v", name, err)
+		}
+		if !reflect.DeepEqual(values, [][]byte{[]byte("order-1"), nil}) {
+			t.Errorf("%s: Unexpected reads. Got: %q Expected: the values before the writes", name, values)
+		}
+		got, err := db.GetBatch([]string{"order-2", "index"})
+		if err != nil || !reflect.DeepEqual(got, [][]byte{[]byte("pending"), []byte("order-1,order-2")}) {
+			t.Errorf("%s: Unexpected values after Transact. Got: %q %v", name, got, err)
+		}
+
+		// the index has moved on, so neither write may be applied
+		txn.Conditions[0] = KeyCondition{Key: "order-3", Condition: Condition{Absent: true}}
+		txn.Writes = []Change{
+			{Key: "order-3", Value: []byte("pending")},
+			{Key: "index", Value: []byte("order-1,order-3")},
+		}
+		if _, err := db.Transact(txn); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("%s: Unexpected error with a failed condition. Got: %v Expected: %v", name, err, ErrVersionMismatch)
+		}
+		got, err = db.GetBatch([]string{"order-3", "index"})
+		if err != nil || !reflect.DeepEqual(got, [][]byte{nil, []byte("order-1,order-2")}) {
+			t.Errorf("%s: Unexpected values after a failed Transact. Got: %q %v", name, got, err)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+	badgerDir := t.TempDir()
+
+	open := map[string]func() (Database, func() error, error){
+		"bolt": func() (Database, func() error, error) {
+			return NewBoltDatabase(f.Name(), false)
+		},
+		"badger": func() (Database, func() error, error) {
+			return openBadgerDatabase(badgerDir, false)
+		},
+	}
+	for name, open := range open {
+		db, closeFunc, err := open()
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with opening the db: %v", name, err)
+		}
+		if err := db.PutKey("stock", []byte("1")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		txn := Txn{
+			Conditions: []KeyCondition{{Key: "stock", Condition: Condition{Version: Version([]byte("1"))}}},
+			Reads:      []string{"stock"},
+			Writes:     []Change{{Key: "stock", Value: []byte("0")}, {Key: "order", Value: []byte("placed")}},
+		}
+		values, err := db.Prepare("txn-1", txn)
+		if err != nil || !reflect.DeepEqual(values, [][]byte{[]byte("1")}) {
+			t.Fatalf("%s: Unexpected result of Prepare. Got: %q %v Expected: [1]", name, values, err)
+		}
+		if values, err := db.Prepare("txn-1", txn); err != nil || len(values) != 1 {
+			t.Errorf("%s: Unexpected result of preparing again. Got: %q %v", name, values, err)
+		}
+		if err := db.PutKey("order", []byte("other")); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: Unexpected error with a write to a locked key. Got: %v Expected: %v", name, err, ErrLocked)
+		}
+		other := Txn{Writes: []Change{{Key: "stock", Value: []byte("5")}}}
+		if _, err := db.Prepare("txn-2", other); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: Unexpected error with preparing a locked key. Got: %v Expected: %v", name, err, ErrLocked)
+		}
+
+		// the prepared transaction and its locks outlive a restart
+		if err := closeFunc(); err != nil {
+			t.Fatalf("%s: Unexpected error with closing the db: %v", name, err)
+		}
+		db, closeFunc, err = open()
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with reopening the db: %v", name, err)
+		}
+		prepared, err := db.Prepared()
+		if err != nil || len(prepared) != 1 || len(prepared["txn-1"].Writes) != 2 {
+			t.Errorf("%s: Unexpected prepared transactions. Got: %v %v Expected: txn-1", name, prepared, err)
+		}
+		if err := db.DeleteKey("stock"); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: Unexpected error with a delete of a locked key. Got: %v Expected: %v", name, err, ErrLocked)
+		}
+		if err := db.DeleteBulkKeys(func(key string) bool { return key == "stock" }); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: Unexpected error with a bulk delete of a locked key. Got: %v Expected: %v", name, err, ErrLocked)
+		}
+
+		if err := db.CommitPrepared("txn-1"); err != nil {
+			t.Fatalf("%s: Unexpected error with CommitPrepared: %v", name, err)
+		}
+		got, err := db.GetBatch([]string{"stock", "order"})
+		if err != nil || !reflect.DeepEqual(got, [][]byte{[]byte("0"), []byte("placed")}) {
+			t.Errorf("%s: Unexpected values after commit. Got: %q %v", name, got, err)
+		}
+		if err := db.CommitPrepared("txn-1"); err != nil {
+			t.Errorf("%s: Unexpected error with committing again: %v", name, err)
+		}
+		if err := db.CommitPrepared("txn-unknown"); !errors.Is(err, ErrNotPrepared) {
+			t.Errorf("%s: Unexpected error with committing an unknown id. Got: %v Expected: %v", name, err, ErrNotPrepared)
+		}
+		if err := db.AbortPrepared("txn-unknown"); err != nil {
+			t.Errorf("%s: Unexpected error with aborting an unknown id: %v", name, err)
+		}
+
+		if _, err := db.Prepare("txn-2", other); err != nil {
+			t.Fatalf("%s: Unexpected error with Prepare: %v", name, err)
+		}
+		if err := db.AbortPrepared("txn-2"); err != nil {
+			t.Fatalf("%s: Unexpected error with AbortPrepared: %v", name, err)
+		}
+		if value, err := db.GetKey("stock"); err != nil || string(value) != "0" {
+			t.Errorf("%s: Unexpected value after abort. Got: %q %v Expected: 0", name, value, err)
+		}
+		if err := db.PutKey("stock", []byte("3")); err != nil {
+			t.Errorf("%s: Unexpected error with a write after the locks are released: %v", name, err)
+		}
+		if prepared, err := db.Prepared(); err != nil || len(prepared) != 0 {
+			t.Errorf("%s: Unexpected prepared transactions. Got: %v %v Expected: none", name, prepared, err)
+		}
+		closeFunc()
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+// TestPreparedReplication tests that a replica promoted after a failover
+// still holds the transactions its master prepared and remembers the ones it
+// committed, and has the locks of the ones it aborted released, whether it
+// streamed them or loaded them from a snapshot.
+func TestPreparedReplication(t *testing.T) {
+	dir := t.TempDir()
+	open := map[string]func(name string, replica bool) (Database, func() error, error){
+		"bolt": func(name string, replica bool) (Database, func() error, error) {
+			return NewBoltDatabase(filepath.Join(dir, name), replica)
+		},
+		"badger": func(name string, replica bool) (Database, func() error, error) {
+			return openBadgerDatabase(filepath.Join(dir, "badger-"+name), replica)
+		},
+	}
+	for name, open := range open {
+		master, closeMaster, err := open("master", false)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with opening the master: %v", name, err)
+		}
+		defer closeMaster()
+		streamed, closeStreamed, err := open("streamed", true)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with opening a replica: %v", name, err)
+		}
+		defer closeStreamed()
+		loaded, closeLoaded, err := open("loaded", true)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with opening a replica: %v", name, err)
+		}
+		defer closeLoaded()
+		if err := master.SetReplicas([]string{"streamed", "loaded"}); err != nil {
+			t.Fatalf("%s: Unexpected error with SetReplicas: %v", name, err)
+		}
+
+		write := Txn{Writes: []Change{{Key: "order", Value: []byte("placed")}}}
+		if _, err := master.Prepare("txn-1", write); err != nil {
+			t.Fatalf("%s: Unexpected error with Prepare: %v", name, err)
+		}
+		if _, err := master.Prepare("txn-2", Txn{Writes: []Change{{Key: "stock", Value: []byte("0")}}}); err != nil {
+			t.Fatalf("%s: Unexpected error with Prepare: %v", name, err)
+		}
+		if err := master.CommitPrepared("txn-2"); err != nil {
+			t.Fatalf("%s: Unexpected error with CommitPrepared: %v", name, err)
+		}
+		if _, err := master.Prepare("txn-3", Txn{Writes: []Change{{Key: "cart", Value: []byte("empty")}}}); err != nil {
+			t.Fatalf("%s: Unexpected error with Prepare: %v", name, err)
+		}
+		if err := master.AbortPrepared("txn-3"); err != nil {
+			t.Fatalf("%s: Unexpected error with AbortPrepared: %v", name, err)
+		}
+
+		changes, err := master.GetChanges("streamed", 1, 0)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with GetChanges: %v", name, err)
+		}
+		if err := streamed.ApplyChanges(changes); err != nil {
+			t.Fatalf("%s: Unexpected error with ApplyChanges: %v", name, err)
+		}
+		var entries []Change
+		_, err = master.Snapshot("loaded", func(key string, value []byte, expiresAt uint64) error {
+			entries = append(entries, Change{Key: key, Value: copyValueIntoSlice(value), ExpiresAt: expiresAt})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with Snapshot: %v", name, err)
+		}
+		if err := loaded.ResetReplica(); err != nil {
+			t.Fatalf("%s: Unexpected error with ResetReplica: %v", name, err)
+		}
+		if err := loaded.LoadSnapshot(entries); err != nil {
+			t.Fatalf("%s: Unexpected error with LoadSnapshot: %v", name, err)
+		}
+
+		for replicaName, replica := range map[string]Database{"streamed": streamed, "loaded": loaded} {
+			replica.SetReplicaMode(false)
+			prepared, err := replica.Prepared()
+			if err != nil || len(prepared) != 1 || !reflect.DeepEqual(prepared["txn-1"], write) {
+				t.Errorf("%s %s: Unexpected prepared transactions. Got: %+v %v Expected: txn-1", name, replicaName, prepared, err)
+			}
+			if err := replica.PutKey("order", []byte("other")); !errors.Is(err, ErrLocked) {
+				t.Errorf("%s %s: Unexpected error with a write to a locked key. Got: %v Expected: %v", name, replicaName, err, ErrLocked)
+			}
+			for _, key := range []string{"stock", "cart"} {
+				if err := replica.PutKey(key, []byte("1")); err != nil {
+					t.Errorf("%s %s: Unexpected error with a write to a key of a decided transaction: %v", name, replicaName, err)
+				}
+			}
+			if err := replica.CommitPrepared("txn-2"); err != nil {
+				t.Errorf("%s %s: Unexpected error with committing a committed transaction again: %v", name, replicaName, err)
+			}
+			if err := replica.CommitPrepared("txn-1"); err != nil {
+				t.Fatalf("%s %s: Unexpected error with CommitPrepared: %v", name, replicaName, err)
+			}
+			if value, err := replica.GetKey("order"); err != nil || string(value) != "placed" {
+				t.Errorf("%s %s: Unexpected value after commit. Got: %q %v Expected: placed", name, replicaName, value, err)
+			}
+		}
+
+	}
+}
+
+func TestDump(t *testing.T) {
+	dir := t.TempDir()
+	open := map[string]func() (Database, func() error, error){
+		"bolt": func() (Database, func() error, error) {
+			return NewBoltDatabase(filepath.Join(dir, "bolt"), false)
+		},
+		"badger": func() (Database, func() error, error) {
+			return openBadgerDatabase(filepath.Join(dir, "badger"), false)
+		},
+	}
+	for name, open := range open {
+		db, closeFunc, err := open()
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with opening the db: %v", name, err)
+		}
+		defer closeFunc()
+		if err := db.PutKey("key-1", []byte("value-1")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		if _, err := db.Prepare("txn-1", Txn{Writes: []Change{{Key: "key-2", Value: []byte("value-2")}}}); err != nil {
+			t.Fatalf("%s: Unexpected error with Prepare: %v", name, err)
+		}
+
+		dump, err := db.Dump()
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with Dump: %v", name, err)
+		}
+		// writes go on while the dump is open, and are left out of it
+		if err := db.PutKey("key-1", []byte("changed")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		if err := db.PutKey("key-3", []byte("value-3")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		got := make(map[string]string)
+		err = dump.ForEach(func(key string, value []byte, _ uint64) error {
+			got[key] = string(value)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with ForEach: %v", name, err)
+		}
+		if err := dump.Close(); err != nil {
+			t.Fatalf("%s: Unexpected error with Close: %v", name, err)
+		}
+		if len(got) != 2 || got["key-1"] != "value-1" || got[string(preparedKey("txn-1"))] == "" {
+			t.Errorf("%s: Unexpected dump. Got: %q Expected: key-1 and txn-1", name, got)
+		}
+	}
+}
+
+func TestSnapshotReads(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		db.SetVersionRetention(time.Hour)
+		// a key that is a prefix of another, and one with a 0x00 in it
+		if err := db.PutBatch([]Change{
+			{Key: "a", Value: []byte("1")},
+			{Key: "a\x00b", Value: []byte("2")},
+			{Key: "ab", Value: []byte("3")},
+		}); err != nil {
+			t.Fatalf("%s: Unexpected error with PutBatch: %v", name, err)
+		}
+		_, ts, err := db.GetAt("a", 0)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with GetAt: %v", name, err)
+		}
+
+		if err := db.PutKey("a", []byte("4")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+		if err := db.DeleteKey("ab"); err != nil {
+			t.Fatalf("%s: Unexpected error with DeleteKey: %v", name, err)
+		}
+		if err := db.PutKey("b", []byte("5")); err != nil {
+			t.Fatalf("%s: Unexpected error with PutKey: %v", name, err)
+		}
+
+		if value, _, err := db.GetAt("a", ts); err != nil || string(value) != "1" {
+			t.Errorf("%s: Unexpected value at %d. Got: %q %v Expected: 1", name, ts, value, err)
+		}
+		if value, _, err := db.GetAt("b", ts); err != nil || value != nil {
+			t.Errorf("%s: Unexpected value of a later key at %d. Got: %q %v Expected: none", name, ts, value, err)
+		}
+		kvs, readTs, err := db.ScanAt("", "", "a", 0, ts)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with ScanAt: %v", name, err)
+		}
+		expected := []KeyValue{{"a", []byte("1")}, {"a\x00b", []byte("2")}, {"ab", []byte("3")}}
+		if readTs != ts || !reflect.DeepEqual(kvs, expected) {
+			t.Errorf("%s: Unexpected scan at %d. Got: %q at %d Expected: %q", name, ts, kvs, readTs, expected)
+		}
+		kvs, latest, err := db.ScanAt("", "", "", 2, 0)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with ScanAt: %v", name, err)
+		}
+		expected = []KeyValue{{"a", []byte("4")}, {"a\x00b", []byte("2")}}
+		if latest <= ts || !reflect.DeepEqual(kvs, expected) {
+			t.Errorf("%s: Unexpected latest scan. Got: %q at %d Expected: %q after %d", name, kvs, latest, expected, ts)
+		}
+
+		if _, _, err := db.GetAt("a", latest+1); !errors.Is(err, ErrSnapshotAhead) {
+			t.Errorf("%s: Unexpected error with a read ahead of the latest write. Got: %v Expected: %v", name, err, ErrSnapshotAhead)
+		}
+
+		// without retention only the latest versions stay readable
+		db.SetVersionRetention(0)
+		if boltDB, ok := db.(*BoltDatabase); ok {
+			if _, err := boltDB.collectVersions(); err != nil {
+				t.Fatalf("%s: Unexpected error with collectVersions: %v", name, err)
+			}
+		}
+		if _, _, err := db.GetAt("a", ts); !errors.Is(err, ErrSnapshotTooOld) {
+			t.Errorf("%s: Unexpected error with a read at a collected timestamp. Got: %v Expected: %v", name, err, ErrSnapshotTooOld)
+		}
+		if value, _, err := db.GetAt("a", latest); err != nil || string(value) != "4" {
+			t.Errorf("%s: Unexpected value at %d. Got: %q %v Expected: 4", name, latest, value, err)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestBoltVersions(t *testing.T) {
+	db, closeFunc, err := NewBoltDatabase(filepath.Join(t.TempDir(), "versions"), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBoltDatabase: %v", err)
+	}
+	defer closeFunc()
+	db.SetVersionRetention(time.Hour)
+
+	// more keys in one write than a garbage collection goes through
+	changes := make([]Change, versionGCBatch+1)
+	for i := range changes {
+		changes[i] = Change{Key: fmt.Sprintf("key-%05d", i), Value: []byte("old")}
+	}
+	if err := db.PutBatch(changes); err != nil {
+		t.Fatalf("Unexpected error with PutBatch: %v", err)
+	}
+	_, ts, err := db.GetAt("key-00000", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetAt: %v", err)
+	}
+	if err := db.PutKey("key-00000", []byte("new")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+
+	// only the version that was overwritten has a value of its own
+	err = db.db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(versionsBucket)
+		if v := versions.Get(versionKey([]byte("key-00000"), ts)); v[0] != versionPut || string(v[versionHeader:]) != "old" {
+			t.Errorf("Unexpected overwritten version. Got: %q Expected: old", v)
+		}
+		if k, v := versionBefore(versions.Cursor(), []byte("key-00000"), ts+2); k == nil || v[0] != versionCurrent || len(v) != versionHeader {
+			t.Errorf("Unexpected current version. Got: %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error with View: %v", err)
+	}
+	if value, _, err := db.GetAt("key-00000", ts); err != nil || string(value) != "old" {
+		t.Errorf("Unexpected value at %d. Got: %q %v Expected: old", ts, value, err)
+	}
+
+	db.SetVersionRetention(0)
+	for _, expected := range []int{versionGCBatch, 2, 0} {
+		if walked, err := db.collectVersions(); err != nil || walked != expected {
+			t.Errorf("Unexpected garbage collection. Got: %d %v Expected: %d", walked, err, expected)
+		}
+	}
+	err = db.db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(versionsBucket).Stats().KeyN; n != len(changes) {
+			t.Errorf("Unexpected number of versions after garbage collection. Got: %d Expected: %d", n, len(changes))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error with View: %v", err)
+	}
+	if value, _, err := db.GetAt("key-00000", ts+1); err != nil || string(value) != "new" {
+		t.Errorf("Unexpected value at %d. Got: %q %v Expected: new", ts+1, value, err)
+	}
+	if value, _, err := db.GetAt("key-00001", ts+1); err != nil || string(value) != "old" {
+		t.Errorf("Unexpected value at %d. Got: %q %v Expected: old", ts+1, value, err)
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	boltDB, closeBolt, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeBolt()
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+
+	for name, db := range map[string]Database{"bolt": boltDB, "badger": badgerDB} {
+		db.SetVersionRetention(time.Hour)
+		_, start, err := db.GetAt("config/a", 0)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with GetAt: %v", name, err)
+		}
+		changes, next, err := db.ChangesSince("config/", start, 10)
+		if err != nil || len(changes) != 0 || next != start {
+			t.Fatalf("%s: Unexpected changes from the latest timestamp. Got: %v up to %d %v Expected: none up to %d", name, changes, next, err, start)
+		}
+
+		if err := db.PutBatch([]Change{
+			{Key: "config/a", Value: []byte("1")},
+			{Key: "config/b", Value: []byte("2")},
+			{Key: "other", Value: []byte("3")},
+		}); err != nil {
+			t.Fatalf("%s: Unexpected error with PutBatch: %v", name, err)
+		}
+		if err := db.DeleteKey("config/a"); err != nil {
+			t.Fatalf("%s: Unexpected error with DeleteKey: %v", name, err)
+		}
+
+		changes, latest, err := db.ChangesSince("config/", start, 10)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error with ChangesSince: %v", name, err)
+		}
+		if len(changes) != 3 {
+			t.Fatalf("%s: Unexpected changes. Got: %v Expected: the puts of config/a and config/b and the delete of config/a", name, changes)
+		}
+		if changes[0].Key != "config/a" || changes[1].Key != "config/b" || changes[0].Sequence != changes[1].Sequence || string(changes[1].Value) != "2" {
+			t.Errorf("%s: Unexpected puts. Got: %v Expected: config/a and config/b at one timestamp", name, changes[:2])
+		}
+		if changes[2].Key != "config/a" || !changes[2].Deleted || changes[2].Sequence != latest {
+			t.Errorf("%s: Unexpected delete. Got: %v Expected: config/a deleted at %d", name, changes[2], latest)
+		}
+
+		// a timestamp is never split, even past the limit
+		changes, next, err = db.ChangesSince("config/", start, 1)
+		if err != nil || len(changes) != 2 || next != changes[1].Sequence {
+			t.Errorf("%s: Unexpected limited changes. Got: %v up to %d %v Expected: the two puts", name, changes, next, err)
+		}
+		changes, next, err = db.ChangesSince("config/", next, 1)
+		if err != nil || len(changes) != 1 || !changes[0].Deleted || next != latest {
+			t.Errorf("%s: Unexpected changes after the puts. Got: %v up to %d %v Expected: the delete", name, changes, next, err)
+		}
+		if changes, next, err = db.ChangesSince("config/", start, 0); err != nil || len(changes) != 3 || next != latest {
+			t.Errorf("%s: Unexpected changes without a limit. Got: %v up to %d %v Expected: all three", name, changes, next, err)
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+
+	dbReadOnly, closeFunc, err := NewBoltDatabase(f.Name(), true)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeFunc()
+
+	changes := []Change{
+		{Sequence: 1, Key: "key-1", Value: []byte("value-1")},
+		{Sequence: 2, Key: "key-2", Value: []byte("value-2")},
+		{Sequence: 3, Key: "key-1", Deleted: true},
+	}
+	if err := dbReadOnly.ApplyChanges(changes); err != nil {
+		t.Fatalf("Unexpected error with ApplyChanges: %v", err)
+	}
+
+	// test that re-applying an old batch is a no-op
+	if err := dbReadOnly.ApplyChanges(changes[:1]); err != nil {
+		t.Fatalf("Unexpected error with ApplyChanges: %v", err)
+	}
+
+	applied, err := dbReadOnly.LastAppliedSequence()
+	if err != nil {
+		t.Fatalf("Unexpected error with LastAppliedSequence: %v", err)
+	}
+	if applied != 3 {
+		t.Errorf("Unexpected applied sequence. Got: %d Expected: 3", applied)
+	}
+
+	val, err := dbReadOnly.GetKey("key-1")
+	if err != nil {
+		t.Fatalf("Unexpected error with GetKey: %v", err)
+	}
+	if val != nil {
+		t.Errorf("Unexpected value for deleted key. Got: %v Expected: nil", val)
+	}
+	val, err = dbReadOnly.GetKey("key-2")
+	if err != nil {
+		t.Fatalf("Unexpected error with GetKey: %v", err)
+	}
+	if !bytes.Equal(val, []byte("value-2")) {
+		t.Errorf("Unexpected value. Got: %v Expected: %v", val, []byte("value-2"))
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestBadgerReplication(t *testing.T) {
+	master, closeMaster, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeMaster()
+	replica, closeReplica, err := openBadgerDatabase(t.TempDir(), true)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeReplica()
+
+	if err := master.SetReplicas([]string{"replica-1"}); err != nil {
+		t.Fatalf("Unexpected error with SetReplicas: %v", err)
+	}
+	if err := master.PutKey("key-1", []byte("value-1")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	if err := master.PutKey("key-2", []byte("value-2")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	if err := master.DeleteKey("key-1"); err != nil {
+		t.Fatalf("Unexpected error with DeleteKey: %v", err)
+	}
+
+	// test invalid Put on the replica
+	if err := replica.PutKey("a", []byte("b")); err == nil {
+		t.Fatalf("Expected error from writing to a readonly")
+	}
+
+	// test shipping the versions in two batches
+	for i := 0; i < 2; i++ {
+		applied, err := replica.LastAppliedSequence()
+		if err != nil {
+			t.Fatalf("Unexpected error with LastAppliedSequence: %v", err)
+		}
+		changes, err := master.GetChanges("replica-1", applied+1, 2)
+		if err != nil {
+			t.Fatalf("Unexpected error with GetChanges: %v", err)
+		}
+		if err := replica.ApplyChanges(changes); err != nil {
+			t.Fatalf("Unexpected error with ApplyChanges: %v", err)
+		}
+	}
+
+	if _, err := replica.GetKey("key-1"); err != badger.ErrKeyNotFound {
+		t.Errorf("Expected key-1 to be deleted on the replica, got: %v", err)
+	}
+	val, err := replica.GetKey("key-2")
+	if err != nil {
+		t.Fatalf("Unexpected error with GetKey: %v", err)
+	}
+	if !bytes.Equal(val, []byte("value-2")) {
+		t.Errorf("Unexpected value. Got: %v Expected: %v", val, []byte("value-2"))
+	}
+
+	// test that the replica is caught up
+	applied, err := replica.LastAppliedSequence()
+	if err != nil {
+		t.Fatalf("Unexpected error with LastAppliedSequence: %v", err)
+	}
+	changes, err := master.GetChanges("replica-1", applied+1, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("Expected no more changes, got: %+v", changes)
+	}
+
+	// test that a version is never split over two batches
+	from := master.db.MaxVersion() + 1
+	batch := []Change{{Key: "key-3", Value: []byte("a")}, {Key: "key-4", Value: []byte("b")}, {Key: "key-5", Value: []byte("c")}}
+	if err := master.PutBatch(batch); err != nil {
+		t.Fatalf("Unexpected error with PutBatch: %v", err)
+	}
+	if err := master.PutKey("key-6", []byte("d")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	changes, err = master.GetChanges("replica-1", from, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 3 || changes[0].Sequence != changes[2].Sequence {
+		t.Errorf("Expected the 3 changes of the batch, got: %+v", changes)
+	}
+	changes, err = master.GetChanges("replica-1", from, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 4 || changes[3].Key != "key-6" {
+		t.Errorf("Expected every change for a limit of 0, got: %+v", changes)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	f, err := ioutil.TempFile("", "temp")
+	if err != nil {
+		t.Error("Unexpected error with opening the file: %w", err)
+	}
+	defer os.Remove(f.Name() + "-boltdb")
+	defer os.Remove(f.Name() + "-replica-boltdb")
+
+	db, closeFunc, err := NewBoltDatabase(f.Name(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeFunc()
+	dbReadOnly, closeReplica, err := NewBoltDatabase(f.Name()+"-replica", true)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewDatabase: %v", err)
+	}
+	defer closeReplica()
+
+	// keys written before the replica existed are not in the change log
+	if err := db.PutKey("key-1", []byte("value-1")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	if err := db.SetReplicas([]string{"replica-1"}); err != nil {
+		t.Fatalf("Unexpected error with SetReplicas: %v", err)
+	}
+	if err := db.PutKey("key-2", []byte("value-2")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	if _, err := db.GetChanges("replica-1", 1, 10); err != ErrHistoryTruncated {
+		t.Fatalf("Expected ErrHistoryTruncated, got: %v", err)
+	}
+
+	// test loading a snapshot into a replica with stale data
+	if err := dbReadOnly.PutKeyReplica("stale", []byte("value")); err != nil {
+		t.Fatalf("Unexpected error with PutKeyReplica: %v", err)
+	}
+	var entries []Change
+	seq, err := db.Snapshot("replica-1", func(key string, value []byte, expiresAt uint64) error {
+		entries = append(entries, Change{Key: key, Value: copyValueIntoSlice(value), ExpiresAt: expiresAt})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error with Snapshot: %v", err)
+	}
+	if seq != 2 || len(entries) != 2 {
+		t.Fatalf("Unexpected snapshot. Got: seq=%d entries=%+v", seq, entries)
+	}
+	if err := dbReadOnly.ResetReplica(); err != nil {
+		t.Fatalf("Unexpected error with ResetReplica: %v", err)
+	}
+	if err := dbReadOnly.LoadSnapshot(entries); err != nil {
+		t.Fatalf("Unexpected error with LoadSnapshot: %v", err)
+	}
+	if err := dbReadOnly.SetAppliedSequence(seq); err != nil {
+		t.Fatalf("Unexpected error with SetAppliedSequence: %v", err)
+	}
+
+	keys, err := dbReadOnly.getBulkKeys(func(s string) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error with getBulkKeys: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "key-1" || keys[1] != "key-2" {
+		t.Errorf("Unexpected keys after snapshot. Got: %v", keys)
+	}
+
+	// test that streaming resumes right after the snapshot
+	if err := db.PutKey("key-3", []byte("value-3")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	changes, err := db.GetChanges("replica-1", seq+1, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error with GetChanges: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Key != "key-3" {
+		t.Errorf("Unexpected changes after snapshot. Got: %+v", changes)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Error("Unexpected error with deleting the file: %w", err)
+	}
+}
+
+func TestBadgerInternalKeys(t *testing.T) {
+	badgerDB, closeBadger, err := openBadgerDatabase(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBadgerDatabase: %v", err)
+	}
+	defer closeBadger()
+	if _, err := badgerDB.Prepare("txn-1", Txn{Writes: []Change{{Key: "a", Value: []byte("1")}}}); err != nil {
+		t.Fatalf("Unexpected error with Prepare: %v", err)
+	}
+
+	internal := string(lockKey("a"))
+	if err := badgerDB.DeleteKey(internal); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey deleting %q, got %v", internal, err)
+	}
+	if err := badgerDB.deleteKeys([]string{"b", internal}); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey bulk deleting %q, got %v", internal, err)
+	}
+	if _, err := badgerDB.GetKey(internal); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey reading %q, got %v", internal, err)
+	}
+	if _, err := badgerDB.GetBatch([]string{"a", internal}); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey reading %q in a batch, got %v", internal, err)
+	}
+	if err := badgerDB.PutKey("a", []byte("2")); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked writing a locked key, got %v", err)
+	}
+}
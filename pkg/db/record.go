@@ -0,0 +1,49 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Record is what the api stores under a key: the value, byte for byte, and
+// the content type it was written with. Replication, resharding and repair
+// ship the encoded record like any other value.
+type Record struct {
+	ContentType string
+	Value       []byte
+}
+
+// recordMagic starts every encoded record, so that values written before
+// records existed are still read back as plain values.
+var recordMagic = []byte("\x00kvrec")
+
+const recordVersion byte = 1
+
+// EncodeRecord lays out the record as the magic, a version, the length
+// prefixed content type and then the value.
+func EncodeRecord(r Record) []byte {
+	buf := make([]byte, 0, len(recordMagic)+1+binary.MaxVarintLen64+len(r.ContentType)+len(r.Value))
+	buf = append(buf, recordMagic...)
+	buf = append(buf, recordVersion)
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(r.ContentType)))]...)
+	buf = append(buf, r.ContentType...)
+	return append(buf, r.Value...)
+}
+
+func DecodeRecord(b []byte) (Record, error) {
+	if !bytes.HasPrefix(b, recordMagic) {
+		return Record{Value: b}, nil
+	}
+	b = b[len(recordMagic):]
+	if len(b) == 0 || b[0] != recordVersion {
+		return Record{}, fmt.Errorf("unknown record version")
+	}
+	ctLen, n := binary.Uvarint(b[1:])
+	if n <= 0 || uint64(len(b)-1-n) < ctLen {
+		return Record{}, fmt.Errorf("corrupt record")
+	}
+	b = b[1+n:]
+	return Record{ContentType: string(b[:ctLen]), Value: b[ctLen:]}, nil
+}
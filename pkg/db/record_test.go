@@ -0,0 +1,35 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	for _, rec := range []Record{
+		{ContentType: "image/png", Value: []byte{0x00, 0xff, 0x89, 'P', 'N', 'G'}},
+		{ContentType: "text/plain", Value: []byte{}},
+		{Value: []byte("value-1")},
+	} {
+		got, err := DecodeRecord(EncodeRecord(rec))
+		if err != nil {
+			t.Fatalf("Unexpected error with DecodeRecord: %v", err)
+		}
+		if got.ContentType != rec.ContentType || !bytes.Equal(got.Value, rec.Value) {
+			t.Errorf("Unexpected record. Got: %+v Expected: %+v", got, rec)
+		}
+	}
+
+	// values written before records existed are read back as they are
+	got, err := DecodeRecord([]byte("value-1"))
+	if err != nil {
+		t.Fatalf("Unexpected error with DecodeRecord: %v", err)
+	}
+	if got.ContentType != "" || string(got.Value) != "value-1" {
+		t.Errorf("Unexpected record for a plain value. Got: %+v", got)
+	}
+
+	if _, err := DecodeRecord(append(append([]byte{}, recordMagic...), 9)); err == nil {
+		t.Errorf("Expected error for an unknown record version")
+	}
+}
@@ -0,0 +1,152 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Depth is the number of levels below the root. Keys are spread over the
+// 1<<Depth leaves by the hash of the key, so two nodes holding the same
+// data always build the same tree.
+const Depth = 10
+
+const Leaves = 1 << Depth
+
+type Hash [sha256.Size]byte
+
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h[:])), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	if len(b) != len(h) {
+		return fmt.Errorf("hash has %d bytes, expected %d", len(b), len(h))
+	}
+	copy(h[:], b)
+	return nil
+}
+
+// Leaf returns the leaf a key belongs to.
+func Leaf(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]) >> (16 - Depth))
+}
+
+type leafEntry struct {
+	key  string
+	hash Hash
+}
+
+func hashEntry(key string, value []byte) Hash {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(key)))])
+	h.Write([]byte(key))
+	h.Write(value)
+	var sum Hash
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Tree is a Merkle tree over the key space of a db. A leaf is the hash of
+// the keys and values in it, and every other node the hash of its two
+// children, so two trees differ at a node exactly when the keys under it do.
+type Tree struct {
+	// levels[0] holds the root and levels[Depth] the leaves
+	levels [][]Hash
+}
+
+// Build hashes every key passed to fn by forEach, which is usually the
+// ForEach of a db.
+func Build(forEach func(fn func(key string, value []byte) error) error) (*Tree, error) {
+	leaves := make([][]leafEntry, Leaves)
+	err := forEach(func(key string, value []byte) error {
+		leaf := Leaf(key)
+		leaves[leaf] = append(leaves[leaf], leafEntry{key: key, hash: hashEntry(key, value)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tree{levels: make([][]Hash, Depth+1)}
+	t.levels[Depth] = make([]Hash, Leaves)
+	for i, entries := range leaves {
+		sort.Slice(entries, func(a, b int) bool { return entries[a].key < entries[b].key })
+		h := sha256.New()
+		for _, entry := range entries {
+			h.Write(entry.hash[:])
+		}
+		copy(t.levels[Depth][i][:], h.Sum(nil))
+	}
+	for level := Depth - 1; level >= 0; level-- {
+		below := t.levels[level+1]
+		t.levels[level] = make([]Hash, len(below)/2)
+		for i := range t.levels[level] {
+			h := sha256.New()
+			h.Write(below[2*i][:])
+			h.Write(below[2*i+1][:])
+			copy(t.levels[level][i][:], h.Sum(nil))
+		}
+	}
+	return t, nil
+}
+
+func (t *Tree) Root() Hash {
+	return t.levels[0][0]
+}
+
+// Node returns the hash of the i-th node of a level.
+func (t *Tree) Node(level, i int) Hash {
+	return t.levels[level][i]
+}
+
+// Range returns the hashes of the nodes from up to but not including to at
+// a level. The level has 1<<level nodes.
+func (t *Tree) Range(level, from, to int) ([]Hash, error) {
+	if level < 0 || level > Depth {
+		return nil, fmt.Errorf("level %d is outside of 0 to %d", level, Depth)
+	}
+	if from < 0 || to > len(t.levels[level]) || from > to {
+		return nil, fmt.Errorf("range %d to %d is outside of level %d", from, to, level)
+	}
+	return t.levels[level][from:to], nil
+}
+
+// Cache keeps a built tree for up to maxAge, so that a replica walking down
+// the tree one level at a time does not cost a full scan per request.
+type Cache struct {
+	forEach func(fn func(key string, value []byte) error) error
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	tree    *Tree
+	builtAt time.Time
+}
+
+func NewCache(forEach func(fn func(key string, value []byte) error) error, maxAge time.Duration) *Cache {
+	return &Cache{forEach: forEach, maxAge: maxAge}
+}
+
+func (c *Cache) Tree() (*Tree, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tree != nil && time.Since(c.builtAt) < c.maxAge {
+		return c.tree, nil
+	}
+	tree, err := Build(c.forEach)
+	if err != nil {
+		return nil, err
+	}
+	c.tree, c.builtAt = tree, time.Now()
+	return tree, nil
+}
@@ -0,0 +1,103 @@
+package merkle
+
+import (
+	"testing"
+)
+
+func forEachOf(kv map[string]string) func(fn func(key string, value []byte) error) error {
+	return func(fn func(key string, value []byte) error) error {
+		for k, v := range kv {
+			if err := fn(k, []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestBuildSameData(t *testing.T) {
+	kv := map[string]string{"key1": "value1", "key2": "value2", "key3": "value3"}
+	a, err := Build(forEachOf(kv))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	b, err := Build(forEachOf(kv))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	if a.Root() != b.Root() {
+		t.Errorf("Expected the same root for the same data")
+	}
+
+	empty, err := Build(forEachOf(map[string]string{}))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	if a.Root() == empty.Root() {
+		t.Errorf("Expected a different root for an empty tree")
+	}
+}
+
+func TestBuildDifferentValue(t *testing.T) {
+	a, err := Build(forEachOf(map[string]string{"key1": "value1", "key2": "value2"}))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	b, err := Build(forEachOf(map[string]string{"key1": "value1", "key2": "other"}))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	if a.Root() == b.Root() {
+		t.Fatalf("Expected a different root for different data")
+	}
+
+	// only the leaf of key2 and the nodes above it should differ
+	leaf := Leaf("key2")
+	for level := Depth; level >= 0; level-- {
+		ha, _ := a.Range(level, 0, 1<<level)
+		hb, _ := b.Range(level, 0, 1<<level)
+		for i := range ha {
+			if differ := ha[i] != hb[i]; differ != (i == leaf>>(Depth-level)) {
+				t.Errorf("Incorrect difference at level %d node %d. Expected: %v Got: %v", level, i, !differ, differ)
+			}
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	tree, err := Build(forEachOf(map[string]string{"key1": "value1"}))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	hashes, err := tree.Range(Depth, 10, 20)
+	if err != nil {
+		t.Fatalf("Unexpected error with Range(): %v", err)
+	}
+	if len(hashes) != 10 {
+		t.Errorf("Incorrect number of hashes. Expected: %d Got: %d", 10, len(hashes))
+	}
+	if _, err := tree.Range(1, 0, 3); err == nil {
+		t.Errorf("Expected error for a range past the end of the level")
+	}
+	if _, err := tree.Range(Depth+1, 0, 1); err == nil {
+		t.Errorf("Expected error for a level below the leaves")
+	}
+}
+
+func TestHashText(t *testing.T) {
+	tree, err := Build(forEachOf(map[string]string{"key1": "value1"}))
+	if err != nil {
+		t.Fatalf("Unexpected error with Build(): %v", err)
+	}
+	text, err := tree.Root().MarshalText()
+	if err != nil {
+		t.Fatalf("Unexpected error with MarshalText(): %v", err)
+	}
+	var h Hash
+	if err := h.UnmarshalText(text); err != nil {
+		t.Fatalf("Unexpected error with UnmarshalText(): %v", err)
+	}
+	if h != tree.Root() {
+		t.Errorf("Incorrect hash after a round trip. Expected: %s Got: %x", text, h[:])
+	}
+}
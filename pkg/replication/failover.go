@@ -0,0 +1,351 @@
+package replication
+
+import (
+	"context"
+	"cs553/pkg/cluster"
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const votedTermKey = "voted-term"
+
+// Failover decides whether this node is the master or a replica of its
+// shard. Replicas heartbeat the master, and once it has been unreachable for
+// the failover timeout they elect one of themselves as the new master. A
+// candidate needs the votes of a majority of the replicas, and every node
+// votes at most once per term, so at most one replica wins a term. A master
+// that has not heard from enough replicas for them to elect another master
+// without it stops taking writes until they are back, so that the two sides
+// of a partition never both accept writes.
+type Failover struct {
+	db         db.Database
+	membership *cluster.Membership
+	shard      int
+	self       string
+	timeout    time.Duration
+	repair     time.Duration
+	client     *http.Client
+
+	mu          sync.Mutex
+	votedTerm   uint64
+	lastContact time.Time
+	// heard is when the master last had a heartbeat from each replica
+	heard           map[string]time.Time
+	fenced          bool
+	electionAt      time.Time
+	stopReplication context.CancelFunc
+}
+
+func NewFailover(database db.Database, membership *cluster.Membership, shard config.ShardConfig, self string) (*Failover, error) {
+	timeout, repair := shard.FailoverTimeout, shard.RepairInterval
+	if timeout == 0 {
+		timeout = config.DefaultFailoverTimeout
+	}
+	if repair == 0 {
+		repair = config.DefaultRepairInterval
+	}
+	f := &Failover{
+		db:         database,
+		membership: membership,
+		shard:      shard.Index,
+		self:       self,
+		timeout:    timeout,
+		repair:     repair,
+		client:     &http.Client{Timeout: timeout / 5},
+	}
+
+	raw, err := database.GetMeta(votedTermKey)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		if f.votedTerm, err = strconv.ParseUint(string(raw), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	membership.OnChange(func(shard int, master cluster.Master) {
+		if shard == f.shard {
+			f.applyRole(master)
+		}
+	})
+	return f, nil
+}
+
+// Start catches up on promotions that happened while this node was down,
+// takes on the matching role and then watches the master in the background.
+func (f *Failover) Start() {
+	f.membership.Sync(f.self)
+	f.applyRole(f.membership.Master(f.shard))
+	go f.watchMaster()
+}
+
+func (f *Failover) watchMaster() {
+	for {
+		time.Sleep(f.timeout / 5)
+
+		master := f.membership.Master(f.shard)
+		if master.Address == f.self {
+			f.checkQuorum()
+			continue
+		}
+		if f.heartbeat(master) {
+			f.touch()
+			continue
+		}
+
+		f.mu.Lock()
+		due := time.Now().After(f.electionAt)
+		f.mu.Unlock()
+		if due {
+			f.runElection(master)
+		}
+	}
+}
+
+// touch records that the master was heard from, and pushes the next
+// election back by the timeout plus some jitter so that replicas do not all
+// stand at once.
+func (f *Failover) touch() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastContact = time.Now()
+	f.electionAt = f.lastContact.Add(f.timeout + time.Duration(rand.Int63n(int64(f.timeout/2)+1)))
+}
+
+func (f *Failover) applyRole(master cluster.Master) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if master.Address == f.self {
+		if f.stopReplication != nil {
+			f.stopReplication()
+			f.stopReplication = nil
+		}
+		if err := f.db.SetReplicas(f.membership.Replicas(f.shard)); err != nil {
+			log.Printf("could not set replicas of shard %d: %v", f.shard, err)
+		}
+		f.db.SetReplicaMode(false)
+		// give the replicas a full timeout to heartbeat the new master
+		f.heard, f.fenced = make(map[string]time.Time), false
+		for _, replica := range f.membership.Replicas(f.shard) {
+			f.heard[replica] = time.Now()
+		}
+		log.Printf("serving as master of shard %d at term %d", f.shard, master.Term)
+		return
+	}
+
+	f.db.SetReplicaMode(true)
+	if err := f.db.SetReplicas(nil); err != nil {
+		log.Printf("could not clear replicas of shard %d: %v", f.shard, err)
+	}
+	// give the new master a full timeout before suspecting it
+	f.lastContact = time.Now()
+	f.electionAt = f.lastContact.Add(f.timeout)
+	if f.stopReplication == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		f.stopReplication = cancel
+		go PropagateReplication(ctx, f.db, f.membership, f.shard, f.self)
+		go RepairReplica(ctx, f.db, f.membership, f.shard, f.repair)
+		log.Printf("serving as replica of shard %d, master is %q at term %d", f.shard, master.Address, master.Term)
+	}
+}
+
+// heartbeat reports whether the master is up and still agrees it is the
+// master. It also tells the master our view, so that a master that was down
+// during a promotion steps down.
+func (f *Failover) heartbeat(master cluster.Master) bool {
+	u := url.Values{}
+	u.Set("shard", strconv.Itoa(f.shard))
+	u.Set("replica", f.self)
+	u.Set("address", master.Address)
+	u.Set("term", strconv.FormatUint(master.Term, 10))
+
+	resp, err := f.client.Get("http://" + master.Address + "/cluster/heartbeat?" + u.Encode())
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	var current cluster.Master
+	if err := json.NewDecoder(resp.Body).Decode(&current); err != nil {
+		return false
+	}
+	if current.Term > master.Term {
+		if _, err := f.membership.Update(f.shard, current); err != nil {
+			log.Printf("could not update master of shard %d: %v", f.shard, err)
+		}
+		return true
+	}
+	return current == master
+}
+
+// Heartbeat is the master's side of a heartbeat from replica. It learns
+// about a newer master from the replica and returns its own view.
+func (f *Failover) Heartbeat(master cluster.Master, replica string) cluster.Master {
+	if _, err := f.membership.Update(f.shard, master); err != nil {
+		log.Printf("could not update master of shard %d: %v", f.shard, err)
+	}
+	if replica != "" {
+		f.mu.Lock()
+		if f.heard != nil {
+			f.heard[replica] = time.Now()
+		}
+		f.mu.Unlock()
+	}
+	f.checkQuorum()
+	return f.membership.Master(f.shard)
+}
+
+// hasMajority reports whether votes are a majority of voters.
+func hasMajority(votes, voters int) bool {
+	return votes*2 > voters
+}
+
+// checkQuorum stops the master from taking writes while the replicas it has
+// not heard from for the failover timeout are a majority, which is when they
+// can elect another master, and lets it take writes again once it hears from
+// enough of them. The replicas only vote once they have not reached the
+// master for the timeout either, so the master stops no later than another
+// one can be elected.
+func (f *Failover) checkQuorum() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.membership.Master(f.shard).Address != f.self || f.heard == nil {
+		return
+	}
+	replicas := f.membership.Replicas(f.shard)
+	unheard := 0
+	for _, replica := range replicas {
+		if time.Since(f.heard[replica]) >= f.timeout {
+			unheard++
+		}
+	}
+	fenced := hasMajority(unheard, len(replicas))
+	if fenced == f.fenced {
+		return
+	}
+	f.fenced = fenced
+	f.db.SetReplicaMode(fenced)
+	if fenced {
+		log.Printf("master of shard %d has not heard from %d of %d replicas, refusing writes", f.shard, unheard, len(replicas))
+	} else {
+		log.Printf("master of shard %d hears from its replicas again, taking writes", f.shard)
+	}
+}
+
+func (f *Failover) position() (term, applied uint64, err error) {
+	if term, err = sourceTerm(f.db); err != nil {
+		return 0, 0, err
+	}
+	if applied, err = f.db.LastAppliedSequence(); err != nil {
+		return 0, 0, err
+	}
+	return term, applied, nil
+}
+
+func (f *Failover) voteFor(term uint64) error {
+	f.votedTerm = term
+	return f.db.PutMeta(votedTermKey, []byte(strconv.FormatUint(term, 10)))
+}
+
+func (f *Failover) runElection(failed cluster.Master) {
+	sourceTerm, applied, err := f.position()
+	if err != nil {
+		log.Printf("could not read replication position: %v", err)
+		return
+	}
+
+	f.mu.Lock()
+	term := failed.Term + 1
+	if f.votedTerm >= term {
+		term = f.votedTerm + 1
+	}
+	if err := f.voteFor(term); err != nil {
+		f.mu.Unlock()
+		log.Printf("could not record vote: %v", err)
+		return
+	}
+	f.mu.Unlock()
+
+	log.Printf("master %q of shard %d is unreachable, standing for term %d", failed.Address, f.shard, term)
+
+	voters := f.membership.Replicas(f.shard)
+	votes := 1
+	for _, voter := range voters {
+		if voter != f.self && f.requestVote(voter, term, sourceTerm, applied) {
+			votes++
+		}
+	}
+	if !hasMajority(votes, len(voters)) {
+		log.Printf("lost the election for term %d with %d of %d votes", term, votes, len(voters))
+		f.touch()
+		return
+	}
+
+	master := cluster.Master{Address: f.self, Term: term}
+	if _, err := f.membership.Update(f.shard, master); err != nil {
+		log.Printf("could not record promotion: %v", err)
+	}
+	go f.membership.Announce(f.shard, master)
+}
+
+func (f *Failover) requestVote(voter string, term, sourceTerm, applied uint64) bool {
+	u := url.Values{}
+	u.Set("shard", strconv.Itoa(f.shard))
+	u.Set("term", strconv.FormatUint(term, 10))
+	u.Set("candidate", f.self)
+	u.Set("source-term", strconv.FormatUint(sourceTerm, 10))
+	u.Set("applied", strconv.FormatUint(applied, 10))
+
+	resp, err := f.client.Get("http://" + voter + "/cluster/vote?" + u.Encode())
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	var granted bool
+	if err := json.NewDecoder(resp.Body).Decode(&granted); err != nil {
+		return false
+	}
+	return granted
+}
+
+// RequestVote is the voter's side of an election. The vote is refused if we
+// already voted in this term, if we can still reach the master, or if the
+// candidate has applied less of the master's writes than we have.
+func (f *Failover) RequestVote(term uint64, candidate string, sourceTerm, applied uint64) bool {
+	myTerm, myApplied, err := f.position()
+	if err != nil {
+		log.Printf("could not read replication position: %v", err)
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	master := f.membership.Master(f.shard)
+	if term <= f.votedTerm || term <= master.Term || master.Address == f.self {
+		return false
+	}
+	if time.Since(f.lastContact) < f.timeout {
+		return false
+	}
+	if sourceTerm < myTerm || (sourceTerm == myTerm && applied < myApplied) {
+		return false
+	}
+	if err := f.voteFor(term); err != nil {
+		log.Printf("could not record vote: %v", err)
+		return false
+	}
+	log.Printf("voted for %q in term %d of shard %d", candidate, term, f.shard)
+	return true
+}
@@ -0,0 +1,141 @@
+package replication
+
+import (
+	"cs553/pkg/cluster"
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var failoverYAML = `Shard:
+  Name: shard0
+  Index: 0
+  Address: node-a
+  Replicas: [node-b, node-c]
+  FailoverTimeout: 1s`
+
+func newTestFailover(t *testing.T, self string) (*Failover, db.Database) {
+	c, err := config.ParseConfig([]byte(failoverYAML), "shard0")
+	if err != nil {
+		t.Fatalf("Unexpected error with ParseConfig: %v", err)
+	}
+	database, closeFunc, err := db.NewBoltDatabase(filepath.Join(t.TempDir(), self), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBoltDatabase: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	membership, err := cluster.NewMembership(c, database)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewMembership: %v", err)
+	}
+	shard, _ := c.GetShard(0)
+	f, err := NewFailover(database, membership, shard, self)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewFailover: %v", err)
+	}
+	return f, database
+}
+
+func TestHasMajority(t *testing.T) {
+	for _, tc := range []struct {
+		votes, voters int
+		want          bool
+	}{
+		{0, 0, false},
+		{1, 1, true},
+		{1, 2, false},
+		{2, 2, true},
+		{1, 3, false},
+		{2, 3, true},
+		{2, 4, false},
+		{3, 4, true},
+	} {
+		if got := hasMajority(tc.votes, tc.voters); got != tc.want {
+			t.Errorf("hasMajority(%d, %d) = %v, expected %v", tc.votes, tc.voters, got, tc.want)
+		}
+	}
+}
+
+func TestRequestVote(t *testing.T) {
+	f, database := newTestFailover(t, "node-b")
+
+	if !f.RequestVote(1, "node-c", 0, 0) {
+		t.Fatalf("Expected a vote for term 1")
+	}
+	if f.RequestVote(1, "node-a", 0, 0) {
+		t.Errorf("Expected no second vote in term 1")
+	}
+	if !f.RequestVote(2, "node-c", 0, 0) {
+		t.Errorf("Expected a vote for the later term 2")
+	}
+	if f.RequestVote(1, "node-c", 0, 0) {
+		t.Errorf("Expected no vote for the earlier term 1")
+	}
+
+	// a voter that still reaches the master refuses
+	f.touch()
+	if f.RequestVote(3, "node-c", 0, 0) {
+		t.Errorf("Expected no vote while the master is reachable")
+	}
+	f.mu.Lock()
+	f.lastContact = time.Time{}
+	f.mu.Unlock()
+
+	// a candidate that applied less than the voter refuses
+	if err := database.SetAppliedSequence(5); err != nil {
+		t.Fatalf("Unexpected error with SetAppliedSequence: %v", err)
+	}
+	if f.RequestVote(3, "node-c", 0, 4) {
+		t.Errorf("Expected no vote for a candidate that is behind")
+	}
+	if !f.RequestVote(3, "node-c", 0, 5) {
+		t.Errorf("Expected a vote for a candidate that is caught up")
+	}
+
+	// a vote outlives a restart
+	shard, _ := f.membership.Config().GetShard(0)
+	restarted, err := NewFailover(database, f.membership, shard, "node-b")
+	if err != nil {
+		t.Fatalf("Unexpected error with NewFailover: %v", err)
+	}
+	if restarted.RequestVote(3, "node-a", 0, 5) {
+		t.Errorf("Expected no second vote in term 3 after a restart")
+	}
+
+	// a term the shard already reached gets no vote
+	if _, err := f.membership.Update(0, cluster.Master{Address: "node-c", Term: 7}); err != nil {
+		t.Fatalf("Unexpected error with Update: %v", err)
+	}
+	if f.RequestVote(7, "node-a", 0, 5) {
+		t.Errorf("Expected no vote for the term of the current master")
+	}
+}
+
+func TestCheckQuorum(t *testing.T) {
+	f, database := newTestFailover(t, "node-a")
+	f.applyRole(f.membership.Master(0))
+
+	if err := database.PutKey("key", []byte("value")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+
+	// a majority of the replicas has gone quiet
+	f.mu.Lock()
+	for replica := range f.heard {
+		f.heard[replica] = time.Now().Add(-2 * time.Second)
+	}
+	f.mu.Unlock()
+	f.checkQuorum()
+	if err := database.PutKey("key", []byte("value")); !errors.Is(err, db.ErrReadOnly) {
+		t.Fatalf("Expected writes to be refused without a quorum, got: %v", err)
+	}
+
+	// one replica of two is back, so the other cannot elect a master alone
+	f.Heartbeat(f.membership.Master(0), "node-b")
+	if err := database.PutKey("key", []byte("value")); err != nil {
+		t.Errorf("Expected writes to be taken with a quorum, got: %v", err)
+	}
+}
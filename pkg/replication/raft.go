@@ -0,0 +1,444 @@
+package replication
+
+import (
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+const (
+	raftApplyTimeout = 5 * time.Second
+	raftReadTimeout  = 5 * time.Second
+	raftSnapshots    = 2
+)
+
+// raftCommand is a single write carried by the raft log, or a batch of
+// writes applied in one transaction. A conditional write is checked by every
+// member as it applies the entry, which all agree on since versions are
+// digests of the values, and an addition to a counter is likewise applied to
+// the same count everywhere. A transaction is checked the same way, and the
+// phases of a transaction that spans shards are carried by the log too, so
+// that every member holds its locks and a new leader can finish it.
+type raftCommand struct {
+	Key       string
+	Value     []byte        `json:",omitempty"`
+	Deleted   bool          `json:",omitempty"`
+	Batch     []db.Change   `json:",omitempty"`
+	Change    *db.Change    `json:",omitempty"`
+	Condition *db.Condition `json:",omitempty"`
+	Delta     *int64        `json:",omitempty"`
+	ExpiresAt uint64        `json:",omitempty"`
+	Txn       *db.Txn       `json:",omitempty"`
+	Prepare   string        `json:",omitempty"`
+	Commit    string        `json:",omitempty"`
+	Abort     string        `json:",omitempty"`
+}
+
+// RaftNode replicates a shard through raft instead of a master streaming its
+// change log. The master and the replicas in config.yaml form the raft group,
+// every write goes through the leader's log and is applied to the db of each
+// member once a majority has it, so an acknowledged write survives the loss
+// of any minority of the group. Members are identified by their http address.
+type RaftNode struct {
+	raft   *raft.Raft
+	db     db.Database
+	self   string
+	client *http.Client
+
+	mu sync.Mutex
+	// ready is set once the leader has committed an entry of its own term,
+	// before that its commit index may lag what the previous leader committed
+	ready bool
+}
+
+func NewRaftNode(database db.Database, shard config.ShardConfig, self string, dir string) (node *RaftNode, closeFunc func() error, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(self)
+	conf.LogOutput = os.Stderr
+	conf.LogLevel = "WARN"
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening raft log: %w", err)
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, raftSnapshots, os.Stderr)
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("opening raft snapshots: %w", err)
+	}
+	transport, err := raft.NewTCPTransport(shard.RaftAddresses[self], nil, 3, raftApplyTimeout, os.Stderr)
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("starting raft transport: %w", err)
+	}
+
+	// raft applies the entries after its latest snapshot again on every
+	// start, or the whole log without one, since it does not know which ones
+	// the db already has. Restore starts the db over from the snapshot, and
+	// without one it is started over here, so that no entry is applied twice.
+	existing, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		transport.Close()
+		store.Close()
+		return nil, nil, err
+	}
+	if existing {
+		list, err := snapshots.List()
+		if err == nil && len(list) == 0 {
+			err = database.ResetReplica()
+		}
+		if err != nil {
+			transport.Close()
+			store.Close()
+			return nil, nil, fmt.Errorf("resetting the db before replaying the raft log: %w", err)
+		}
+	}
+
+	r, err := raft.NewRaft(conf, &raftFSM{db: database}, store, store, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		store.Close()
+		return nil, nil, err
+	}
+
+	// every member bootstraps the same configuration the first time it
+	// starts, after that the group lives in the raft log
+	if !existing {
+		var servers []raft.Server
+		for _, member := range shard.Members() {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(member),
+				Address: raft.ServerAddress(shard.RaftAddresses[member]),
+			})
+		}
+		if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && err != raft.ErrCantBootstrap {
+			return nil, nil, fmt.Errorf("bootstrapping raft: %w", err)
+		}
+	}
+
+	node = &RaftNode{
+		raft:   r,
+		db:     database,
+		self:   self,
+		client: &http.Client{Timeout: raftReadTimeout},
+	}
+	go node.watchLeadership()
+
+	closeFunc = func() error {
+		err := r.Shutdown().Error()
+		transport.Close()
+		if serr := store.Close(); err == nil {
+			err = serr
+		}
+		return err
+	}
+	return node, closeFunc, nil
+}
+
+func (n *RaftNode) watchLeadership() {
+	for range n.raft.LeaderCh() {
+		n.mu.Lock()
+		n.ready = false
+		n.mu.Unlock()
+	}
+}
+
+func (n *RaftNode) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the http address of the current leader, or an empty string
+// while there is none.
+func (n *RaftNode) Leader() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+func (n *RaftNode) apply(cmd raftCommand) error {
+	_, err := n.applyResult(cmd)
+	return err
+}
+
+// applyResult commits cmd and returns what the leader got applying it.
+func (n *RaftNode) applyResult(cmd raftCommand) (interface{}, error) {
+	data, err := json.Marshal(&cmd)
+	if err != nil {
+		return nil, err
+	}
+	future := n.raft.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+// Put commits a write through the raft log. It only succeeds on the leader.
+func (n *RaftNode) Put(key string, value []byte) error {
+	return n.apply(raftCommand{Key: key, Value: value})
+}
+
+// Delete commits a delete through the raft log. It only succeeds on the
+// leader.
+func (n *RaftNode) Delete(key string) error {
+	return n.apply(raftCommand{Key: key, Deleted: true})
+}
+
+// PutIf commits a conditional write through the raft log. The error of the
+// condition is the one the leader got applying it.
+func (n *RaftNode) PutIf(change db.Change, cond db.Condition) error {
+	return n.apply(raftCommand{Change: &change, Condition: &cond})
+}
+
+// Add commits an addition to the counter under key through the raft log and
+// returns the new value. It only succeeds on the leader.
+func (n *RaftNode) Add(key string, delta int64, expiresAt uint64) (int64, error) {
+	resp, err := n.applyResult(raftCommand{Key: key, Delta: &delta, ExpiresAt: expiresAt})
+	if err != nil {
+		return 0, err
+	}
+	return resp.(int64), nil
+}
+
+// Transact commits a transaction through the raft log and returns what it
+// read. It only succeeds on the leader.
+func (n *RaftNode) Transact(txn db.Txn) ([][]byte, error) {
+	resp, err := n.applyResult(raftCommand{Txn: &txn})
+	if err != nil {
+		return nil, err
+	}
+	return resp.([][]byte), nil
+}
+
+// Prepare commits the first phase of a transaction that spans shards through
+// the raft log and returns what it read. It only succeeds on the leader.
+func (n *RaftNode) Prepare(id string, txn db.Txn) ([][]byte, error) {
+	resp, err := n.applyResult(raftCommand{Prepare: id, Txn: &txn})
+	if err != nil {
+		return nil, err
+	}
+	return resp.([][]byte), nil
+}
+
+// CommitPrepared commits the decision to commit a prepared transaction
+// through the raft log. It only succeeds on the leader.
+func (n *RaftNode) CommitPrepared(id string) error {
+	return n.apply(raftCommand{Commit: id})
+}
+
+// AbortPrepared commits the decision to abort a prepared transaction through
+// the raft log. It only succeeds on the leader.
+func (n *RaftNode) AbortPrepared(id string) error {
+	return n.apply(raftCommand{Abort: id})
+}
+
+// PutBatch commits a batch of writes and deletes through a single entry of
+// the raft log. It only succeeds on the leader.
+func (n *RaftNode) PutBatch(changes []db.Change) error {
+	return n.apply(raftCommand{Batch: changes})
+}
+
+// ReadIndex is the leader's side of a linearizable read. It returns the
+// commit index once a majority has confirmed we are still the leader, and a
+// read served after applying up to it sees every acknowledged write.
+func (n *RaftNode) ReadIndex() (uint64, error) {
+	if !n.IsLeader() {
+		return 0, raft.ErrNotLeader
+	}
+
+	n.mu.Lock()
+	ready := n.ready
+	n.mu.Unlock()
+	if !ready {
+		if err := n.raft.Barrier(raftApplyTimeout).Error(); err != nil {
+			return 0, err
+		}
+		n.mu.Lock()
+		n.ready = true
+		n.mu.Unlock()
+	}
+
+	index := n.raft.CommitIndex()
+	if err := n.raft.VerifyLeader().Error(); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+func (n *RaftNode) remoteReadIndex() (uint64, error) {
+	leader := n.Leader()
+	if leader == "" {
+		return 0, raft.ErrNotLeader
+	}
+	resp, err := n.client.Get("http://" + leader + "/raft/read-index")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		out, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("leader returned %s: %s", resp.Status, out)
+	}
+	var index uint64
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// WaitForRead blocks until a read of the local db is linearizable. Followers
+// ask the leader for its read index and then wait until they have applied
+// up to it, so reads are spread over the group without going through the log.
+func (n *RaftNode) WaitForRead() error {
+	var index uint64
+	var err error
+	if n.IsLeader() {
+		index, err = n.ReadIndex()
+	} else {
+		index, err = n.remoteReadIndex()
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(raftReadTimeout)
+	for n.raft.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out applying up to read index %d", index)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// raftFSM applies committed raft entries to the db.
+type raftFSM struct {
+	db db.Database
+}
+
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return fmt.Errorf("decoding raft command: %w", err)
+	}
+	if len(cmd.Batch) > 0 {
+		return f.db.PutBatch(cmd.Batch)
+	}
+	if cmd.Change != nil && cmd.Condition != nil {
+		return f.db.PutIf(*cmd.Change, *cmd.Condition)
+	}
+	switch {
+	case cmd.Prepare != "" && cmd.Txn != nil:
+		values, err := f.db.Prepare(cmd.Prepare, *cmd.Txn)
+		if err != nil {
+			return err
+		}
+		return values
+	case cmd.Commit != "":
+		return f.db.CommitPrepared(cmd.Commit)
+	case cmd.Abort != "":
+		return f.db.AbortPrepared(cmd.Abort)
+	}
+	if cmd.Txn != nil {
+		values, err := f.db.Transact(*cmd.Txn)
+		if err != nil {
+			return err
+		}
+		return values
+	}
+	if cmd.Delta != nil {
+		_, value, err := f.db.Add(cmd.Key, *cmd.Delta, cmd.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		return value
+	}
+	if cmd.Deleted {
+		return f.db.DeleteKey(cmd.Key)
+	}
+	return f.db.PutKey(cmd.Key, cmd.Value)
+}
+
+// Snapshot pins the db while raft holds off applying entries, and Persist
+// streams it out in the same format as /replication/snapshot while entries
+// are applied again. The prepared transactions are in it too, as the
+// entries that prepared them may be dropped from the log once the snapshot
+// is taken.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	dump, err := f.db.Dump()
+	if err != nil {
+		return nil, err
+	}
+	return &raftSnapshot{dump: dump}, nil
+}
+
+func (f *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	if err := f.db.ResetReplica(); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(rc)
+	batch := make([]db.Change, 0, batchSize)
+	for {
+		var entry SnapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("raft snapshot ended before it was complete")
+			}
+			return fmt.Errorf("decoding raft snapshot: %w", err)
+		}
+
+		if entry.Done || len(batch) == batchSize {
+			if err := f.db.LoadSnapshot(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if entry.Done {
+			return nil
+		}
+		batch = append(batch, db.Change{Key: entry.Key, Value: entry.Value, ExpiresAt: entry.ExpiresAt})
+	}
+}
+
+type raftSnapshot struct {
+	dump db.Dump
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	encoder := json.NewEncoder(sink)
+	err := s.dump.ForEach(func(key string, value []byte, expiresAt uint64) error {
+		return encoder.Encode(&SnapshotEntry{Key: key, Value: value, ExpiresAt: expiresAt})
+	})
+	if err == nil {
+		err = encoder.Encode(&SnapshotEntry{Done: true})
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftSnapshot) Release() {
+	s.dump.Close()
+}
@@ -0,0 +1,151 @@
+package replication
+
+import (
+	"bytes"
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// bufferSink is a raft.SnapshotSink that keeps the snapshot in memory.
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func newTestDB(t *testing.T, name string) db.Database {
+	database, closeFunc, err := db.NewBoltDatabase(filepath.Join(t.TempDir(), name), false)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewBoltDatabase: %v", err)
+	}
+	t.Cleanup(func() { closeFunc() })
+	return database
+}
+
+func TestRaftSnapshotKeepsPrepared(t *testing.T) {
+	leader := newTestDB(t, "leader")
+	if err := leader.PutKey("stock", []byte("1")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	txn := db.Txn{Writes: []db.Change{{Key: "stock", Value: []byte("0")}}}
+	if _, err := leader.Prepare("txn-1", txn); err != nil {
+		t.Fatalf("Unexpected error with Prepare: %v", err)
+	}
+
+	snapshot, err := (&raftFSM{db: leader}).Snapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error with Snapshot: %v", err)
+	}
+	defer snapshot.Release()
+	// writes go on while the snapshot is persisted, without ending up in it
+	if err := leader.PutKey("later", []byte("1")); err != nil {
+		t.Fatalf("Unexpected error with PutKey: %v", err)
+	}
+	sink := &bufferSink{}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatalf("Unexpected error with Persist: %v", err)
+	}
+
+	// the member restored from it had a lock of its own, which is gone since
+	member := newTestDB(t, "member")
+	if _, err := member.Prepare("txn-0", db.Txn{Writes: []db.Change{{Key: "order", Value: []byte("placed")}}}); err != nil {
+		t.Fatalf("Unexpected error with Prepare: %v", err)
+	}
+	if err := (&raftFSM{db: member}).Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("Unexpected error with Restore: %v", err)
+	}
+
+	if value, err := member.GetKey("stock"); err != nil || string(value) != "1" {
+		t.Errorf("Unexpected value after Restore. Got: %q %v Expected: 1", value, err)
+	}
+	if value, _ := member.GetKey("later"); value != nil {
+		t.Errorf("Expected a write after the snapshot to be left out of it, got: %q", value)
+	}
+	prepared, err := member.Prepared()
+	if err != nil {
+		t.Fatalf("Unexpected error with Prepared: %v", err)
+	}
+	if _, ok := prepared["txn-1"]; !ok || len(prepared) != 1 {
+		t.Errorf("Unexpected prepared transactions after Restore. Got: %v Expected: txn-1", prepared)
+	}
+	if err := member.PutKey("stock", []byte("5")); !errors.Is(err, db.ErrLocked) {
+		t.Errorf("Expected stock to stay locked after Restore, got: %v", err)
+	}
+	if err := member.PutKey("order", []byte("other")); err != nil {
+		t.Errorf("Expected the stale lock on order to be dropped by Restore, got: %v", err)
+	}
+
+	// the restored transaction can still be committed
+	if err := member.CommitPrepared("txn-1"); err != nil {
+		t.Fatalf("Unexpected error with CommitPrepared: %v", err)
+	}
+	if value, err := member.GetKey("stock"); err != nil || string(value) != "0" {
+		t.Errorf("Unexpected value after the commit. Got: %q %v Expected: 0", value, err)
+	}
+}
+
+// startRaftNode starts a group of one on dir and waits for it to lead.
+func startRaftNode(t *testing.T, database db.Database, shard config.ShardConfig, dir string) (*RaftNode, func() error) {
+	node, closeFunc, err := NewRaftNode(database, shard, shard.Address, dir)
+	if err != nil {
+		t.Fatalf("Unexpected error with NewRaftNode: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !node.IsLeader() {
+		if time.Now().After(deadline) {
+			closeFunc()
+			t.Fatalf("Timed out waiting for the node to lead")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return node, closeFunc
+}
+
+func TestRaftRestartAppliesOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error with Listen: %v", err)
+	}
+	raftAddress := l.Addr().String()
+	l.Close()
+	shard := config.ShardConfig{
+		Address:       "localhost:8080",
+		Replication:   config.ReplicationRaft,
+		RaftAddresses: map[string]string{"localhost:8080": raftAddress},
+	}
+	database := newTestDB(t, "member")
+	dir := t.TempDir()
+
+	node, closeFunc := startRaftNode(t, database, shard, dir)
+	if _, err := node.Add("count", 1, 0); err != nil {
+		t.Fatalf("Unexpected error with Add: %v", err)
+	}
+	if _, err := node.Prepare("txn-1", db.Txn{Writes: []db.Change{{Key: "stock", Value: []byte("0")}}}); err != nil {
+		t.Fatalf("Unexpected error with Prepare: %v", err)
+	}
+	if err := closeFunc(); err != nil {
+		t.Fatalf("Unexpected error with closing the node: %v", err)
+	}
+
+	// the whole log is applied again, as no snapshot was taken
+	node, closeFunc = startRaftNode(t, database, shard, dir)
+	defer closeFunc()
+	count, err := node.Add("count", 1, 0)
+	if err != nil || count != 2 {
+		t.Errorf("Unexpected count after a restart. Got: %d %v Expected: 2", count, err)
+	}
+	if err := node.CommitPrepared("txn-1"); err != nil {
+		t.Fatalf("Unexpected error with CommitPrepared: %v", err)
+	}
+	if value, err := database.GetKey("stock"); err != nil || string(value) != "0" {
+		t.Errorf("Unexpected value after the commit. Got: %q %v Expected: 0", value, err)
+	}
+}
@@ -0,0 +1,199 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"cs553/pkg/cluster"
+	"cs553/pkg/db"
+	"cs553/pkg/merkle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// repairer catches divergence that streaming cannot see, such as a change
+// that was lost or applied twice, by comparing the replica's Merkle tree with
+// the master's and copying over the keys of the leaves that differ. Writes
+// the replica has not streamed yet show up as differences too, which only
+// means they arrive a little early.
+type repairer struct {
+	db         db.Database
+	membership *cluster.Membership
+	shard      int
+	client     *http.Client
+}
+
+// RepairReplica runs an anti-entropy pass against the master of the shard
+// every interval until ctx is cancelled.
+func RepairReplica(ctx context.Context, database db.Database, membership *cluster.Membership, shard int, interval time.Duration) {
+	rp := &repairer{
+		db:         database,
+		membership: membership,
+		shard:      shard,
+		client:     &http.Client{Timeout: pollWait},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if err := rp.repair(ctx); err != nil {
+			log.Printf("anti-entropy repair failed: %v", err)
+		}
+	}
+}
+
+func (rp *repairer) get(ctx context.Context, master cluster.Master, path string, u url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+master.Address+path+"?"+u.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("master returned %s: %s", resp.Status, body)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// remoteHashes fetches the master's hashes of the given nodes of a level,
+// asking for each run of consecutive nodes in a single request.
+func (rp *repairer) remoteHashes(ctx context.Context, master cluster.Master, level int, nodes []int) (map[int]merkle.Hash, error) {
+	hashes := make(map[int]merkle.Hash, len(nodes))
+	for start := 0; start < len(nodes); {
+		end := start + 1
+		for end < len(nodes) && nodes[end] == nodes[end-1]+1 {
+			end++
+		}
+		from, to := nodes[start], nodes[end-1]+1
+
+		u := url.Values{}
+		u.Set("level", strconv.Itoa(level))
+		u.Set("from", strconv.Itoa(from))
+		u.Set("to", strconv.Itoa(to))
+		var batch []merkle.Hash
+		if err := rp.get(ctx, master, "/merkle", u, &batch); err != nil {
+			return nil, err
+		}
+		if len(batch) != to-from {
+			return nil, fmt.Errorf("master returned %d hashes for nodes %d to %d", len(batch), from, to)
+		}
+		for i, h := range batch {
+			hashes[from+i] = h
+		}
+		start = end
+	}
+	return hashes, nil
+}
+
+// differingLeaves walks down from the root, only descending into the nodes
+// whose hashes differ from the master's.
+func (rp *repairer) differingLeaves(ctx context.Context, master cluster.Master, local *merkle.Tree) ([]int, error) {
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		remote, err := rp.remoteHashes(ctx, master, level, nodes)
+		if err != nil {
+			return nil, err
+		}
+		var differing []int
+		for _, i := range nodes {
+			if remote[i] != local.Node(level, i) {
+				differing = append(differing, i)
+			}
+		}
+		if level == merkle.Depth || len(differing) == 0 {
+			return differing, nil
+		}
+		nodes = nodes[:0]
+		for _, i := range differing {
+			nodes = append(nodes, 2*i, 2*i+1)
+		}
+	}
+}
+
+func (rp *repairer) repair(ctx context.Context) error {
+	applied, err := rp.db.LastAppliedSequence()
+	if err != nil || applied == 0 {
+		// nothing to compare before the first snapshot has loaded
+		return err
+	}
+	master := rp.membership.Master(rp.shard)
+
+	local, err := merkle.Build(db.ForEachValue(rp.db))
+	if err != nil {
+		return err
+	}
+	leaves, err := rp.differingLeaves(ctx, master, local)
+	if err != nil || len(leaves) == 0 {
+		return err
+	}
+
+	// the local keys are read before the master's, so that a key streaming
+	// applies in between is not taken for one the master no longer has
+	inLeaves := make(map[int]bool, len(leaves))
+	for _, leaf := range leaves {
+		inLeaves[leaf] = true
+	}
+	stale := make(map[string][]byte)
+	err = rp.db.ForEach(func(key string, value []byte, _ uint64) error {
+		if inLeaves[merkle.Leaf(key)] {
+			stale[key] = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if applied, err = rp.db.LastAppliedSequence(); err != nil {
+		return err
+	}
+	u := url.Values{}
+	for _, leaf := range leaves {
+		u.Add("leaf", strconv.Itoa(leaf))
+	}
+	var entries []SnapshotEntry
+	if err := rp.get(ctx, master, "/merkle/keys", u, &entries); err != nil {
+		return err
+	}
+	// a change streamed while the master's keys were on their way may be
+	// newer than them, so the pass is left to the next one
+	if now, err := rp.db.LastAppliedSequence(); err != nil || now != applied {
+		return err
+	}
+
+	repaired := 0
+	for _, entry := range entries {
+		value, ok := stale[entry.Key]
+		delete(stale, entry.Key)
+		if ok && bytes.Equal(value, entry.Value) {
+			continue
+		}
+		// loaded like a snapshot entry so that the key keeps its expiry
+		if err := rp.db.LoadSnapshot([]db.Change{{Key: entry.Key, Value: entry.Value, ExpiresAt: entry.ExpiresAt}}); err != nil {
+			return err
+		}
+		repaired++
+	}
+	for key := range stale {
+		if err := rp.db.DeleteKeyReplica(key); err != nil {
+			return err
+		}
+		repaired++
+	}
+	if repaired > 0 {
+		log.Printf("anti-entropy repaired %d keys in %d leaves from %q", repaired, len(leaves), master.Address)
+	}
+	return nil
+}
@@ -1,93 +1,249 @@
 package replication
 
 import (
-	"bytes"
+	"context"
+	"cs553/pkg/cluster"
 	"cs553/pkg/db"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"time"
 )
 
-type ReplicateKeyValue struct {
-	Key   string
-	Value string
-	Err   error
+const (
+	batchSize = 500
+	pollWait  = 10 * time.Second
+	// snapshotIdle is how long a snapshot download waits for the master
+	snapshotIdle = 30 * time.Second
+)
+
+type ChangeBatch struct {
+	Changes []db.Change
+}
+
+type SnapshotEntry struct {
+	Key       string `json:",omitempty"`
+	Value     []byte `json:",omitempty"`
+	ExpiresAt uint64 `json:",omitempty"`
+	Sequence  uint64 `json:",omitempty"`
+	Done      bool   `json:",omitempty"`
+}
+
+// errNeedsSnapshot is returned when the master no longer has the changes
+// following the replica's position.
+var errNeedsSnapshot = errors.New("replica fell behind the retained history")
+
+// sourceTermKey holds the term of the master the replica's data came from.
+// Sequences of different masters are unrelated, so a replica reloads a
+// snapshot whenever the master of its shard changes.
+const sourceTermKey = "replication-term"
+
+func sourceTerm(database db.Database) (uint64, error) {
+	raw, err := database.GetMeta(sourceTermKey)
+	if err != nil || raw == nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(raw), 10, 64)
 }
 
 type ReplicationClient struct {
-	db            db.Database
-	masterAddress string
+	db             db.Database
+	membership     *cluster.Membership
+	shard          int
+	replicaAddress string
+	client         *http.Client
+	snapshotClient *http.Client
+	bootstrapped   bool
 }
 
-func PropagateReplication(db db.Database, masterAddress string) {
+// PropagateReplication keeps the replica up to date with whichever node is
+// the master of the shard until ctx is cancelled.
+func PropagateReplication(ctx context.Context, db db.Database, membership *cluster.Membership, shard int, replicaAddress string) {
 	rc := &ReplicationClient{
-		db:            db,
-		masterAddress: masterAddress,
+		db:             db,
+		membership:     membership,
+		shard:          shard,
+		replicaAddress: replicaAddress,
+		client:         &http.Client{Timeout: pollWait + 5*time.Second},
+		snapshotClient: &http.Client{},
 	}
-	for {
-		backlog, err := rc.replicationLoop()
-		if err != nil {
-			log.Printf("eror with replicationLoop: %v", err)
-			time.Sleep(time.Second)
+	for ctx.Err() == nil {
+		master := rc.membership.Master(rc.shard)
+		err := rc.replicationLoop(ctx, master)
+		if err == errNeedsSnapshot {
+			log.Printf("replica is too far behind %q, loading a snapshot", master.Address)
+			rc.bootstrapped = false
 			continue
 		}
-		if !backlog {
-			time.Sleep(time.Millisecond * 100)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("eror with replicationLoop: %v", err)
+			time.Sleep(time.Second)
 		}
 	}
 }
 
-func (rc *ReplicationClient) replicationLoop() (bool, error) {
-	resp, err := http.Get("http://" + rc.masterAddress + "/get-next-replication-key")
+// replicationLoop asks the master for the changes following the last
+// sequence applied locally. Requesting from a sequence acknowledges every
+// change before it, so nothing is lost if the replica dies mid-batch.
+func (rc *ReplicationClient) replicationLoop(ctx context.Context, master cluster.Master) error {
+	applied, err := rc.db.LastAppliedSequence()
 	if err != nil {
-		return false, err
+		return err
+	}
+	term, err := sourceTerm(rc.db)
+	if err != nil {
+		return err
+	}
+	if (applied == 0 && !rc.bootstrapped) || term != master.Term {
+		return rc.bootstrap(ctx, master)
+	}
+
+	u := url.Values{}
+	u.Set("replica", rc.replicaAddress)
+	u.Set("from", strconv.FormatUint(applied+1, 10))
+	u.Set("limit", strconv.Itoa(batchSize))
+	u.Set("wait", pollWait.String())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+master.Address+"/replication/stream?"+u.Encode(), nil)
+	if err != nil {
+		return err
 	}
-	var repKV ReplicateKeyValue
-	if err := json.NewDecoder(resp.Body).Decode(&repKV); err != nil {
-		return false, nil
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
-	if repKV.Err != nil {
-		return false, repKV.Err
+	if resp.StatusCode == http.StatusGone {
+		return errNeedsSnapshot
+	}
+	if resp.StatusCode != http.StatusOK {
+		out, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("master returned %s: %s", resp.Status, out)
+	}
+
+	var batch ChangeBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return fmt.Errorf("decoding change batch: %w", err)
 	}
-	if repKV.Key == "" {
-		return false, nil
+	if len(batch.Changes) == 0 {
+		return nil
 	}
 
-	if err := rc.db.PutKeyReplica(repKV.Key, []byte(repKV.Value)); err != nil {
-		return false, err
+	if err := rc.db.ApplyChanges(batch.Changes); err != nil {
+		return err
+	}
+	log.Printf("Applied changes %d to %d from %q", batch.Changes[0].Sequence, batch.Changes[len(batch.Changes)-1].Sequence, master.Address)
+	return nil
+}
+
+// bootstrap replaces the replica's data with a point-in-time dump from the
+// master and records the sequence it corresponds to, so that streaming picks
+// up right after it. The dump is staged in a file first, so the data of the
+// replica is only replaced by a snapshot that arrived whole. A replica that
+// dies while loading it starts over, since the applied sequence is only
+// written at the end.
+func (rc *ReplicationClient) bootstrap(ctx context.Context, master cluster.Master) error {
+	staged, err := rc.fetchSnapshot(ctx, master)
+	if err != nil {
+		return err
 	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
 
-	if err := rc.deleteFromQueue(repKV.Key, repKV.Value); err != nil {
-		log.Printf("deleteFromQueue failed with: %v", err)
+	if err := rc.db.ResetReplica(); err != nil {
+		return err
 	}
+	decoder := json.NewDecoder(staged)
+	batch := make([]db.Change, 0, batchSize)
+	loaded := 0
+	for {
+		var entry SnapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return fmt.Errorf("decoding snapshot: %w", err)
+		}
 
-	log.Printf("Next key value %+v", repKV)
-	return true, nil
+		if entry.Done || len(batch) == batchSize {
+			if err := rc.db.LoadSnapshot(batch); err != nil {
+				return err
+			}
+			loaded += len(batch)
+			batch = batch[:0]
+		}
+		if entry.Done {
+			if err := rc.db.SetAppliedSequence(entry.Sequence); err != nil {
+				return err
+			}
+			if err := rc.db.PutMeta(sourceTermKey, []byte(strconv.FormatUint(master.Term, 10))); err != nil {
+				return err
+			}
+			rc.bootstrapped = true
+			log.Printf("Loaded snapshot of %d keys at sequence %d from %q", loaded, entry.Sequence, master.Address)
+			return nil
+		}
+		batch = append(batch, db.Change{Key: entry.Key, Value: entry.Value, ExpiresAt: entry.ExpiresAt})
+	}
 }
 
-func (rc *ReplicationClient) deleteFromQueue(key, value string) error {
+// fetchSnapshot downloads a snapshot of the master into a temporary file,
+// rewound to its start, and checks that it ends with Done. A snapshot can
+// take much longer than a poll, so rather than a deadline for the whole of
+// it, the download fails once the master sends nothing for snapshotIdle.
+func (rc *ReplicationClient) fetchSnapshot(ctx context.Context, master cluster.Master) (*os.File, error) {
 	u := url.Values{}
-	u.Set("key", key)
-	u.Set("value", value)
+	u.Set("replica", rc.replicaAddress)
 
-	log.Printf("Deleting key=%q, value=%q from replication queue on %q", key, value, rc.masterAddress)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(snapshotIdle, cancel)
+	defer idle.Stop()
 
-	resp, err := http.Get("http://" + rc.masterAddress + "/delete-next-replication-key?" + u.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+master.Address+"/replication/snapshot?"+u.Encode(), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	out, err := ioutil.ReadAll(resp.Body)
+	resp, err := rc.snapshotClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !bytes.Equal(out, []byte("ok \n")) {
-		return fmt.Errorf(string(out))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		out, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("master returned %s: %s", resp.Status, out)
 	}
-	return nil
+
+	staged, err := ioutil.TempFile("", "snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		staged.Close()
+		os.Remove(staged.Name())
+		return nil, err
+	}
+	decoder := json.NewDecoder(io.TeeReader(resp.Body, staged))
+	for {
+		idle.Reset(snapshotIdle)
+		var entry SnapshotEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return fail(fmt.Errorf("snapshot ended before it was complete"))
+			}
+			return fail(fmt.Errorf("receiving snapshot: %w", err))
+		}
+		if entry.Done {
+			break
+		}
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return staged, nil
 }
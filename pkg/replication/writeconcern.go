@@ -0,0 +1,66 @@
+package replication
+
+import (
+	"cs553/pkg/config"
+	"cs553/pkg/db"
+	"time"
+)
+
+// RequiredAcks returns how many of the shard's replicas must have a write
+// to satisfy the write concern. Asking for more replicas than the shard has
+// is capped at the number of replicas.
+func RequiredAcks(wc config.WriteConcern, replicas int) int {
+	required := 0
+	switch wc {
+	case config.WriteConcernOne:
+		required = 1
+	case config.WriteConcernMajority:
+		// a majority of the master plus its replicas, not counting the master
+		required = (replicas + 1) / 2
+	case config.WriteConcernAll:
+		required = replicas
+	}
+	if required > replicas {
+		required = replicas
+	}
+	return required
+}
+
+// MetWriteConcern returns the strongest write concern satisfied by acked
+// replicas out of the shard's replicas.
+func MetWriteConcern(acked, replicas int) config.WriteConcern {
+	for _, wc := range []config.WriteConcern{config.WriteConcernAll, config.WriteConcernMajority, config.WriteConcernOne} {
+		if replicas > 0 && acked >= RequiredAcks(wc, replicas) {
+			return wc
+		}
+	}
+	return config.WriteConcernAsync
+}
+
+// WaitForReplicas blocks until required replicas have acknowledged every
+// change up to seq, or until the timeout, and returns how many did.
+func WaitForReplicas(database db.Database, seq uint64, required int, timeout time.Duration) (int, error) {
+	deadline := time.After(timeout)
+	for {
+		ackCh := database.WaitForAcks()
+		ackedSequences, err := database.AckedSequences()
+		if err != nil {
+			return 0, err
+		}
+		acked := 0
+		for _, ackedSeq := range ackedSequences {
+			if ackedSeq >= seq {
+				acked++
+			}
+		}
+		if acked >= required {
+			return acked, nil
+		}
+
+		select {
+		case <-ackCh:
+		case <-deadline:
+			return acked, nil
+		}
+	}
+}